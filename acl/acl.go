@@ -0,0 +1,329 @@
+// Package acl decides whether an authenticated user may reach a destination.
+//
+// # Rule file
+//
+// A rule file contains one rule or directive per line, "#" starts a comment.
+// A rule looks like:
+//
+//	<user> <allow|deny> <tcp|udp|any> <destination> [ports]
+//
+// Where:
+// user is a username or "*" for everyone.
+// destination is a CIDR, an IP, a hostname glob like "*.example.com" or "*".
+// ports is a comma separated list of ports or port ranges like "80,8000-8080",
+// it matches all ports if omitted or "*".
+//
+// Unix domain socket destinations are matched by rules of protocol "unix"
+// only, whose destination is a path glob like "/run/app/*.sock" or "*", and
+// which take no ports:
+//
+//	<user> <allow|deny> unix <path>
+//
+// Rules are evaluated in order, the first matching one decides. If no rule
+// matches, private, loopback and link-local destinations and unix domain
+// sockets are denied, and the others are decided by the
+// "default <allow|deny>" directive, which is deny if absent.
+// Without any rules, [Builtin] applies.
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type Action int
+
+const (
+	Deny Action = iota
+	Allow
+)
+
+func (a Action) String() string {
+	if a == Allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// Dest is a destination to be checked.
+type Dest struct {
+	Host  string // Host name as configured, may be an IP literal
+	IP    net.IP // Resolved address of Host
+	Port  uint16
+	Proto string // "tcp", "udp" or "unix", where Host is the socket path
+}
+
+func (d Dest) String() string {
+	if d.Proto == "unix" {
+		return "unix " + d.Host
+	}
+	if d.IP == nil || d.Host == d.IP.String() {
+		return fmt.Sprintf("%s %s", d.Proto, net.JoinHostPort(d.Host, strconv.Itoa(int(d.Port))))
+	}
+	return fmt.Sprintf(
+		"%s %s (%s)", d.Proto,
+		net.JoinHostPort(d.Host, strconv.Itoa(int(d.Port))), d.IP,
+	)
+}
+
+type portRange struct {
+	min, max uint16
+}
+
+type Rule struct {
+	User   string
+	Action Action
+	Proto  string
+	net    *net.IPNet
+	glob   string
+	ports  []portRange
+	text   string
+	line   int
+}
+
+// String returns the rule as written in the rule file, along with its line
+// number.
+func (r *Rule) String() string {
+	return fmt.Sprintf("line %d: %s", r.line, r.text)
+}
+
+func (r *Rule) match(usr string, d Dest) bool {
+	if r.User != "*" && r.User != usr {
+		return false
+	}
+	if r.Proto != d.Proto && (r.Proto != "any" || d.Proto == "unix") {
+		return false
+	}
+	if d.Proto == "unix" {
+		ok, _ := path.Match(r.glob, d.Host)
+		return r.glob == "*" || ok
+	}
+
+	switch {
+	case r.net != nil:
+		if d.IP == nil || !r.net.Contains(d.IP) {
+			return false
+		}
+	case r.glob != "":
+		if r.glob != "*" {
+			ok, _ := path.Match(r.glob, strings.ToLower(d.Host))
+			if !ok {
+				return false
+			}
+		}
+	}
+
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, pr := range r.ports {
+		if d.Port >= pr.min && d.Port <= pr.max {
+			return true
+		}
+	}
+	return false
+}
+
+// Decision is the result of [ACL.Check].
+// Rule is the rule matched, nil if none did.
+type Decision struct {
+	Action Action
+	Rule   *Rule
+	Reason string
+}
+
+func (d Decision) String() string {
+	if d.Rule != nil {
+		return fmt.Sprintf("%s by rule %s", d.Action, d.Rule)
+	}
+	return fmt.Sprintf("%s by %s", d.Action, d.Reason)
+}
+
+// All methods can be called simultaneously.
+type ACL struct {
+	rules   []*Rule
+	Default Action
+}
+
+func (a *ACL) Check(usr string, d Dest) Decision {
+	for _, r := range a.rules {
+		if r.match(usr, d) {
+			return Decision{Action: r.Action, Rule: r}
+		}
+	}
+	if d.Proto == "unix" {
+		return Decision{Action: Deny, Reason: "unix socket destination"}
+	}
+	if d.IP != nil && IsPrivate(d.IP) {
+		return Decision{Action: Deny, Reason: "private destination"}
+	}
+	return Decision{Action: a.Default, Reason: "default policy"}
+}
+
+// Builtin is the ACL of servers without rules, allowing all destinations but
+// private ones and unix domain sockets.
+var Builtin = &ACL{Default: Allow}
+
+// IsPrivate reports whether ip is a private, loopback, link-local or
+// unspecified address.
+func IsPrivate(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// New returns an empty ACL, whose default action is deny.
+func New() *ACL {
+	return &ACL{Default: Deny}
+}
+
+// AddRule parses a rule or directive in the syntax of a rule file line, and
+// appends it to a. line is used to identify the rule in decisions.
+func (a *ACL) AddRule(text string, line int) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return fmt.Errorf("empty rule")
+	}
+	return a.parseLine(text, line)
+}
+
+func Load(name string) (*ACL, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+func Parse(r io.Reader) (*ACL, error) {
+	a := New()
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if err := a.parseLine(text, line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *ACL) parseLine(text string, line int) error {
+	fields := strings.Fields(text)
+
+	if fields[0] == "default" {
+		if len(fields) != 2 {
+			return fmt.Errorf("expecting \"default <allow|deny>\"")
+		}
+		act, err := parseAction(fields[1])
+		if err != nil {
+			return err
+		}
+		a.Default = act
+		return nil
+	}
+
+	if len(fields) < 4 || len(fields) > 5 {
+		return fmt.Errorf("expecting \"<user> <allow|deny> <tcp|udp|any|unix> <destination> [ports]\"")
+	}
+
+	r := &Rule{
+		User: fields[0],
+		text: strings.Join(fields, " "),
+		line: line,
+	}
+
+	var err error
+	if r.Action, err = parseAction(fields[1]); err != nil {
+		return err
+	}
+
+	switch fields[2] {
+	case "tcp", "udp", "any":
+		r.Proto = fields[2]
+	case "unix":
+		if len(fields) == 5 {
+			return fmt.Errorf("expecting no ports for unix destination")
+		}
+		r.Proto, r.glob = "unix", fields[3]
+		if _, err := path.Match(r.glob, ""); err != nil {
+			return fmt.Errorf("invalid destination %q: %w", fields[3], err)
+		}
+		a.rules = append(a.rules, r)
+		return nil
+	default:
+		return fmt.Errorf("unknown protocol %q", fields[2])
+	}
+
+	dest := fields[3]
+	if _, n, err := net.ParseCIDR(dest); err == nil {
+		r.net = n
+	} else if ip := net.ParseIP(dest); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		r.glob = strings.ToLower(dest)
+		if _, err := path.Match(r.glob, ""); err != nil {
+			return fmt.Errorf("invalid destination %q: %w", dest, err)
+		}
+	}
+
+	if len(fields) == 5 && fields[4] != "*" {
+		for _, s := range strings.Split(fields[4], ",") {
+			pr, err := parsePortRange(s)
+			if err != nil {
+				return err
+			}
+			r.ports = append(r.ports, pr)
+		}
+	}
+
+	a.rules = append(a.rules, r)
+	return nil
+}
+
+func parseAction(s string) (Action, error) {
+	switch s {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	}
+	return Deny, fmt.Errorf("unknown action %q", s)
+}
+
+func parsePortRange(s string) (portRange, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	min, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", lo)
+	}
+	max := min
+	if isRange {
+		max, err = strconv.ParseUint(hi, 10, 16)
+		if err != nil {
+			return portRange{}, fmt.Errorf("invalid port %q", hi)
+		}
+	}
+	if min > max {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return portRange{uint16(min), uint16(max)}, nil
+}
@@ -0,0 +1,147 @@
+package acl
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testRules = `
+# Everyone may reach the web servers.
+*     allow tcp 10.1.0.0/16    80,443
+alice allow any 192.168.1.10   *
+bob   deny  tcp *.example.com  8000-8080
+*     allow tcp *.example.com
+default allow
+`
+
+func TestCheck(t *testing.T) {
+	a, err := Parse(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		usr  string
+		dest Dest
+		want Action
+	}{
+		{"bob", Dest{"10.1.2.3", net.ParseIP("10.1.2.3"), 443, "tcp"}, Allow},
+		{"bob", Dest{"10.1.2.3", net.ParseIP("10.1.2.3"), 22, "tcp"}, Deny},
+		{"bob", Dest{"10.1.2.3", net.ParseIP("10.1.2.3"), 443, "udp"}, Deny},
+		{"alice", Dest{"192.168.1.10", net.ParseIP("192.168.1.10"), 53, "udp"}, Allow},
+		{"bob", Dest{"192.168.1.10", net.ParseIP("192.168.1.10"), 53, "udp"}, Deny},
+		{"bob", Dest{"api.example.com", net.ParseIP("8.8.8.8"), 8080, "tcp"}, Deny},
+		{"alice", Dest{"API.example.com", net.ParseIP("8.8.8.8"), 8080, "tcp"}, Allow},
+		{"bob", Dest{"localhost", net.ParseIP("127.0.0.1"), 22, "tcp"}, Deny},
+		{"bob", Dest{"one.one", net.ParseIP("1.1.1.1"), 53, "udp"}, Allow},
+	}
+	for _, c := range cases {
+		if got := a.Check(c.usr, c.dest); got.Action != c.want {
+			t.Errorf("%s to %s: want %s, got %s", c.usr, c.dest, c.want, got)
+		}
+	}
+}
+
+func TestCheckUnixAndBuiltin(t *testing.T) {
+	a, err := Parse(strings.NewReader("alice allow unix /run/app/*.sock\n* allow any *\ndefault allow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		acl  *ACL
+		usr  string
+		dest Dest
+		want Action
+	}{
+		{a, "alice", Dest{Host: "/run/app/web.sock", Proto: "unix"}, Allow},
+		{a, "alice", Dest{Host: "/run/other.sock", Proto: "unix"}, Deny},
+		{a, "bob", Dest{Host: "/run/app/web.sock", Proto: "unix"}, Deny},
+		{Builtin, "bob", Dest{"one.one", net.ParseIP("1.1.1.1"), 53, "udp"}, Allow},
+		{Builtin, "bob", Dest{"localhost", net.ParseIP("127.0.0.1"), 22, "tcp"}, Deny},
+		{Builtin, "bob", Dest{"lan", net.ParseIP("192.168.1.10"), 80, "tcp"}, Deny},
+		{Builtin, "bob", Dest{Host: "/run/app/web.sock", Proto: "unix"}, Deny},
+	}
+	for _, c := range cases {
+		if got := c.acl.Check(c.usr, c.dest); got.Action != c.want {
+			t.Errorf("%s to %s: want %s, got %s", c.usr, c.dest, c.want, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	bad := []string{
+		"* allow",
+		"* permit tcp *",
+		"* allow icmp *",
+		"* allow tcp * 80-",
+		"* allow tcp * 90-80",
+		"* allow tcp [ 80",
+		"* allow unix /run/x.sock 80",
+		"default maybe",
+	}
+	for _, s := range bad {
+		if _, err := Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: expecting error", s)
+		}
+	}
+}
+
+func TestSourceFilter(t *testing.T) {
+	f, err := NewSourceFilter([]string{"10.0.0.0/8", "192.168.1.1"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.2.3.4"), Port: 1}, true},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, false}, // Denied over allowed
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 1}, false},
+		{&net.UnixAddr{Name: "/run/xcat.sock", Net: "unix"}, true},
+	}
+	for _, c := range cases {
+		if ok, _ := f.Check(c.addr); ok != c.want {
+			t.Errorf("%s: want %v, got %v", c.addr, c.want, ok)
+		}
+	}
+	if ok, cnt := f.Check(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 2}); ok || cnt != 2 {
+		t.Errorf("want rejected twice, got %v, %d", ok, cnt)
+	}
+	total, byIP := f.Rejected()
+	if total != 3 || byIP["10.1.2.3"] != 2 || byIP["192.168.1.2"] != 1 {
+		t.Errorf("unexpected rejections %d %v", total, byIP)
+	}
+
+	var none *SourceFilter
+	if ok, _ := none.Check(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}); !ok {
+		t.Error("nil filter rejected")
+	}
+}
+
+func TestSourceFilterCap(t *testing.T) {
+	f, err := NewSourceFilter(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxRejectedIPs+10; i++ {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		want := 1
+		if i >= MaxRejectedIPs {
+			want = 0 // Not counted apart
+		}
+		if _, cnt := f.Check(&net.TCPAddr{IP: ip}); cnt != want {
+			t.Fatalf("peer %d: want count %d, got %d", i, want, cnt)
+		}
+	}
+	// Peers counted apart still are.
+	if _, cnt := f.Check(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 0)}); cnt != 2 {
+		t.Errorf("want count 2 of a counted peer, got %d", cnt)
+	}
+	total, byIP := f.Rejected()
+	if total != MaxRejectedIPs+11 || byIP[OtherIPs] != 10 || len(byIP) != MaxRejectedIPs+1 {
+		t.Errorf("got total %d, %d others, %d keys", total, byIP[OtherIPs], len(byIP))
+	}
+}
@@ -0,0 +1,142 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// SourceFilter decides whether a peer may connect by its IP, before any
+// handshake takes place.
+// A peer is rejected if its IP is in the deny list, or if the allow list is
+// not empty and the IP is not in it. Peers without an IP, like those connected
+// through unix domain sockets, are always accepted.
+//
+// A nil SourceFilter accepts every peer.
+// All methods can be called simultaneously.
+type SourceFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	mux      sync.Mutex
+	rejected map[string]int
+	total    int
+}
+
+// MaxRejectedIPs is the max number of peer IPs whose rejections are counted
+// apart, rejections of other peers are counted under [OtherIPs].
+const MaxRejectedIPs = 1024
+
+// OtherIPs is the key of peers not counted apart in [SourceFilter.Rejected].
+const OtherIPs = "other"
+
+// NewSourceFilter parses lists of CIDRs or IPs.
+func NewSourceFilter(allow, deny []string) (*SourceFilter, error) {
+	f := &SourceFilter{rejected: make(map[string]int)}
+	var err error
+	if f.allow, err = parseNets(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseNets(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ParseNetList splits a comma separated list, ignoring empty items.
+func ParseNetList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func parseNets(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if _, n, err := net.ParseCIDR(s); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid CIDR or IP %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// Check reports whether the peer at addr is accepted, and counts it if not.
+// cnt is the number of times the peer has been rejected so far, or 0 if the
+// peer is beyond [MaxRejectedIPs] and not counted apart.
+func (f *SourceFilter) Check(addr net.Addr) (ok bool, cnt int) {
+	if f == nil {
+		return true, 0
+	}
+
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return true, 0
+	}
+
+	if f.accepts(ip) {
+		return true, 0
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.total++
+	key := ip.String()
+	if _, ok := f.rejected[key]; !ok && len(f.rejected) >= MaxRejectedIPs {
+		f.rejected[OtherIPs]++
+		return false, 0
+	}
+	f.rejected[key]++
+	return false, f.rejected[key]
+}
+
+func (f *SourceFilter) accepts(ip net.IP) bool {
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rejected returns the total number of rejections, and a copy of the number
+// of rejections by peer IP, with up to [MaxRejectedIPs] IPs and [OtherIPs].
+func (f *SourceFilter) Rejected() (total int, byIP map[string]int) {
+	if f == nil {
+		return 0, nil
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	byIP = make(map[string]int, len(f.rejected))
+	for k, v := range f.rejected {
+		byIP[k] = v
+	}
+	return f.total, byIP
+}
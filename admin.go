@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/tunnel"
+	"github.com/fishBone000/xcat/util"
+)
+
+// adminSessions are control links and relays listed and killed by the admin
+// endpoint.
+type adminSessions interface {
+	CtrlLinks() []tunnel.CtrlLinkInfo
+	Relays() []tunnel.RelayInfo
+	KillRelay(id int) bool
+	KillUser(user string) int
+}
+
+// reloadRequests carry reloads requested by the admin endpoint to waitStop,
+// which sends the result back.
+var reloadRequests = make(chan chan error)
+
+// adminStatus is the reply of /status.
+type adminStatus struct {
+	Mode      string                `json:"mode"`
+	Version   string                `json:"version"`
+	CtrlLinks []tunnel.CtrlLinkInfo `json:"ctrl_links"`
+	Relays    []tunnel.RelayInfo    `json:"relays"`
+	Rejected  adminRejected         `json:"rejected"`
+}
+
+// adminRejected is about peers rejected by the source address filter since
+// it's loaded, see [acl.SourceFilter.Rejected].
+type adminRejected struct {
+	Total int            `json:"total"`
+	ByIP  map[string]int `json:"by_ip,omitempty"`
+}
+
+// adminUpdate is a line of /feed.
+type adminUpdate struct {
+	Time time.Time `json:"time"`
+	adminStatus
+	Logs []*log.Entry `json:"logs"` // Warnings and errors since the last update
+}
+
+// adminEndpoint serves the admin API:
+//
+//	GET  /status               adminStatus in JSON
+//	GET  /feed?interval=1s     adminUpdate in JSON lines, every interval
+//	POST /kill?relay=ID        Closes the relay of ID
+//	POST /kill?user=NAME       Closes control links and relays of user NAME
+//	POST /reload               Reloads the configuration
+//
+// Requests must carry the token configured as "Authorization: Bearer TOKEN"
+// if any.
+type adminEndpoint struct {
+	addr    string
+	handler http.Handler
+	l       net.Listener
+}
+
+// serveAdmin serves the admin endpoint of s if enabled, on the listener in
+// inherited first. nil is returned if disabled.
+func serveAdmin(s *settings, sess adminSessions, inherited map[string]*util.MultiListenerTCP) (*adminEndpoint, error) {
+	addr := s.Admin.Listen
+	if addr == "" {
+		return nil, nil
+	}
+	a := &adminEndpoint{addr: addr, handler: adminHandler(sess)}
+	if l := inherited[addr]; l != nil {
+		delete(inherited, addr)
+		a.serve(l)
+		return a, nil
+	}
+	if err := a.listen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *adminEndpoint) listen() error {
+	l, err := util.ListenStream(a.addr, os.FileMode(cur.Load().UnixPerm))
+	if err != nil {
+		return err
+	}
+	a.serve(l)
+	return nil
+}
+
+func (a *adminEndpoint) serve(l net.Listener) {
+	a.l = l
+	log.Infof("Serving admin endpoint on %s. ", a.addr)
+	go func() {
+		err := http.Serve(l, a.handler)
+		if !stopping.Get() && !errors.Is(err, net.ErrClosed) {
+			log.Errf("Admin endpoint stopped: %v. ", err)
+		}
+	}()
+}
+
+// prepareHandOff adds the listener to listeners if it can be handed off.
+// Otherwise it's closed so that the new process can listen on the address,
+// and the returned function listens again, for the hand off failed.
+func (a *adminEndpoint) prepareHandOff(listeners map[string]*util.MultiListenerTCP) (undo func()) {
+	if l, ok := a.l.(*util.MultiListenerTCP); ok {
+		listeners[a.addr] = l
+		return func() {}
+	}
+	util.CloseCloser(a.l)
+	return func() {
+		if err := a.listen(); err != nil {
+			log.Errf("Failed to listen admin endpoint again: %v. ", err)
+		}
+	}
+}
+
+func (a *adminEndpoint) Close() error {
+	return a.l.Close()
+}
+
+func adminHandler(sess adminSessions) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newAdminStatus(sess))
+	})
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		interval := time.Second
+		if v := r.URL.Query().Get("interval"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 100*time.Millisecond {
+				http.Error(w, "invalid interval, expecting 100ms or longer", http.StatusBadRequest)
+				return
+			}
+			interval = d
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var seq uint64
+		for {
+			u := &adminUpdate{Time: time.Now(), adminStatus: *newAdminStatus(sess), Logs: []*log.Entry{}}
+			var es []log.Entry
+			es, seq = logHistory.Since(seq)
+			for i := range es {
+				u.Logs = append(u.Logs, &es[i])
+			}
+			if err := enc.Encode(u); err != nil {
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/kill", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		switch {
+		case q.Has("relay"):
+			id, err := strconv.Atoi(q.Get("relay"))
+			if err != nil {
+				http.Error(w, "invalid relay id", http.StatusBadRequest)
+				return
+			}
+			if !sess.KillRelay(id) {
+				http.Error(w, "relay not found", http.StatusNotFound)
+				return
+			}
+			log.Infof("Killed relay %d by admin request. ", id)
+			writeKilled(w, 1)
+		case q.Has("user"):
+			user := q.Get("user")
+			n := sess.KillUser(user)
+			log.Infof("Killed %d control links and relays of user %s by admin request. ", n, user)
+			writeKilled(w, n)
+		default:
+			http.Error(w, "expecting relay or user", http.StatusBadRequest)
+		}
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		done := make(chan error, 1)
+		select {
+		case reloadRequests <- done:
+		case <-r.Context().Done():
+			return
+		}
+		if err := <-done; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := cur.Load().Admin.Token
+		if len(token) > 0 {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), token) != 1 {
+				log.Warnf("Unauthorized admin request %s %s. ", r.Method, r.URL.Path)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func newAdminStatus(sess adminSessions) *adminStatus {
+	s := cur.Load()
+	st := &adminStatus{
+		Mode:      s.Mode,
+		Version:   version,
+		CtrlLinks: sess.CtrlLinks(),
+		Relays:    sess.Relays(),
+	}
+	st.Rejected.Total, st.Rejected.ByIP = s.SourceFilter().Rejected()
+	return st
+}
+
+func writeKilled(w http.ResponseWriter, n int) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"killed": n})
+}
@@ -1,60 +1,277 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/fishBone000/xcat/acl"
+	"github.com/fishBone000/xcat/config"
 	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/ratelimit"
+	"github.com/fishBone000/xcat/util"
 )
 
-const (
-	ModeServer = "server"
-	ModeClient = "client"
-)
-
-// Cmd line arguments
+// Cmd line arguments, those explicitly set override the configuration file
 var (
+	ConfigFile            string
 	Mode                  string
 	Host                  string
 	Port                  int
 	Usr                   string
 	Pwd                   string
+	UsrFile               string
+	PwdFile               string
 	LAddr                 string
-	LHost                 string
-	DataLinkListenTimeout uint // TODO int might be better for these timeouts? What if they overflow?
-	CtrlLinkTimeout       uint
-	UDPTimeout            uint
+	DataLinkListenTimeout = durationFlag(15 * time.Second)
+	CtrlLinkTimeout       = durationFlag(5 * time.Second)
+	Heartbeat             = durationFlag(15 * time.Second)
+	UDPTimeout            = durationFlag(180 * time.Second)
 	Version               bool
 	LogLevel              int
-)
-
-// Variables after parsing
-var (
-	Addr string // Combination of Host and Port
+	ExecCmd               string
+	UserExecCmds          = userCmdFlag{}
+	UnixPerm              = permFlag(0600)
+	ACLFile               string
+	AllowSrc              string
+	DenySrc               string
+	RateUp                rateFlag
+	RateDown              rateFlag
+	RateUser              rateFlag
+	RateConn              rateFlag
+	MaxCtrlLinksPerUser   int
+	MaxCtrlLinksPerIP     int
+	MaxPending            int
+	MaxRelays             int
+	DrainTimeout          = durationFlag(30 * time.Second)
+	MetricsAddr           string
+	LogFormat             string
+	LogFile               string
+	LogLevels             = levelsFlag{}
+	StatFile              string
+	UDPMux                bool
+	UDPTransport          string
+	UDPMTU                int
+	UDPOversize           string
 )
 
 func specifyFlags() {
+	flag.StringVar(&ConfigFile, "c", "", "configuration file, flags set explicitly override values in it")
 	flag.StringVar(&Mode, "m", "", "run mode, can be server or client, cannot be empty")
 	flag.StringVar(&Host, "h", "", "host name")
 	flag.IntVar(&Port, "p", 0, "port")
 	flag.StringVar(&Usr, "U", "", "username for authentication")
-	flag.StringVar(&Pwd, "P", "", "password for authentication")
+	flag.StringVar(&Pwd, "P", "", "password for authentication, visible to other local users, prefer -password-file or "+envPassword)
+	flag.StringVar(&UsrFile, "user-file", "", "file containing the username, like -U, "+envUsername+" is read if neither is set")
+	flag.StringVar(&PwdFile, "password-file", "", "file containing the password, like -P, "+envPassword+" is read if neither is set")
 	flag.StringVar(&LAddr, "l", ":1080", "listening address")
-	flag.UintVar(&DataLinkListenTimeout, "t", 15, "timeout (sec) for listening incoming data link, effective on server side only")
-	flag.UintVar(&CtrlLinkTimeout, "T", 5, "timeout (sec) for establishing control link an dport query, effective on client side only")
-	flag.UintVar(&UDPTimeout, "u", 180, "timeout (sec) for UDP relaying, effective on client side only")
+	flag.Var(&DataLinkListenTimeout, "t", "timeout (duration like 15s, or secs) for listening incoming data link, effective on server side only")
+	flag.Var(&CtrlLinkTimeout, "T", "timeout for establishing control link and port query, effective on client side only")
+	flag.Var(&Heartbeat, "heartbeat", "interval of heartbeats on control links, 0 to disable, effective on client side only")
+	flag.BoolVar(&UDPMux, "udp-mux", false, "relay UDP inbounds as flows of one data link, the server must support it, effective on client side only")
+	flag.StringVar(&UDPTransport, "udp-transport", "auto", "how UDP datagrams are carried, udp, tcp over data link connections, or auto for tcp while UDP is blocked, effective on client side only")
+	flag.IntVar(&UDPMTU, "udp-mtu", 0, "path MTU to the server for UDP relaying, 0 to discover, effective on client side only")
+	flag.StringVar(&UDPOversize, "udp-oversize", "fragment", "what to do with UDP datagrams over the payload MTU, fragment or reject, effective on client side only")
+	flag.Var(&UDPTimeout, "u", "timeout for UDP relaying, effective on client side only")
 	flag.BoolVar(&Version, "v", false, "print version number")
 	flag.IntVar(&LogLevel, "d", 2, "log level, 0: err, 1: warn, 2: info, 3: dbg")
+	flag.Var(LogLevels, "log-levels", "comma separated subsystem=level, overriding -d for subsystems "+strings.Join(log.Subsystems, ", ")+", can be repeated")
+	flag.StringVar(&LogFormat, "log-format", "text", "log format, text or json")
+	flag.StringVar(&LogFile, "log-file", "", "file to write logs to instead of standard output, rotated as configured")
+	flag.StringVar(&ExecCmd, "e", "", "command to run for each TCP data link instead of dialing host, effective on server side only")
+	flag.Var(UserExecCmds, "E", "user=command, like -e but only for the given user, can be repeated")
+	flag.StringVar(&ACLFile, "acl", "", "ACL rule file for outbounds, private and unix socket ones are denied unless allowed by it, effective on server side only")
+	flag.StringVar(&AllowSrc, "allow-src", "", "comma separated CIDRs allowed to connect, empty for all")
+	flag.StringVar(&DenySrc, "deny-src", "", "comma separated CIDRs denied to connect")
+	flag.Var(&RateUp, "rate-up", "total bandwidth (bytes/sec, k/M/G suffixes allowed) from client to host, 0 for unlimited")
+	flag.Var(&RateDown, "rate-down", "total bandwidth from host to client, 0 for unlimited")
+	flag.Var(&RateUser, "rate-user", "bandwidth of each user in each direction, 0 for unlimited")
+	flag.Var(&RateConn, "rate-conn", "bandwidth of each TCP connection or UDP relay in each direction, 0 for unlimited")
+	flag.IntVar(&MaxCtrlLinksPerUser, "max-ctrl-user", 0, "max control links per user, 0 for unlimited, effective on server side only")
+	flag.IntVar(&MaxCtrlLinksPerIP, "max-ctrl-ip", 0, "max control links per client IP, 0 for unlimited, effective on server side only")
+	flag.IntVar(&MaxPending, "max-pending", 0, "max data links pending for connection per control link, 0 for unlimited, effective on server side only")
+	flag.IntVar(&MaxRelays, "max-relays", 0, "max concurrent relays, 0 for unlimited, effective on server side only")
+	flag.Var(&DrainTimeout, "drain", "timeout for active relays to finish after SIGINT or SIGTERM, 0 for no timeout")
+	flag.StringVar(&StatFile, "stat", "", "file to record connection events in, for \"xcat stat analyze\"")
+	flag.StringVar(&MetricsAddr, "metrics", "", "listening address of the HTTP endpoint serving Prometheus metrics at /metrics, disabled if empty")
+	flag.Var(&UnixPerm, "unix-perm", "permission (octal) of unix domain sockets created for listening addresses starting with "+util.UnixPrefix)
+}
+
+// userCmdFlag maps usernames to commands, it is set by "-E user=command".
+type userCmdFlag map[string]string
+
+func (f userCmdFlag) String() string {
+	return fmt.Sprint(map[string]string(f))
+}
+
+func (f userCmdFlag) Set(s string) error {
+	usr, cmd, ok := strings.Cut(s, "=")
+	if !ok || cmd == "" {
+		return fmt.Errorf("expecting user=command, got %q", s)
+	}
+	f[usr] = cmd
+	return nil
+}
+
+// levelsFlag maps subsystems to log levels, it is set by
+// "-log-levels ctrl=3,listener=0".
+type levelsFlag map[string]int
+
+func (f levelsFlag) String() string {
+	return fmt.Sprint(map[string]int(f))
+}
+
+func (f levelsFlag) Set(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		name, level, ok := strings.Cut(pair, "=")
+		l, err := strconv.Atoi(level)
+		if !ok || err != nil {
+			return fmt.Errorf("expecting subsystem=level, got %q", pair)
+		}
+		f[name] = l
+	}
+	return nil
+}
+
+// permFlag is a file permission given in octal.
+type permFlag os.FileMode
+
+func (f *permFlag) String() string {
+	return fmt.Sprintf("%#o", uint32(*f))
 }
 
-func init() {
+func (f *permFlag) Set(s string) error {
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return err
+	}
+	if perm > 0777 {
+		return fmt.Errorf("invalid permission %s", s)
+	}
+	*f = permFlag(perm)
+	return nil
+}
+
+// rateFlag is a bandwidth in bytes per second, see [ratelimit.ParseRate].
+type rateFlag int64
+
+func (f *rateFlag) String() string {
+	return ratelimit.FormatRate(int64(*f))
+}
+
+func (f *rateFlag) Set(s string) error {
+	rate, err := ratelimit.ParseRate(s)
+	*f = rateFlag(rate)
+	return err
+}
+
+// durationFlag is a duration like "1m30s", or in seconds if there's no unit.
+type durationFlag time.Duration
+
+func (f *durationFlag) String() string {
+	return time.Duration(*f).String()
+}
+
+func (f *durationFlag) Set(s string) error {
+	if secs, err := strconv.ParseUint(s, 10, 32); err == nil {
+		*f = durationFlag(time.Duration(secs) * time.Second)
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	*f = durationFlag(d)
+	return err
+}
+
+// Environment variables of credentials, read and unset on start up so that
+// they are not inherited by commands.
+const (
+	envUsername = "XCAT_USERNAME"
+	envPassword = "XCAT_PASSWORD"
+)
+
+// Credentials taken from the environment, or from the parent process on
+// restart, kept for reloads and handed to new processes through a pipe.
+// Keys are derived from copies which are zeroed, but these are not, and
+// neither are -P and the environment the process started with, which stays
+// in its memory.
+var (
+	envUsr *string
+	envPwd config.Secret // Nil if not given
+)
+
+func readCredentialEnv() {
+	if v, ok := os.LookupEnv(envUsername); ok {
+		envUsr = &v
+		os.Unsetenv(envUsername)
+	}
+	if v, ok := os.LookupEnv(envPassword); ok {
+		envPwd = append(config.Secret{}, v...)
+		os.Unsetenv(envPassword)
+	}
+	if err := inheritCredentials(); err != nil {
+		log.Warnf("Failed to read credentials from parent process: %v. ", err)
+	}
+}
+
+// flagCredential returns the username and password given by flags, files or
+// environment variables in that order, nil if not given.
+// The password is read from file on every call.
+func flagCredential(set map[string]bool) (usr *config.Username, pwd config.Secret, err error) {
+	switch {
+	case set["U"]:
+		u := config.Username(Usr)
+		usr = &u
+	case set["user-file"]:
+		b, err := config.ReadSecretFile(UsrFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read username: %w", err)
+		}
+		u := config.Username(b)
+		usr = &u
+	case envUsr != nil:
+		u := config.Username(*envUsr)
+		usr = &u
+	}
+
+	switch {
+	case set["P"]:
+		pwd = config.Secret(Pwd)
+	case set["password-file"]:
+		pwd, err = config.ReadSecretFile(PwdFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read password: %w", err)
+		}
+	case envPwd != nil:
+		// A copy, as passwords of the config are zeroed.
+		pwd = append(config.Secret{}, envPwd...)
+	}
+	if pwd == nil && (set["P"] || set["password-file"] || envPwd != nil) {
+		pwd = config.Secret{}
+	}
+	return usr, pwd, nil
+}
+
+func deref(usr *config.Username) config.Username {
+	if usr == nil {
+		return ""
+	}
+	return *usr
+}
+
+// parseArgs parses flags and loads the configuration, exits on error.
+func parseArgs() {
 	specifyFlags()
 
 	flag.Parse()
 
+	readCredentialEnv()
+
 	checkFlags()
 }
 
@@ -64,23 +281,245 @@ func checkFlags() {
 		os.Exit(0)
 	}
 
-	if Mode != ModeServer && Mode != ModeClient {
-		fmt.Printf("Unknown mode %s", Mode)
+	c, err := loadConfig()
+	if err != nil {
+		printConfigErrors(os.Stdout, ConfigFile, err)
 		os.Exit(1)
 	}
 
-	if Port < 0x00 || Port > 0xFFFF {
-		fmt.Printf("Invalid port %d. \n", Port)
+	cur.Store(newSettings(c))
+	if err := setupLog(c.Log); err != nil {
+		fmt.Printf("Failed to open log file: %s\n", err)
 		os.Exit(1)
 	}
-	Addr = net.JoinHostPort(Host, strconv.Itoa(Port))
 
-	var err error
-	LHost, _, err = net.SplitHostPort(LAddr)
+	warnArgvPassword()
+}
+
+// warnArgvPassword warns if the password is given by -P.
+func warnArgvPassword() {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "P"
+	})
+	if set {
+		log.Warnf(
+			"!!! Password given by -P is visible to all local users through the process list, "+
+				"use -password-file or %s instead. ", envPassword,
+		)
+	}
+}
+
+// loadConfig loads ConfigFile if specified, overrides it with flags and
+// validates the result.
+func loadConfig() (*config.Config, error) {
+	c := config.Default()
+	if ConfigFile != "" {
+		var err error
+		c, err = config.Load(ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyFlags(c); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyFlags overrides c with flags set on the command line.
+// -l, -h, -p and -e apply to the first forward, which is created if there's
+// none.
+func applyFlags(c *config.Config) error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if set["m"] {
+		c.Mode = Mode
+	}
+
+	if len(c.Forwards) == 0 {
+		c.Forwards = []config.Forward{{}}
+		set["l"] = true
+	}
+	fwd := &c.Forwards[0]
+	if set["l"] {
+		fwd.Listen = LAddr
+	}
+	if set["h"] || set["p"] {
+		if set["p"] && (Port < 0x00 || Port > 0xFFFF) {
+			return fmt.Errorf("invalid port %d", Port)
+		}
+		addr := fwd.Target
+		if c.Mode == config.ModeClient {
+			addr = fwd.Server
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		if set["h"] {
+			host = Host
+		}
+		if set["p"] {
+			port = strconv.Itoa(Port)
+		}
+		if path, ok := util.SplitUnixAddr(host); ok {
+			addr = util.UnixPrefix + path
+		} else {
+			addr = net.JoinHostPort(host, port)
+		}
+		if c.Mode == config.ModeClient {
+			fwd.Server = addr
+		} else {
+			fwd.Target = addr
+		}
+	}
+	if set["e"] {
+		fwd.Exec = ExecCmd
+	}
+
+	usr, pwd, err := flagCredential(set)
 	if err != nil {
-		fmt.Printf("Invalid listening address %s: %s. \n", LAddr, err.Error())
-		os.Exit(1)
+		return err
+	}
+	if usr != nil || pwd != nil {
+		if c.Mode == config.ModeClient {
+			if usr != nil {
+				c.User = *usr
+			}
+			if pwd != nil {
+				c.Password = pwd
+			}
+		} else if u := c.FindUser(deref(usr)); u != nil {
+			if pwd != nil {
+				u.Password = pwd
+			}
+		} else {
+			c.Users = append(c.Users, config.User{Name: deref(usr), Password: pwd})
+		}
+	}
+	for usr, cmd := range UserExecCmds {
+		u := c.FindUser(config.Username(usr))
+		if u == nil {
+			return fmt.Errorf("unknown user %s for -E", usr)
+		}
+		u.Exec = cmd
 	}
 
-	log.Level = LogLevel
+	if set["t"] {
+		c.Timeouts.DataLinkListen = config.Duration(DataLinkListenTimeout)
+	}
+	if set["T"] {
+		c.Timeouts.CtrlLink = config.Duration(CtrlLinkTimeout)
+	}
+	if set["heartbeat"] {
+		c.Timeouts.Heartbeat = config.Duration(Heartbeat)
+	}
+	if set["u"] {
+		c.Timeouts.UDP = config.Duration(UDPTimeout)
+	}
+	if set["udp-mux"] {
+		c.UDP.Mux = UDPMux
+	}
+	if set["udp-transport"] {
+		c.UDP.Transport = UDPTransport
+	}
+	if set["udp-mtu"] {
+		c.UDP.MTU = UDPMTU
+	}
+	if set["udp-oversize"] {
+		c.UDP.Oversize = UDPOversize
+	}
+	if set["drain"] {
+		c.Timeouts.Drain = config.Duration(DrainTimeout)
+	}
+	if set["d"] {
+		c.Log.Level = LogLevel
+	}
+	if set["log-format"] {
+		c.Log.Format = LogFormat
+	}
+	if set["log-file"] {
+		c.Log.File = LogFile
+	}
+	if set["log-levels"] {
+		if c.Log.Levels == nil {
+			c.Log.Levels = make(map[string]int)
+		}
+		for name, l := range LogLevels {
+			c.Log.Levels[name] = l
+		}
+	}
+	if set["unix-perm"] {
+		c.UnixPerm = config.Perm(UnixPerm)
+	}
+	if set["metrics"] {
+		c.Metrics.Listen = MetricsAddr
+	}
+	if set["stat"] {
+		c.Stat.File = StatFile
+	}
+
+	if set["acl"] {
+		c.ACL = config.ACL{File: ACLFile}
+	}
+	if set["allow-src"] {
+		c.Sources.Allow = acl.ParseNetList(AllowSrc)
+	}
+	if set["deny-src"] {
+		c.Sources.Deny = acl.ParseNetList(DenySrc)
+	}
+
+	for name, rate := range map[string]struct {
+		dst *config.Bandwidth
+		v   rateFlag
+	}{
+		"rate-up":   {&c.Rate.Up, RateUp},
+		"rate-down": {&c.Rate.Down, RateDown},
+		"rate-user": {&c.Rate.User, RateUser},
+		"rate-conn": {&c.Rate.Conn, RateConn},
+	} {
+		if set[name] {
+			*rate.dst = config.Bandwidth(rate.v)
+		}
+	}
+	for name, limit := range map[string]struct {
+		dst *int
+		v   int
+	}{
+		"max-ctrl-user": {&c.Limits.MaxCtrlLinksPerUser, MaxCtrlLinksPerUser},
+		"max-ctrl-ip":   {&c.Limits.MaxCtrlLinksPerIP, MaxCtrlLinksPerIP},
+		"max-pending":   {&c.Limits.MaxPending, MaxPending},
+		"max-relays":    {&c.Limits.MaxRelays, MaxRelays},
+	} {
+		if set[name] {
+			*limit.dst = limit.v
+		}
+	}
+	return nil
+}
+
+// printConfigErrors prints errors returned by [config.Config.Validate],
+// one per line, prefixed with file name and line number if known.
+func printConfigErrors(w io.Writer, file string, err error) {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, err := range errs {
+		var e *config.Error
+		switch {
+		case errors.As(err, &e) && e.Line > 0 && file != "":
+			fmt.Fprintf(w, "%s:%d: %s\n", file, e.Line, e.Msg)
+		case file != "":
+			fmt.Fprintf(w, "%s: %s\n", file, err)
+		default:
+			fmt.Fprintln(w, err)
+		}
+	}
 }
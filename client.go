@@ -1,212 +1,296 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"strconv"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/fishBone000/xcat/ctrl"
+	"github.com/fishBone000/xcat/config"
 	"github.com/fishBone000/xcat/log"
-	"github.com/fishBone000/xcat/ray"
-	"github.com/fishBone000/xcat/stat"
+	"github.com/fishBone000/xcat/ratelimit"
+	"github.com/fishBone000/xcat/tunnel"
 	"github.com/fishBone000/xcat/util"
 )
 
-var (
-	cnt stat.Counter
-	sf stat.StatFile
-)
-
-func runClient() {
+func runClient() int {
 	log.Info("Client start up!")
 	log.Infof("Version: %s", version)
-	sf.Init()
-	log.Infof("Stastic file: %s", sf.Name())
-
-	ctrl := ctrl.NewCtrlLink(
-		net.JoinHostPort(Host, strconv.Itoa(Port)), []byte(Usr), []byte(Pwd),
-		time.Second*time.Duration(CtrlLinkTimeout),
-	)
+	if err := openStat(cur.Load(), "client"); err != nil {
+		log.Errf("Failed to open statistic file, exitting: %v", err)
+		return 1
+	}
+	defer closeStat()
 
-	ctrl.Sf = &sf
+	fatal := util.Fatal{}
+	ls := &inboundListeners{fatal: &fatal}
+	if err := ls.update(cur.Load()); err != nil {
+		log.Errf("Failed to listen inbounds, exitting: %v", err)
+		return 1
+	}
 
-	lt, err := util.ListenMultipleTCP("tcp", LAddr)
+	closers := []io.Closer{inboundsDrain{ls}}
+	ml, err := serveMetrics(cur.Load(), nil)
 	if err != nil {
-		log.Err("Listen TCP failed: " + err.Error())
-		os.Exit(1)
+		util.CloseCloser(ls)
+		log.Errf("Failed to listen metrics endpoint, exitting: %v", err)
+		return 1
+	}
+	if ml != nil {
+		closers = append(closers, ml)
 	}
-	lu, err := util.ListenMultipleUDP("udp", LAddr)
+	admin, err := serveAdmin(cur.Load(), ls, nil)
 	if err != nil {
-		log.Err("Listen UDP failed: " + err.Error())
-		os.Exit(1)
+		for _, c := range closers {
+			util.CloseCloser(c)
+		}
+		log.Errf("Failed to listen admin endpoint, exitting: %v", err)
+		return 1
+	}
+	if admin != nil {
+		closers = append(closers, admin)
 	}
 
-	fatal := util.Fatal{}
+	code := waitStop(&fatal, nil, func() error { return reload(ls.update) }, closers...)
+	util.CloseCloser(ls)
+	if err := fatal.Get(); err != nil {
+		fmt.Printf("Accept inbound failed, exitting.\nReason: %s.\n", err.Error())
+	}
+	return code
+}
 
-	go func() {
-		for {
-			inbound, err := lt.Accept()
-			if err != nil {
-				fatal.Set(err)
-				return
+// clientOptions returns options of the tunnel client of fwd of s.
+func clientOptions(s *settings, fwd *config.Forward) *tunnel.ClientOptions {
+	usr, _ := s.Credential(fwd)
+	return &tunnel.ClientOptions{
+		Name:              fwd.Name,
+		Server:            fwd.Server,
+		User:              string(usr),
+		Key:               s.fwdKeys[fwd.Name],
+		CtrlLinkTimeout:   time.Duration(s.Timeouts.CtrlLink),
+		Heartbeat:         time.Duration(s.Timeouts.Heartbeat),
+		DataLinkTimeout:   time.Duration(s.Timeouts.DataLinkListen),
+		UDPTimeout:        time.Duration(s.Timeouts.UDP),
+		UDPMux:            s.UDP.Mux,
+		UDPTransport:      udpTransport(s.UDP.Transport),
+		UDPMTU:            s.UDP.MTU,
+		UDPRejectOversize: s.UDP.Oversize == config.OversizeReject,
+		Accept: func(remote net.Addr) bool {
+			return acceptSrc(s, remote, "inbound")
+		},
+		Limiters: func(r *tunnel.Request) (up, down ratelimit.Limiters) {
+			return s.relayLimiters(fwd, usr)
+		},
+		Relays: &active,
+		Stat:   sf,
+	}
+}
+
+func udpTransport(t string) tunnel.UDPTransport {
+	switch t {
+	case config.UDPNative:
+		return tunnel.UDPNative
+	case config.UDPOverTCP:
+		return tunnel.UDPOverTCP
+	}
+	return tunnel.UDPAuto
+}
+
+// inboundListeners are listeners of inbounds by listening address,
+// following forwards of the current settings.
+type inboundListeners struct {
+	mux   sync.Mutex
+	m     map[string]*inboundListener
+	fatal *util.Fatal // Set if accepting failed
+}
+
+type inboundListener struct {
+	client *tunnel.Client
+	lt     net.Listener
+	lu     *util.MultiListenerUDP // nil for unix domain sockets
+}
+
+// update listens for forwards of s not listened yet, then puts s in effect and
+// closes listeners of removed forwards.
+// Nothing is changed if failed.
+func (ls *inboundListeners) update(s *settings) error {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+
+	added := make(map[string]*inboundListener)
+	for i := range s.Forwards {
+		fwd := &s.Forwards[i]
+		if ls.m[fwd.Listen] != nil {
+			continue
+		}
+		l, err := listenInbounds(fwd.Listen, os.FileMode(s.UnixPerm))
+		if err != nil {
+			for _, l := range added {
+				l.Close()
 			}
-			go serveInboundTCP(inbound, ctrl)
+			return fmt.Errorf("forward %s: %w", fwd.Name, err)
 		}
-	}()
+		log.Infof("Listening inbounds of forward %s on %s. ", fwd.Name, fwd.Listen)
+		added[fwd.Listen] = l
+	}
 
-	go func() {
-		for {
-			inbound, err := lu.Accept()
-			if err != nil {
-				fatal.Set(err)
-				return
-			}
-			go serveInboundUDP(inbound, ctrl)
+	cur.Store(s)
+
+	if ls.m == nil {
+		ls.m = make(map[string]*inboundListener)
+	}
+	for addr, l := range ls.m {
+		if fwd := s.forward(addr); fwd != nil {
+			// The control link is closed if not reused.
+			l.client.Reconfigure(clientOptions(s, fwd))
+			continue
 		}
-	}()
+		log.Infof("Stopped listening inbounds on %s. ", addr)
+		l.Close()
+		delete(ls.m, addr)
+	}
+	for addr, l := range added {
+		l.client = tunnel.NewClient(clientOptions(s, s.forward(addr)))
+		ls.m[addr] = l
+		l.serve(ls.fatal)
+	}
+	return nil
+}
 
-	<-fatal.Chan()
-	fmt.Printf("Accept inbound failed, exitting.\nReason: %s.\n", fatal.Get().Error())
+func (ls *inboundListeners) Close() error {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	for _, l := range ls.m {
+		l.Close()
+	}
+	return nil
 }
 
- // New Inbound: n
- // Got port: p(P)
- // Ray: r(R)
- // Relay: l(L)
-func serveInboundTCP(inbound net.Conn, ctrl *ctrl.ControlLink) {
-	id := cnt.Tick()
-	sf.Write("t", id, "n")
-	
-	log.Debugf("New TCP inbound %s. ", inbound.RemoteAddr().String())
-	port, err := ctrl.GetPortTCP()
-	if err != nil {
-		sf.Write("t", id, "P")
-		log.Debugf("Failed to get available port, closing inbound %s. ", inbound.RemoteAddr())
-		util.CloseCloser(inbound)
-		return
+// drain stops accepting inbounds, but keeps UDP listeners open until Close,
+// as UDP inbounds being relayed are closed with them.
+func (ls *inboundListeners) drain() {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	for _, l := range ls.m {
+		l.drain()
 	}
-	sf.Write("t", id, "p")
-	log.Debug(fmt.Sprintf("Got port %d for inbound %s. ", port, util.ConnStr(inbound)))
+}
 
-	rconn, err := ray.Dial("tcp", net.JoinHostPort(Host, strconv.Itoa(int(port))), []byte(Usr), []byte(Pwd))
-	if err != nil {
-		sf.Write("t", id, "R")
-		log.Errf("Establish TCP data link to server %s failed, closing inbound %s: %w", Addr, util.ConnStr(inbound), err)
-		util.CloseCloser(inbound)
-		return
+// inboundsDrain drains ls once closed, for draining relays before ls is
+// closed.
+type inboundsDrain struct {
+	ls *inboundListeners
+}
+
+func (d inboundsDrain) Close() error {
+	d.ls.drain()
+	return nil
+}
+
+// clients returns clients of all forwards.
+func (ls *inboundListeners) clients() []*tunnel.Client {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	var cs []*tunnel.Client
+	for _, l := range ls.m {
+		cs = append(cs, l.client)
 	}
-	sf.Write("t", id, "r")
-	log.Debugf("Established TCP data link %s for inbound %s, relay starting. ", util.ConnStr(rconn), util.ConnStr(inbound))
+	return cs
+}
 
-	if err := util.Relay(inbound, rconn); err != nil {
-		sf.Write("t", id, "L")
-		log.Warnf("Error relaying TCP for inbound %s: \n%w", util.ConnStr(inbound), err)
-	} else {
-		sf.Write("t", id, "l")
-		log.Debugf("Relay TCP finished for inbound %s. ", util.ConnStr(inbound))
+func (ls *inboundListeners) CtrlLinks() []tunnel.CtrlLinkInfo {
+	infos := []tunnel.CtrlLinkInfo{}
+	for _, c := range ls.clients() {
+		infos = append(infos, c.CtrlLink())
 	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Forward < infos[j].Forward })
+	return infos
 }
 
- // New Inbound: n
- // Got port: p(P)
- // Ray: r(R)
- // Relay: l(L)
-func serveInboundUDP(inbound *util.UDPConn, ctrl *ctrl.ControlLink) {
-	defer util.CloseCloser(inbound)
+func (ls *inboundListeners) Relays() []tunnel.RelayInfo {
+	infos := []tunnel.RelayInfo{}
+	for _, c := range ls.clients() {
+		infos = append(infos, c.Relays()...)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
 
-	id := cnt.Tick()
-	sf.Write("u", id, "n")
+func (ls *inboundListeners) KillRelay(id int) bool {
+	for _, c := range ls.clients() {
+		if c.KillRelay(id) {
+			return true
+		}
+	}
+	return false
+}
 
-	log.Debugf("New UDP inbound %s. ", inbound.RemoteAddr().String())
-	port, err := ctrl.GetPortUDP()
-	if err != nil {
-		sf.Write("u", id, "P")
-		log.Errf("Failed to get available port, closing inbound %s. ", inbound.RemoteAddr())
-		return
+func (ls *inboundListeners) KillUser(user string) int {
+	n := 0
+	for _, c := range ls.clients() {
+		n += c.KillUser(user)
 	}
-	sf.Write("u", id, "p")
+	return n
+}
 
-	addr := net.JoinHostPort(Host, strconv.Itoa(int(port)))
-	ru, err := ray.DialTimeoutUDP("udp", addr, []byte(Usr), []byte(Pwd), time.Second*time.Duration(DataLinkListenTimeout))
+func listenInbounds(addr string, perm os.FileMode) (*inboundListener, error) {
+	l := &inboundListener{}
+	var err error
+	l.lt, err = util.ListenStream(addr, perm)
 	if err != nil {
-		sf.Write("u", id, "R")
-		log.Errf("Failed to dial UDP data link to %s. Reason: \n%w", addr, err)
-		return
+		return nil, fmt.Errorf("listen TCP: %w", err)
 	}
-	sf.Write("u", id, "r")
-	defer util.CloseCloser(ru)
+	if _, ok := util.SplitUnixAddr(addr); !ok {
+		l.lu, err = util.ListenMultipleUDP("udp", addr)
+		if err != nil {
+			util.CloseCloser(l.lt)
+			return nil, fmt.Errorf("listen UDP: %w", err)
+		}
+		// Replaced by the client once served.
+		l.lu.SetFilter(func(raddr net.Addr) bool {
+			return acceptSrc(cur.Load(), raddr, "UDP inbound")
+		})
+	}
+	return l, nil
+}
 
-	fatal := util.Fatal{}
-	activity := make(chan struct{}, 4)
+// serve starts accepting inbounds, fatal is set if accepting failed.
+func (l *inboundListener) serve(fatal *util.Fatal) {
 	go func() {
-		for {
-			p, err := inbound.Read()
-			if err != nil {
-				fatal.Set(err)
-				return
-			}
-			activity <- struct{}{}
-			_, err = ru.Write(p)
-			if err != nil {
-				fatal.Set(err)
-				return
-			}
+		if err := l.client.Serve(context.Background(), l.lt); err != nil {
+			fatal.Set(err)
 		}
 	}()
-	go func() {
-		buffer := make([]byte, 65535)
-		for {
-			n, err := ru.Read(buffer)
-			var werr error
-			if n > 0 {
-				activity <- struct{}{}
-				_, werr = inbound.Write(buffer[:n])
-			}
-			switch {
-			case err != nil:
+	if l.lu != nil {
+		go func() {
+			if err := l.client.ServeUDP(context.Background(), l.lu); err != nil {
 				fatal.Set(err)
-				return
-			case werr != nil:
-				fatal.Set(werr)
-				return
 			}
-		}
-	}()
-	go func() {
-		d := time.Second * time.Duration(UDPTimeout)
-		var ticker *time.Ticker
-		if UDPTimeout > 0 {
-			ticker = time.NewTicker(d)
-			defer ticker.Stop()
-		} else {
-			// Make a dummy ticker
-			ticker = new(time.Ticker)
-			ticker.C = make(<-chan time.Time)
-		}
-		for {
-			select {
-			case <-activity:
-				ticker.Reset(d)
-			case <-ticker.C:
-				fatal.Set(nil)
-				return
-			}
-		}
-	}()
+		}()
+	}
+}
 
-	<-fatal.Chan()
-	if err := ru.ErrTCP(); err != nil {
-		sf.Write("u", id, "L")
-		log.Errf("Error relaying UDP for %s. Reason:\n%w", inbound.RemoteAddr(), err)
-		return
+// Close closes the listeners and the control link.
+func (l *inboundListener) Close() error {
+	l.drain()
+	if l.lu != nil {
+		util.CloseCloser(l.lu)
 	}
-	if err := fatal.Get(); err != nil {
-		sf.Write("u", id, "L")
-		log.Errf("Error relaying UDP for %s. Reason:\n%w", inbound.RemoteAddr(), fatal.Get())
-		return
+	return nil
+}
+
+// drain closes the control link and stops accepting inbounds, UDP inbounds
+// accepted are kept.
+func (l *inboundListener) drain() {
+	if l.client != nil {
+		util.CloseCloser(l.client)
+	}
+	util.CloseCloser(l.lt)
+	if l.lu != nil {
+		l.lu.StopAccepting()
 	}
-	sf.Write("u", id, "l")
-	log.Debugf("Relay UDP for %s finished (no activity for %d secs). ", inbound.RemoteAddr(), UDPTimeout)
 }
@@ -0,0 +1,738 @@
+// Package config loads and validates configuration files of xcat.
+//
+// A configuration file is in YAML, see example.yaml for all the settings.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/fishBone000/xcat/acl"
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/ratelimit"
+	"github.com/fishBone000/xcat/ray"
+	"github.com/fishBone000/xcat/util"
+)
+
+const (
+	ModeServer = "server"
+	ModeClient = "client"
+)
+
+// Values of UDP.Transport.
+const (
+	UDPAuto    = "auto"
+	UDPNative  = "udp"
+	UDPOverTCP = "tcp"
+)
+
+// Values of UDP.Oversize.
+const (
+	OversizeFragment = "fragment"
+	OversizeReject   = "reject"
+)
+
+type Config struct {
+	Mode     string     `yaml:"mode"`
+	User     Username   `yaml:"user"`     // Client side credential
+	Password Secret     `yaml:"password"` // Client side credential
+	Users    []User     `yaml:"users"`    // Server side credentials
+	Forwards []Forward  `yaml:"forwards"`
+	Timeouts Timeouts   `yaml:"timeouts"`
+	Limits   Limits     `yaml:"limits"`
+	Rate     RateLimits `yaml:"rate"`
+	ACL      ACL        `yaml:"acl"`
+	Sources  Sources    `yaml:"sources"`
+	UDP      UDP        `yaml:"udp"`
+	Log      Log        `yaml:"log"`
+	Metrics  Metrics    `yaml:"metrics"`
+	Stat     Stat       `yaml:"stat"`
+	Admin    Admin      `yaml:"admin"`
+	UnixPerm Perm       `yaml:"unix_perm"`
+	root     *yaml.Node // For locating errors, nil if not loaded from file
+	acl      *acl.ACL   // Built by Validate
+	sources  *acl.SourceFilter
+}
+
+type User struct {
+	Name     Username `yaml:"name"`
+	Password Secret   `yaml:"password"`
+	// Command to run for TCP data links of the user, overriding that of the
+	// forward.
+	Exec string `yaml:"exec"`
+}
+
+// Forward is a forwarding rule.
+// On client side, inbounds on Listen are relayed through the server at Server.
+// On server side, control links are accepted on Listen, and data links are
+// relayed to Target, or to a command if Exec is set.
+type Forward struct {
+	Name     string     `yaml:"name"`
+	Listen   string     `yaml:"listen"`
+	Server   string     `yaml:"server"`   // Client side only
+	User     Username   `yaml:"user"`     // Client side only, overrides Config.User
+	Password Secret     `yaml:"password"` // Client side only, overrides Config.Password
+	Target   string     `yaml:"target"`   // Server side only
+	Exec     string     `yaml:"exec"`     // Server side only
+	Rate     RateLimits `yaml:"rate"`     // User is ignored
+}
+
+type Timeouts struct {
+	DataLinkListen Duration `yaml:"data_link_listen"`
+	CtrlLink       Duration `yaml:"ctrl_link"`
+	Heartbeat      Duration `yaml:"heartbeat"`
+	UDP            Duration `yaml:"udp"`
+	Drain          Duration `yaml:"drain"`
+}
+
+// Limits of server side resources, 0 for unlimited.
+type Limits struct {
+	MaxCtrlLinksPerUser int `yaml:"max_ctrl_links_per_user"`
+	MaxCtrlLinksPerIP   int `yaml:"max_ctrl_links_per_ip"`
+	MaxPending          int `yaml:"max_pending"`
+	MaxRelays           int `yaml:"max_relays"`
+}
+
+// RateLimits are bandwidth limits, 0 for unlimited.
+// Up is the direction from client to host.
+type RateLimits struct {
+	Up   Bandwidth `yaml:"up"`
+	Down Bandwidth `yaml:"down"`
+	User Bandwidth `yaml:"user"`
+	Conn Bandwidth `yaml:"conn"`
+}
+
+// ACL of server side outbounds, rules are in the syntax of package acl.
+type ACL struct {
+	File    string   `yaml:"file"`
+	Rules   []string `yaml:"rules"`
+	Default string   `yaml:"default"`
+}
+
+// Sources are CIDRs allowed or denied to connect.
+type Sources struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+type Log struct {
+	Level  int            `yaml:"level"`
+	Levels map[string]int `yaml:"levels"` // Of subsystems, see [log.Subsystems]
+	Format string         `yaml:"format"` // "text" or "json"
+	File   string         `yaml:"file"`   // Standard output if empty
+
+	// Messages of the same format are limited to SampleBurst per
+	// SampleInterval, sampling is disabled if SampleBurst is 0.
+	SampleBurst    int      `yaml:"sample_burst"`
+	SampleInterval Duration `yaml:"sample_interval"`
+
+	// The file is rotated when it grows over MaxSize or has been written
+	// for Rotate, zero values disable the respective rotation.
+	MaxSize    Size     `yaml:"max_size"`
+	Rotate     Duration `yaml:"rotate"`
+	MaxBackups int      `yaml:"max_backups"` // Rotated files kept, 0 for all
+}
+
+// UDP configures relaying UDP inbounds, client side only.
+type UDP struct {
+	// Mux relays inbounds as flows of one data link, instead of one data
+	// link each. Servers must support it.
+	Mux bool `yaml:"mux"`
+	// Transport is how datagrams are carried: "udp", "tcp" over the TCP
+	// connections of data links for networks dropping UDP, or "auto" for
+	// "tcp" while UDP is found blocked. Empty means "auto".
+	Transport string `yaml:"transport"`
+	// MTU is the path MTU to servers in bytes, discovered if 0, where 1500
+	// is assumed if not supported.
+	MTU int `yaml:"mtu"`
+	// Oversize is what to do with datagrams over the payload MTU: "fragment"
+	// them, which servers must support, or "reject". Empty means "fragment".
+	// Senders of rejected datagrams are told the MTU by ICMP if possible.
+	Oversize string `yaml:"oversize"`
+}
+
+// Metrics is the HTTP endpoint serving metrics at /metrics.
+type Metrics struct {
+	Listen string `yaml:"listen"` // Disabled if empty
+}
+
+// Stat is the statistic file of connection events, see package stat.
+// It is rotated like the log file.
+type Stat struct {
+	File       string   `yaml:"file"` // Disabled if empty
+	MaxSize    Size     `yaml:"max_size"`
+	Rotate     Duration `yaml:"rotate"`
+	MaxBackups int      `yaml:"max_backups"`
+}
+
+// Admin is the endpoint for inspecting and controlling the running process,
+// used by "xcat ctl".
+type Admin struct {
+	// UnixPrefix followed by a socket path, or a loopback address.
+	// Disabled if empty.
+	Listen string `yaml:"listen"`
+	// Bearer token of requests, required for loopback addresses.
+	Token Secret `yaml:"token"`
+}
+
+// Duration is a time.Duration written as a Go duration string like "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return &Error{value.Line, fmt.Sprintf("invalid duration %q", s)}
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Bandwidth is in bytes per second, written like "10M", see
+// [ratelimit.ParseRate].
+type Bandwidth int64
+
+func (b *Bandwidth) UnmarshalYAML(value *yaml.Node) error {
+	v, err := ratelimit.ParseRate(value.Value)
+	if err != nil {
+		return &Error{value.Line, err.Error()}
+	}
+	*b = Bandwidth(v)
+	return nil
+}
+
+// Size is in bytes, written like "10M", see [ratelimit.ParseRate].
+type Size int64
+
+func (sz *Size) UnmarshalYAML(value *yaml.Node) error {
+	v, err := ratelimit.ParseRate(value.Value)
+	if err != nil {
+		return &Error{value.Line, fmt.Sprintf("invalid size %q", value.Value)}
+	}
+	*sz = Size(v)
+	return nil
+}
+
+// Perm is a file permission written in octal like "0660".
+type Perm os.FileMode
+
+func (p *Perm) UnmarshalYAML(value *yaml.Node) error {
+	v, err := strconv.ParseUint(value.Value, 8, 32)
+	if err != nil || v > 0777 {
+		return &Error{value.Line, fmt.Sprintf("invalid permission %q", value.Value)}
+	}
+	*p = Perm(v)
+	return nil
+}
+
+// Secret is a password, given inline, or by reference like
+// {file: /run/secrets/xcat} or {env: XCAT_SECRET}.
+// It's printed as "<secret>" by package fmt.
+type Secret []byte
+
+func (s *Secret) UnmarshalYAML(value *yaml.Node) error {
+	b, err := decodeRef(value)
+	*s = b
+	return err
+}
+
+func (s Secret) String() string {
+	return "<secret>"
+}
+
+// Zero overwrites s with zeros.
+func (s Secret) Zero() {
+	clear(s)
+}
+
+// Username is a username, which can be given by reference like [Secret].
+type Username string
+
+func (u *Username) UnmarshalYAML(value *yaml.Node) error {
+	b, err := decodeRef(value)
+	*u = Username(b)
+	return err
+}
+
+// decodeRef decodes a scalar, or reads the file or environment variable
+// referenced by a mapping with key "file" or "env".
+func decodeRef(value *yaml.Node) ([]byte, error) {
+	if value.Kind == yaml.ScalarNode {
+		return []byte(value.Value), nil
+	}
+	if value.Kind != yaml.MappingNode || len(value.Content) != 2 {
+		return nil, &Error{value.Line, "expecting a string, or a mapping of file or env"}
+	}
+	key, ref := value.Content[0].Value, value.Content[1].Value
+	switch key {
+	case "file":
+		b, err := ReadSecretFile(ref)
+		if err != nil {
+			return nil, &Error{value.Line, err.Error()}
+		}
+		return b, nil
+	case "env":
+		v, ok := os.LookupEnv(ref)
+		if !ok {
+			return nil, &Error{value.Line, fmt.Sprintf("environment variable %s is not set", ref)}
+		}
+		return []byte(v), nil
+	}
+	return nil, &Error{value.Line, fmt.Sprintf("unknown reference %q, expecting file or env", key)}
+}
+
+// ReadSecretFile reads a secret from the file at name, with trailing newlines
+// trimmed.
+func ReadSecretFile(name string) (Secret, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	n := len(bytes.TrimRight(b, "\r\n"))
+	clear(b[n:])
+	return b[:n], nil
+}
+
+// Error is a configuration error, Line is 0 if unknown.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return e.Msg
+}
+
+// Default returns a Config with default values and nothing else.
+func Default() *Config {
+	return &Config{
+		Timeouts: Timeouts{
+			DataLinkListen: Duration(15 * time.Second),
+			CtrlLink:       Duration(5 * time.Second),
+			Heartbeat:      Duration(15 * time.Second),
+			UDP:            Duration(180 * time.Second),
+			Drain:          Duration(30 * time.Second),
+		},
+		Log:      Log{Level: 2, Format: "text", SampleBurst: 50, SampleInterval: Duration(time.Second)},
+		UnixPerm: 0600,
+	}
+}
+
+// Load reads the file at name on top of [Default].
+// The result is not validated.
+func Load(name string) (*Config, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse is like Load but reads from b.
+func Parse(b []byte) (*Config, error) {
+	c := Default()
+
+	root := new(yaml.Node)
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(root); err != nil {
+		if errors.Is(err, io.EOF) {
+			return c, nil
+		}
+		return nil, yamlError(err)
+	}
+	c.root = root
+
+	// Decode again for KnownFields, which yaml.Node.Decode doesn't support.
+	dec = yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		var e *Error
+		if errors.As(err, &e) {
+			return nil, e
+		}
+		return nil, yamlError(err)
+	}
+	return c, nil
+}
+
+// yamlError converts errors of package yaml, which carry line numbers in
+// messages like "yaml: line 3: ...", into [*Error]s joined by errors.Join.
+func yamlError(err error) error {
+	msgs := []string{err.Error()}
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		msgs = te.Errors
+	}
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		e := &Error{Msg: strings.TrimPrefix(msg, "yaml: ")}
+		if s, ok := strings.CutPrefix(e.Msg, "line "); ok {
+			n, rest, _ := strings.Cut(s, ": ")
+			if line, err := strconv.Atoi(n); err == nil {
+				e.Line, e.Msg = line, rest
+			}
+		}
+		errs[i] = e
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks c and returns all the problems found, joined by
+// errors.Join. Each of them is an [*Error], carrying a line number if c is
+// loaded from a file.
+func (c *Config) Validate() error {
+	v := validator{c: c}
+	v.validate()
+	return errors.Join(v.errs...)
+}
+
+// ACLRules returns the ACL built by Validate, nil if not configured.
+func (c *Config) ACLRules() *acl.ACL {
+	return c.acl
+}
+
+// SourceFilter returns the source filter built by Validate, nil if not
+// configured.
+func (c *Config) SourceFilter() *acl.SourceFilter {
+	return c.sources
+}
+
+// FindUser returns the user of name on server side, or nil if not found.
+func (c *Config) FindUser(name Username) *User {
+	for i := range c.Users {
+		if c.Users[i].Name == name {
+			return &c.Users[i]
+		}
+	}
+	return nil
+}
+
+// Credential returns the username and password of fwd on client side.
+func (c *Config) Credential(fwd *Forward) (usr Username, pwd Secret) {
+	usr, pwd = c.User, c.Password
+	if fwd.User != "" {
+		usr = fwd.User
+	}
+	if len(fwd.Password) > 0 {
+		pwd = fwd.Password
+	}
+	return
+}
+
+// ZeroSecrets overwrites all the passwords in c with zeros, they are useless
+// afterwards.
+func (c *Config) ZeroSecrets() {
+	c.Password.Zero()
+	for i := range c.Forwards {
+		c.Forwards[i].Password.Zero()
+	}
+	for i := range c.Users {
+		c.Users[i].Password.Zero()
+	}
+}
+
+type validator struct {
+	c    *Config
+	errs []error
+}
+
+// errorf records an error at the node found by path, see [Config.line].
+func (v *validator) errorf(path []any, f string, a ...any) {
+	v.errs = append(v.errs, &Error{v.c.line(path...), fmt.Sprintf(f, a...)})
+}
+
+func (v *validator) validate() {
+	c := v.c
+
+	switch c.Mode {
+	case ModeServer, ModeClient:
+	case "":
+		v.errorf(nil, "mode is not specified")
+		return
+	default:
+		v.errorf([]any{"mode"}, "unknown mode %q", c.Mode)
+		return
+	}
+
+	if len(c.Forwards) == 0 {
+		v.errorf(nil, "no forwards specified")
+	}
+	names := make(map[string]bool)
+	listens := make(map[string]bool)
+	for i := range c.Forwards {
+		fwd := &c.Forwards[i]
+		if fwd.Name == "" {
+			fwd.Name = fwd.Listen
+		}
+		if names[fwd.Name] {
+			v.errorf([]any{"forwards", i, "name"}, "duplicate forward name %q", fwd.Name)
+		}
+		names[fwd.Name] = true
+		if fwd.Listen != "" && listens[fwd.Listen] {
+			v.errorf([]any{"forwards", i, "listen"}, "duplicate listening address %q", fwd.Listen)
+		}
+		listens[fwd.Listen] = true
+		v.validateForward(i, fwd)
+	}
+
+	if c.Mode == ModeServer {
+		v.validateUsers()
+	}
+
+	t := c.Timeouts
+	for _, d := range []struct {
+		key string
+		d   Duration
+	}{
+		{"data_link_listen", t.DataLinkListen},
+		{"ctrl_link", t.CtrlLink},
+		{"heartbeat", t.Heartbeat},
+		{"udp", t.UDP},
+		{"drain", t.Drain},
+	} {
+		if d.d < 0 {
+			v.errorf([]any{"timeouts", d.key}, "negative timeout %s", time.Duration(d.d))
+		}
+	}
+
+	l := c.Limits
+	for _, n := range []struct {
+		key string
+		n   int
+	}{
+		{"max_ctrl_links_per_user", l.MaxCtrlLinksPerUser},
+		{"max_ctrl_links_per_ip", l.MaxCtrlLinksPerIP},
+		{"max_pending", l.MaxPending},
+		{"max_relays", l.MaxRelays},
+	} {
+		if n.n < 0 {
+			v.errorf([]any{"limits", n.key}, "negative limit %d", n.n)
+		}
+	}
+
+	switch c.UDP.Transport {
+	case "", UDPAuto, UDPNative, UDPOverTCP:
+	default:
+		v.errorf([]any{"udp", "transport"}, "udp transport must be auto, udp or tcp, got %q", c.UDP.Transport)
+	}
+	if mtu := c.UDP.MTU; mtu != 0 && (mtu < ray.MinMTU || mtu > 0xFFFF) {
+		v.errorf([]any{"udp", "mtu"}, "udp mtu must be 0 or within %d to %d, got %d", ray.MinMTU, 0xFFFF, mtu)
+	}
+	switch c.UDP.Oversize {
+	case "", OversizeFragment, OversizeReject:
+	default:
+		v.errorf([]any{"udp", "oversize"}, "udp oversize must be fragment or reject, got %q", c.UDP.Oversize)
+	}
+
+	if c.Log.Level < 0 || c.Log.Level > 3 {
+		v.errorf([]any{"log", "level"}, "log level must be within 0 to 3, got %d", c.Log.Level)
+	}
+	for name, l := range c.Log.Levels {
+		if !slices.Contains(log.Subsystems, name) {
+			v.errorf([]any{"log", "levels", name}, "unknown subsystem %s, expecting one of %s", name, strings.Join(log.Subsystems, ", "))
+		} else if l < 0 || l > 3 {
+			v.errorf([]any{"log", "levels", name}, "log level must be within 0 to 3, got %d", l)
+		}
+	}
+	if c.Log.SampleBurst < 0 {
+		v.errorf([]any{"log", "sample_burst"}, "negative sample burst %d", c.Log.SampleBurst)
+	}
+	if c.Log.Format != "" && c.Log.Format != "text" && c.Log.Format != "json" {
+		v.errorf([]any{"log", "format"}, "log format must be text or json, got %q", c.Log.Format)
+	}
+	if c.Log.MaxBackups < 0 {
+		v.errorf([]any{"log", "max_backups"}, "negative max backups %d", c.Log.MaxBackups)
+	}
+
+	if c.Stat.MaxBackups < 0 {
+		v.errorf([]any{"stat", "max_backups"}, "negative max backups %d", c.Stat.MaxBackups)
+	}
+
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			v.errorf([]any{"metrics", "listen"}, "invalid listening address %q: %s", c.Metrics.Listen, err)
+		}
+	}
+
+	if a := c.Admin; a.Listen != "" {
+		if _, ok := util.SplitUnixAddr(a.Listen); !ok {
+			host, _, err := net.SplitHostPort(a.Listen)
+			ip := net.ParseIP(host)
+			switch {
+			case err != nil:
+				v.errorf([]any{"admin", "listen"}, "invalid listening address %q: %s", a.Listen, err)
+			case host != "localhost" && (ip == nil || !ip.IsLoopback()):
+				v.errorf([]any{"admin", "listen"}, "admin endpoint must listen on a loopback address or a unix domain socket, got %q", a.Listen)
+			case len(a.Token) == 0:
+				v.errorf([]any{"admin", "token"}, "token is required for listening on %s", a.Listen)
+			}
+		}
+	}
+
+	v.validateACL()
+
+	var err error
+	if len(c.Sources.Allow) > 0 || len(c.Sources.Deny) > 0 {
+		c.sources, err = acl.NewSourceFilter(c.Sources.Allow, c.Sources.Deny)
+		if err != nil {
+			v.errorf([]any{"sources"}, "%s", err)
+		}
+	}
+}
+
+func (v *validator) validateForward(i int, fwd *Forward) {
+	c := v.c
+	at := func(key string) []any { return []any{"forwards", i, key} }
+
+	if fwd.Listen == "" {
+		v.errorf([]any{"forwards", i}, "listen is not specified")
+	} else if _, isUnix := util.SplitUnixAddr(fwd.Listen); isUnix {
+		if c.Mode == ModeServer {
+			v.errorf(at("listen"), "listening address of server cannot be a unix domain socket")
+		}
+	} else if _, _, err := net.SplitHostPort(fwd.Listen); err != nil {
+		v.errorf(at("listen"), "invalid listening address %q: %s", fwd.Listen, err)
+	}
+
+	if c.Mode == ModeClient {
+		if fwd.Server == "" {
+			v.errorf([]any{"forwards", i}, "server is not specified")
+		} else if _, isUnix := util.SplitUnixAddr(fwd.Server); isUnix {
+			v.errorf(at("server"), "server address cannot be a unix domain socket")
+		} else if _, _, err := net.SplitHostPort(fwd.Server); err != nil {
+			v.errorf(at("server"), "invalid server address %q: %s", fwd.Server, err)
+		}
+		if usr, pwd := c.Credential(fwd); usr == "" && len(pwd) == 0 {
+			v.errorf([]any{"forwards", i}, "neither user nor password is specified")
+		}
+		if fwd.Target != "" || fwd.Exec != "" {
+			v.errorf([]any{"forwards", i}, "target and exec are effective on server side only")
+		}
+		return
+	}
+
+	if fwd.Target == "" && fwd.Exec == "" {
+		v.errorf([]any{"forwards", i}, "neither target nor exec is specified")
+	} else if fwd.Target != "" {
+		if _, isUnix := util.SplitUnixAddr(fwd.Target); !isUnix {
+			if _, _, err := net.SplitHostPort(fwd.Target); err != nil {
+				v.errorf(at("target"), "invalid target %q: %s", fwd.Target, err)
+			}
+		}
+	}
+	if fwd.Server != "" || fwd.User != "" || len(fwd.Password) > 0 {
+		v.errorf([]any{"forwards", i}, "server, user and password are effective on client side only")
+	}
+}
+
+func (v *validator) validateUsers() {
+	c := v.c
+	if len(c.Users) == 0 {
+		v.errorf(nil, "no users specified")
+	}
+	names := make(map[Username]bool)
+	for i, u := range c.Users {
+		if names[u.Name] {
+			v.errorf([]any{"users", i, "name"}, "duplicate user %q", u.Name)
+		}
+		names[u.Name] = true
+		if u.Name == "" && len(u.Password) == 0 {
+			v.errorf([]any{"users", i}, "neither name nor password is specified")
+		}
+	}
+}
+
+func (v *validator) validateACL() {
+	c := v.c
+	a := c.ACL
+	if a.File == "" && len(a.Rules) == 0 && a.Default == "" {
+		return
+	}
+	if a.File != "" && len(a.Rules) > 0 {
+		v.errorf([]any{"acl"}, "file and rules cannot be both specified")
+		return
+	}
+
+	var err error
+	if a.File != "" {
+		c.acl, err = acl.Load(a.File)
+		if err != nil {
+			v.errorf([]any{"acl", "file"}, "ACL file %s: %s", a.File, err)
+			return
+		}
+	} else {
+		c.acl = acl.New()
+		for i, rule := range a.Rules {
+			if err := c.acl.AddRule(rule, c.line("acl", "rules", i)); err != nil {
+				v.errorf([]any{"acl", "rules", i}, "%s", err)
+			}
+		}
+	}
+
+	switch a.Default {
+	case "":
+	case "allow":
+		c.acl.Default = acl.Allow
+	case "deny":
+		c.acl.Default = acl.Deny
+	default:
+		v.errorf([]any{"acl", "default"}, "unknown default action %q", a.Default)
+	}
+}
+
+// line returns the line number of the node at path, where strings are keys
+// of mappings and ints are indexes of sequences.
+// If not found, the line of the deepest node found is returned, 0 if c is not
+// loaded from a file.
+func (c *Config) line(path ...any) int {
+	if c.root == nil {
+		return 0
+	}
+	n := c.root
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	line := n.Line
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case string:
+			if n.Kind != yaml.MappingNode {
+				return line
+			}
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == p {
+					next = n.Content[i+1]
+					break
+				}
+			}
+		case int:
+			if n.Kind != yaml.SequenceNode || p >= len(n.Content) {
+				return line
+			}
+			next = n.Content[p]
+		}
+		if next == nil {
+			return line
+		}
+		n = next
+		line = n.Line
+	}
+	return line
+}
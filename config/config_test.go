@@ -0,0 +1,140 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExample(t *testing.T) {
+	t.Setenv("XCAT_CAROL_PASSWORD", "secret")
+	c, err := Load("example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Forwards) != 2 || c.Forwards[1].Target != "127.0.0.1:22" {
+		t.Fatalf("unexpected forwards %+v", c.Forwards)
+	}
+	if time.Duration(c.Timeouts.UDP) != 3*time.Minute {
+		t.Fatalf("expecting UDP timeout 3m, got %s", time.Duration(c.Timeouts.UDP))
+	}
+	if c.Forwards[0].Rate.Up != 10<<20 {
+		t.Fatalf("expecting rate 10M, got %d", c.Forwards[0].Rate.Up)
+	}
+	if c.ACLRules() == nil {
+		t.Fatal("expecting ACL built")
+	}
+}
+
+func TestErrorLines(t *testing.T) {
+	c, err := Parse([]byte(`mode: server
+users:
+  - name: alice
+    password: secret
+  - name: alice
+forwards:
+  - listen: ":1080"
+limits:
+  max_relays: -1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Validate()
+	want := map[int]bool{5: true, 7: true, 9: true}
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var e *Error
+		if !errors.As(err, &e) || !want[e.Line] {
+			t.Errorf("unexpected error %v", err)
+			continue
+		}
+		delete(want, e.Line)
+	}
+	if len(want) > 0 {
+		t.Errorf("missing errors at lines %v", want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]int{
+		"mode: server\ntimeout:\n  udp: 1m\n":  2,
+		"mode: server\ntimeouts:\n  udp: 60\n": 3,
+		"mode: server\nrate:\n  up: 1X\n":      3,
+		"mode: [server\n":                      1,
+	}
+	for s, line := range cases {
+		_, err := Parse([]byte(s))
+		var e *Error
+		if !errors.As(err, &e) || e.Line != line {
+			t.Errorf("%q: expecting error at line %d, got %v", s, line, err)
+		}
+	}
+}
+
+func TestSecretRefs(t *testing.T) {
+	name := t.TempDir() + "/pwd"
+	if err := os.WriteFile(name, []byte("from file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XCAT_TEST_USER", "bob")
+	c, err := Parse([]byte(`mode: client
+user: {env: XCAT_TEST_USER}
+password: {file: ` + name + `}
+forwards:
+  - listen: ":1080"
+    server: "example.com:1080"
+    password: inline
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.User != "bob" || string(c.Password) != "from file" {
+		t.Fatalf("unexpected credential %q %q", c.User, string(c.Password))
+	}
+	if _, pwd := c.Credential(&c.Forwards[0]); string(pwd) != "inline" {
+		t.Fatalf("expecting password of forward, got %q", string(pwd))
+	}
+
+	c.ZeroSecrets()
+	for _, b := range c.Password {
+		if b != 0 {
+			t.Fatal("password not zeroed")
+		}
+	}
+
+	for _, s := range []string{
+		"password: {env: XCAT_TEST_UNSET}\n",
+		"password: {file: " + name + ".missing}\n",
+		"password: {url: x}\n",
+	} {
+		var e *Error
+		if _, err := Parse([]byte("mode: client\n" + s)); !errors.As(err, &e) || e.Line != 2 {
+			t.Errorf("%q: expecting error at line 2, got %v", s, err)
+		}
+	}
+}
+
+func TestAdminValidation(t *testing.T) {
+	cases := map[string]bool{
+		"listen: unix:/run/xcat.sock":               true,
+		"listen: 127.0.0.1:9101\n  token: t":        true,
+		"listen: localhost:9101\n  token: t":        true,
+		"listen: 127.0.0.1:9101":                    false,
+		"listen: 0.0.0.0:9101\n  token: t":          false,
+		"listen: \"[::1]:9101\"\n  token: t":        true,
+		"listen: 192.168.1.1:9101\n  token: secret": false,
+	}
+	for admin, ok := range cases {
+		c, err := Parse([]byte("mode: server\nusers:\n  - name: alice\n    password: secret\nforwards:\n  - listen: \":1080\"\n    target: 127.0.0.1:22\nadmin:\n  " + admin + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Validate(); (err == nil) != ok {
+			t.Errorf("%q: got %v", admin, err)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fishBone000/xcat/config"
+	"github.com/fishBone000/xcat/util"
+)
+
+const ctlUsage = `Usage: xcat ctl [-c FILE] [-addr ADDR] [-json] COMMAND [ARG]
+
+Talks to the admin endpoint of a running client or server, at the address
+in the admin section of the configuration file, or -addr. The token is read
+from the configuration file, or the ` + envAdminToken + ` environment variable.
+
+Commands:
+  status          list control links and relays
+  kill-relay ID   close the relay of ID
+  kill-user NAME  close control links and relays of user NAME
+  reload          reload the configuration
+
+Flags:
+`
+
+const envAdminToken = "XCAT_ADMIN_TOKEN"
+
+// runCtl runs the ctl subcommand with args following it.
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), ctlUsage)
+		fs.PrintDefaults()
+	}
+	file, addr := adminFlags(fs)
+	asJSON := fs.Bool("json", false, "print the status in JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cmd, arg := fs.Arg(0), fs.Arg(1)
+	nargs := map[string]int{"status": 1, "reload": 1, "kill-relay": 2, "kill-user": 2}
+	if n, ok := nargs[cmd]; !ok || fs.NArg() != n {
+		fs.Usage()
+		return 2
+	}
+
+	ac, code := adminClientOf("ctl", *file, *addr)
+	if ac == nil {
+		return code
+	}
+	var err error
+	switch cmd {
+	case "status":
+		var st adminStatus
+		if err = ac.do(http.MethodGet, "/status", &st); err == nil {
+			if *asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				err = enc.Encode(&st)
+			} else {
+				writeAdminStatus(os.Stdout, &st, time.Now())
+			}
+		}
+	case "reload":
+		if err = ac.do(http.MethodPost, "/reload", nil); err == nil {
+			fmt.Println("Configuration reloaded.")
+		}
+	case "kill-relay", "kill-user":
+		q := url.Values{strings.TrimPrefix(cmd, "kill-"): {arg}}
+		var reply struct{ Killed int }
+		if err = ac.do(http.MethodPost, "/kill?"+q.Encode(), &reply); err == nil {
+			fmt.Printf("Killed %d.\n", reply.Killed)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "xcat ctl: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// adminFlags adds flags locating the admin endpoint to fs.
+func adminFlags(fs *flag.FlagSet) (file, addr *string) {
+	file = fs.String("c", "", "configuration file of the running process")
+	addr = fs.String("addr", "", "address of the admin endpoint, overriding the configuration file")
+	return
+}
+
+// adminClientOf returns the client of the admin endpoint at addr, or that in
+// the configuration file. Errors are printed, and nil is returned with the
+// exit code.
+func adminClientOf(cmd, file, addr string) (*adminClient, int) {
+	var token []byte
+	if file != "" {
+		c, err := config.Load(file)
+		if err != nil {
+			printConfigErrors(os.Stderr, file, err)
+			return nil, 1
+		}
+		if addr == "" {
+			addr = c.Admin.Listen
+		}
+		token = c.Admin.Token
+	}
+	if t, ok := os.LookupEnv(envAdminToken); ok {
+		token = []byte(t)
+	}
+	if addr == "" {
+		fmt.Fprintf(os.Stderr, "xcat %s: no admin endpoint, set -addr or admin.listen in the configuration file given by -c\n", cmd)
+		return nil, 2
+	}
+	return newAdminClient(addr, token), 0
+}
+
+// adminClient makes requests to an admin endpoint.
+type adminClient struct {
+	base  string
+	token []byte
+	c     *http.Client
+}
+
+func newAdminClient(addr string, token []byte) *adminClient {
+	ac := &adminClient{base: "http://" + addr, token: token, c: &http.Client{Timeout: 10 * time.Second}}
+	if path, ok := util.SplitUnixAddr(addr); ok {
+		ac.base = "http://xcat"
+		ac.c.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return ac
+}
+
+// do makes a request of method to path, and decodes the JSON reply into v
+// if not nil.
+func (ac *adminClient) do(method, path string, v any) error {
+	resp, err := ac.request(ac.c, method, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.New("invalid reply: " + err.Error())
+	}
+	return nil
+}
+
+// stream gets path, and returns the reply body which is read until the
+// caller closes it.
+func (ac *adminClient) stream(path string) (io.ReadCloser, error) {
+	c := *ac.c
+	c.Timeout = 0
+	resp, err := ac.request(&c, http.MethodGet, path)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// request makes a request of method to path with c, failing if the reply is
+// not successful.
+func (ac *adminClient) request(c *http.Client, method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, ac.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(ac.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+string(ac.token))
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func writeAdminStatus(w io.Writer, st *adminStatus, now time.Time) {
+	age := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return now.Sub(t).Truncate(time.Second).String()
+	}
+	fmt.Fprintf(w, "Mode: %s, version: %s\n", st.Mode, st.Version)
+
+	fmt.Fprintf(w, "\nControl links: %d\n", len(st.CtrlLinks))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  ID\tFORWARD\tUSER\tREMOTE\tSTATE\tSINCE\tPENDING\tRTT")
+	for _, c := range st.CtrlLinks {
+		state := "up"
+		switch {
+		case c.Since.IsZero():
+			state = "idle" // Connected on the first inbound
+		case !c.Connected:
+			state = "down"
+		}
+		rtt := "-"
+		if c.RTT > 0 {
+			rtt = roundRTT(c.RTT).String()
+		}
+		fmt.Fprintf(tw, "  %d\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", c.ID, c.Forward, c.User, c.Remote, state, age(c.Since), c.Pending, rtt)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nRelays: %d\n", len(st.Relays))
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  ID\tNET\tFORWARD\tUSER\tREMOTE\tAGE\tUP\tDOWN")
+	for _, r := range st.Relays {
+		fmt.Fprintf(tw, "  %d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.ID, r.Network, r.Forward, r.User, r.Remote, age(r.Since), formatBytes(r.Up), formatBytes(r.Down))
+	}
+	tw.Flush()
+
+	if st.Rejected.Total == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nRejected by source filter: %d\n", st.Rejected.Total)
+	peers := make([]string, 0, len(st.Rejected.ByIP))
+	for ip := range st.Rejected.ByIP {
+		peers = append(peers, ip)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		ci, cj := st.Rejected.ByIP[peers[i]], st.Rejected.ByIP[peers[j]]
+		return ci > cj || ci == cj && peers[i] < peers[j]
+	})
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  PEER\tTIMES")
+	for _, ip := range peers[:min(len(peers), maxRejectedShown)] {
+		fmt.Fprintf(tw, "  %s\t%d\n", ip, st.Rejected.ByIP[ip])
+	}
+	tw.Flush()
+}
+
+// maxRejectedShown is the max number of rejected peers shown by status, those
+// rejected most.
+const maxRejectedShown = 10
+
+// formatBytes formats n bytes in binary units.
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%ciB", f, units[i])
+}
+
+// roundRTT rounds d to 3 significant digits at most.
+func roundRTT(d time.Duration) time.Duration {
+	r := time.Duration(1)
+	for d >= 1000*r {
+		r *= 10
+	}
+	return d.Round(r)
+}
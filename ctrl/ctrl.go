@@ -1,10 +1,15 @@
 package ctrl
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fishBone000/xcat/log"
@@ -13,150 +18,550 @@ import (
 	"github.com/fishBone000/xcat/util"
 )
 
+const GetPortRetries = 5
+
+// Delays between attempts of connecting again after the server is found
+// unreachable, doubling from ReconnectMin up to ReconnectMax, each randomized
+// to between half of it and it.
 const (
-	ConnectRetries = 5
-	GetPortRetries = 5
+	ReconnectMin = 500 * time.Millisecond
+	ReconnectMax = 30 * time.Second
 )
 
+// Requests sent on the control link, each one byte.
+const (
+	ReqTCP byte = 0x00
+	ReqUDP byte = 0x01
+	// ReqPing is a heartbeat, replied with ReplyPong. Servers not supporting
+	// it take it as ReqUDP.
+	ReqPing byte = 0x02
+	// ReqUDPMux is like ReqUDP, but the data link carries many flows, see
+	// package tunnel.
+	ReqUDPMux byte = 0x03
+)
+
+// A reply on the control link is either a non-zero port in 2 bytes big endian,
+// or 2 zero bytes followed by one of the reply codes below.
+const (
+	ReplyDenied           byte = 0x01
+	ReplyTooManyCtrlLinks byte = 0x02
+	ReplyTooManyPending   byte = 0x03
+	ReplyTooManyRelays    byte = 0x04
+	ReplyPong             byte = 0x05 // Of ReqPing, not a refusal
+)
+
+// ReplyError is returned by [ControlLink.GetPortTCP] and
+// [ControlLink.GetPortUDP] if the server refused the request.
+type ReplyError byte
+
+var (
+	ErrDenied           = ReplyError(ReplyDenied)
+	ErrTooManyCtrlLinks = ReplyError(ReplyTooManyCtrlLinks)
+	ErrTooManyPending   = ReplyError(ReplyTooManyPending)
+	ErrTooManyRelays    = ReplyError(ReplyTooManyRelays)
+)
+
+func (e ReplyError) Error() string {
+	switch byte(e) {
+	case ReplyDenied:
+		return "server denied the request"
+	case ReplyTooManyCtrlLinks:
+		return "server refused the control link: too many control links"
+	case ReplyTooManyPending:
+		return "server refused the request: too many pending data links"
+	case ReplyTooManyRelays:
+		return "server refused the request: too many relays"
+	}
+	return fmt.Sprintf("server refused the request with code 0x%02X", byte(e))
+}
+
+// UnreachableError is returned by port queries while the server is being
+// connected again in background.
+type UnreachableError struct {
+	Since time.Time // Of the first failed attempt
+	Err   error     // Of the latest attempt
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("server unreachable since %s: %v", e.Since.Format(time.DateTime), e.Err)
+}
+
+func (e *UnreachableError) Unwrap() error {
+	return e.Err
+}
+
 // r: connect retry
 // c: connected
 // B: broken
 type ControlLink struct {
-	addr           string
-	usr            []byte
-	pwd            []byte
-	timeout        time.Duration
-	connectFailCnt int
-	Sf             *stat.StatFile
-	cntr           stat.Counter
-	id             int
+	addr    string
+	key     ray.Key
+	timeout time.Duration
+	Sf      *stat.StatFile
+	Log     log.Logger
+	// Dial dials the server if not nil, instead of net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Handshake is called with the result of negotiation on each new
+	// connection if not nil.
+	Handshake func(err error)
+	// Heartbeat is the interval of pinging the server while connected, 0
+	// for none. A ping not replied in time breaks the connection, which is
+	// connected again at once rather than on the next port query.
+	Heartbeat time.Duration
+	cntr      stat.Counter
+	id        int
+	status    atomic.Pointer[Status]
+
+	historyMux sync.Mutex
+	history    []Status // Latest changes of status, oldest first
 
 	rconn *ray.RayConn
-	mux   sync.Mutex
+	// Held while using rconn, a channel so that waiting can be cancelled.
+	sem chan struct{}
+	// Set while connecting again in background, see reconnect.
+	outage        atomic.Pointer[UnreachableError]
+	stopReconnect context.CancelFunc
+}
+
+// Status is the state of a [ControlLink].
+type Status struct {
+	ID        int // In statistic files, changes after broken
+	Connected bool
+	Since     time.Time     // Of connecting or breaking, zero if never connected
+	Error     string        // Why broken or failed to connect, empty if closed
+	Connects  int           // Times connected so far
+	Failures  int           // Connecting attempts failed since broken
+	RTT       time.Duration // Smoothed round trip time of heartbeats, 0 if none yet
+	Jitter    time.Duration // Smoothed deviation of RTT
+}
+
+// historySize is how many changes of status are kept, see
+// [ControlLink.History].
+const historySize = 16
+
+// Status returns the current state of c.
+func (c *ControlLink) Status() Status {
+	if st := c.status.Load(); st != nil {
+		return *st
+	}
+	return Status{}
+}
+
+// History returns the latest changes of status, oldest first.
+func (c *ControlLink) History() []Status {
+	c.historyMux.Lock()
+	defer c.historyMux.Unlock()
+	return append([]Status(nil), c.history...)
+}
+
+func (c *ControlLink) setStatus(connected bool, err error) {
+	st := &Status{ID: c.id, Connected: connected, Since: time.Now(), Connects: c.Status().Connects}
+	if connected {
+		st.Connects++
+	}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	c.status.Store(st)
+
+	c.historyMux.Lock()
+	defer c.historyMux.Unlock()
+	if len(c.history) == historySize {
+		c.history = c.history[1:]
+	}
+	c.history = append(c.history, *st)
 }
 
 func NewCtrlLink(addr string, usr, pwd []byte, timeout time.Duration) *ControlLink {
+	return NewCtrlLinkKey(addr, ray.NewKey(usr, pwd), timeout)
+}
+
+func NewCtrlLinkKey(addr string, key ray.Key, timeout time.Duration) *ControlLink {
 	ctrl := &ControlLink{
-		addr:           addr,
-		usr:            usr,
-		pwd:            pwd,
-		timeout:        timeout,
-		connectFailCnt: 0,
+		addr:    addr,
+		key:     key,
+		timeout: timeout,
+		sem:     make(chan struct{}, 1),
 	}
 
 	return ctrl
 }
 
+func (c *ControlLink) lock(ctx context.Context) error {
+	select {
+	case c.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *ControlLink) unlock() {
+	<-c.sem
+}
+
 func (c *ControlLink) GetPortTCP() (port uint16, err error) {
-	return c.getPort(0x00)
+	return c.GetPortContext(context.Background(), ReqTCP)
 }
 
 func (c *ControlLink) GetPortUDP() (port uint16, err error) {
-	return c.getPort(0x01)
+	return c.GetPortContext(context.Background(), ReqUDP)
 }
 
-func (c *ControlLink) getPort(msg byte) (port uint16, err error) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
+// GetPortContext queries a port of a data link for req, [ReqTCP] or [ReqUDP].
+// If ctx is done before the reply, ctx.Err() is returned, and the connection
+// is closed if the query has been sent, as its reply can't be told apart
+// from later ones. While the server is unreachable, an [UnreachableError] is
+// returned at once.
+func (c *ControlLink) GetPortContext(ctx context.Context, req byte) (port uint16, err error) {
+	if o := c.outage.Load(); o != nil {
+		return 0, o
+	}
+	if err = c.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer c.unlock()
 
-	log.Debug("ctrl link: Getting port. ")
+	c.Log.Debug("ctrl link: Getting port. ")
 
 	for retry := 0; retry <= GetPortRetries; retry++ {
 		if retry != 0 {
-			log.Err(fmt.Errorf(
+			c.Log.Err(fmt.Errorf(
 				"ctrl link: Query port failed, retrying %d/%d. ",
 				retry, GetPortRetries,
 			))
 		}
 
-		err = c.connectNoLock()
+		err = c.connectNoLock(ctx)
 		if err != nil {
 			if retry != 0 {
-				log.Errf("ctrl link: Stopped trying querying port after %d retries. ", retry)
+				c.Log.Errf("ctrl link: Stopped trying querying port after %d retries. ", retry)
 			}
 			return
 		}
 
-		err = c.rconn.SetDeadline(time.Now().Add(c.timeout))
-		if err != nil {
-			log.Warnf("ctrl link: Failed to set deadline: %w. ", err)
+		rconn := c.rconn
+		stop := context.AfterFunc(ctx, func() { rconn.Close() })
+		port, err = c.queryNoLock(req)
+		if !stop() {
+			if c.rconn != nil {
+				c.setBroken(ctx.Err())
+			}
+			c.Log.Debug("ctrl link: Port query cancelled. ")
+			return 0, ctx.Err()
 		}
 
-		_, err = c.rconn.Write([]byte{msg})
-		if err != nil {
-			c.setBroken()
-			log.Err(fmt.Errorf("ctrl link: Couldn't send port query: %w. ", err))
-			continue
+		var re ReplyError
+		if errors.As(err, &re) {
+			return
 		}
-
-		buf := make([]byte, 2)
-		_, err = io.ReadFull(c.rconn, buf)
-		if err != nil {
-			c.setBroken()
-			log.Err(fmt.Errorf("ctrl link: Couldn't get port: %w. ", err))
-			continue
+		if err == nil {
+			c.Log.Debug(fmt.Sprintf("ctrl link: Got port %d. ", port))
+			return
 		}
+	}
 
-		port = binary.BigEndian.Uint16(buf)
+	c.Log.Err(fmt.Sprintf("ctrl link: Failed to get port after %d retries. ", GetPortRetries))
+	return
+}
 
-		if err == nil {
-			log.Debug(fmt.Sprintf("ctrl link: Got port %d. ", port))
+// queryNoLock sends req and reads the reply, the link is set broken if it
+// failed other than being refused.
+func (c *ControlLink) queryNoLock(req byte) (port uint16, err error) {
+	err = c.rconn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		c.Log.Warnf("ctrl link: Failed to set deadline: %v. ", err)
+	}
+
+	_, err = c.rconn.Write([]byte{req})
+	if err != nil {
+		c.setBroken(err)
+		c.Log.Err(fmt.Errorf("ctrl link: Couldn't send port query: %w. ", err))
+		return
+	}
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(c.rconn, buf)
+	if err != nil {
+		c.setBroken(err)
+		c.Log.Err(fmt.Errorf("ctrl link: Couldn't get port: %w. ", err))
+		return
+	}
+
+	port = binary.BigEndian.Uint16(buf)
+	if port == 0 {
+		_, err = io.ReadFull(c.rconn, buf[:1])
+		if err != nil {
+			c.setBroken(err)
+			c.Log.Err(fmt.Errorf("ctrl link: Couldn't get reply code: %w. ", err))
 			return
 		}
+		err = ReplyError(buf[0])
+		c.Log.Debugf("ctrl link: Port query refused: %v. ", err)
+		if err == ErrTooManyCtrlLinks {
+			// The server closes the link after this reply.
+			c.setBroken(err)
+		}
 	}
-
-	log.Err(fmt.Sprintf("ctrl link: Failed to get port after %d retries. ", GetPortRetries))
 	return
 }
 
-func (c *ControlLink) connect() (err error) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	return c.connectNoLock()
+func (c *ControlLink) connect(ctx context.Context) (err error) {
+	if err = c.lock(ctx); err != nil {
+		return err
+	}
+	defer c.unlock()
+	return c.connectNoLock(ctx)
 }
 
-func (c *ControlLink) connectNoLock() (err error) {
+// connectNoLock connects to the server if not connected. If failed, the
+// server is connected again in background, and port queries fail at once
+// meanwhile.
+func (c *ControlLink) connectNoLock(ctx context.Context) error {
 	if c.rconn != nil {
 		return nil
 	}
+	if o := c.outage.Load(); o != nil {
+		return o
+	}
 
-	for retry := 0; retry <= ConnectRetries; retry++ {
-		if retry != 0 && c.connectFailCnt == 0 {
-			log.Err(fmt.Errorf(
-				"ctrl link: connect failed, retrying %d/%d: %w. ",
-				retry, ConnectRetries, err,
-			))
+	c.Sf.Write("c", c.id, "r")
+	rconn, err := c.dial(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		c.setBroken(err)
+		c.Log.Errf("ctrl link %s: Failed to connect, connecting again in background: %v. ", c.addr, err)
+		o := &UnreachableError{Since: time.Now(), Err: err}
+		c.outage.Store(o)
+		ctx, cancel := context.WithCancel(context.Background())
+		c.stopReconnect = cancel
+		go c.reconnect(ctx, o.Since)
+		return o
+	}
+	c.connectedNoLock(rconn)
+	return nil
+}
+
+func (c *ControlLink) connectedNoLock(rconn *ray.RayConn) {
+	c.rconn = rconn
+	c.setStatus(true, nil)
+	c.Sf.WriteEvent(stat.Event{Kind: "c", ID: c.id, Code: "c", Remote: c.addr})
+	c.Log.Info("ctrl link " + c.addr + ": Connect successful: " + util.ConnStr(rconn) + ". ")
+	if c.Heartbeat > 0 {
+		go c.heartbeat(rconn)
+	}
+}
 
+// reconnect connects to the server with exponential backoff, until
+// succeeded or ctx is done.
+func (c *ControlLink) reconnect(ctx context.Context, since time.Time) {
+	delay := backoff(0)
+	for n := 1; ; n++ {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		c.lock(context.Background())
 		c.Sf.Write("c", c.id, "r")
-		c.rconn, err = ray.DialTimeout("tcp", c.addr, c.usr, c.pwd, c.timeout)
+		c.unlock()
+		rconn, err := c.dial(ctx)
+
+		c.lock(context.Background())
+		if ctx.Err() != nil {
+			// Closed meanwhile.
+			if rconn != nil {
+				rconn.Close()
+			}
+			c.unlock()
+			return
+		}
 		if err != nil {
+			c.setBroken(err)
+			c.outage.Store(&UnreachableError{Since: since, Err: err})
+			c.unlock()
+			delay = backoff(n)
+			c.Log.Warnf("ctrl link %s: Connecting attempt %d failed, next in %v: %v. ", c.addr, n, delay.Truncate(time.Millisecond), err)
 			continue
 		}
-		break
+		c.outage.Store(nil)
+		c.stopReconnect = nil
+		c.connectedNoLock(rconn)
+		c.unlock()
+		c.Log.Event("ctrl_link_restored").Infof(
+			"ctrl link %s: Server reachable again after %v, on attempt %d. ",
+			c.addr, time.Since(since).Truncate(time.Millisecond), n,
+		)
+		return
 	}
+}
 
-	if err != nil {
-		c.setBroken()
-		if c.connectFailCnt == 0 {
-			log.Errf(
-				"ctrl link: Failed to connect after %d retries: %w",
-				ConnectRetries, err,
-			)
-			log.Err("Control link to server lost. ")
+// backoff returns the delay before the connecting attempt after n failed
+// ones in background.
+func backoff(n int) time.Duration {
+	d := ReconnectMax
+	if n < 16 && ReconnectMin<<n < ReconnectMax {
+		d = ReconnectMin << n
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// errNoPong is returned by pingNoLock if the server doesn't support
+// heartbeats.
+var errNoPong = errors.New("heartbeat not supported by server")
+
+// heartbeat pings the server every c.Heartbeat until rconn is no longer the
+// connection of c. If a ping failed, the link is set broken and connected
+// again.
+func (c *ControlLink) heartbeat(rconn *ray.RayConn) {
+	ticker := time.NewTicker(c.Heartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.lock(context.Background())
+		if c.rconn != rconn {
+			c.unlock()
+			return
 		}
-		c.connectFailCnt += 1
-		return err
+		rtt, err := c.pingNoLock()
+		switch {
+		case err == nil:
+			st := c.updateRTT(rtt)
+			c.Sf.WriteEvent(stat.Event{Kind: "c", ID: c.id, Code: "h", RTT: rtt.Microseconds(), Jitter: st.Jitter.Microseconds()})
+			c.Log.Debugf("ctrl link %s: Heartbeat RTT %v, smoothed %v, jitter %v. ", c.addr, rtt, st.RTT, st.Jitter)
+			c.unlock()
+			continue
+		case errors.Is(err, errNoPong):
+			c.Log.Warnf("ctrl link %s: Server doesn't reply heartbeats, stopped sending them. ", c.addr)
+			c.unlock()
+			return
+		}
+		c.Sf.WriteEvent(stat.Event{Kind: "c", ID: c.id, Code: "H", Error: err.Error()})
+		c.Log.Warnf("ctrl link %s: Heartbeat failed, connecting again: %v. ", c.addr, err)
+		c.setBroken(err)
+		c.connectNoLock(context.Background())
+		c.unlock()
+		return
 	}
+}
 
-	c.connectFailCnt = 0
-	c.Sf.Write("c", c.id, "c")
-	log.Info("ctrl link " + c.addr + ": Connect successful: " + util.ConnStr(c.rconn) + ". ")
-	return nil
+// pingNoLock sends a heartbeat and returns the round trip time.
+func (c *ControlLink) pingNoLock() (time.Duration, error) {
+	timeout := c.timeout
+	if timeout <= 0 {
+		timeout = c.Heartbeat
+	}
+	start := time.Now()
+	if err := c.rconn.SetDeadline(start.Add(timeout)); err != nil {
+		c.Log.Warnf("ctrl link: Failed to set deadline: %v. ", err)
+	}
+	if _, err := c.rconn.Write([]byte{ReqPing}); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(c.rconn, buf[:2]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint16(buf) != 0 {
+		// Taken as ReqUDP and a port is allocated.
+		return 0, errNoPong
+	}
+	if _, err := io.ReadFull(c.rconn, buf[2:]); err != nil {
+		return 0, err
+	}
+	if buf[2] != ReplyPong {
+		return 0, errNoPong
+	}
+	return time.Since(start), nil
 }
 
-func (c *ControlLink) setBroken() {
+// updateRTT smooths rtt into the status like TCP does, see RFC 6298.
+func (c *ControlLink) updateRTT(rtt time.Duration) Status {
+	st := c.Status()
+	if st.RTT == 0 {
+		st.RTT, st.Jitter = rtt, rtt/2
+	} else {
+		d := st.RTT - rtt
+		if d < 0 {
+			d = -d
+		}
+		st.Jitter += (d - st.Jitter) / 4
+		st.RTT += (rtt - st.RTT) / 8
+	}
+	c.status.Store(&st)
+	return st
+}
+
+func (c *ControlLink) dial(ctx context.Context) (*ray.RayConn, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	dial := c.Dial
+	if dial == nil {
+		dialer := &net.Dialer{KeepAlive: 10 * time.Second}
+		dial = dialer.DialContext
+	}
+	conn, err := dial(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	rconn, err := ray.FromConnContext(ctx, conn, c.key)
+	if c.Handshake != nil {
+		c.Handshake(err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rconn, nil
+}
+
+// Close closes the current connection to server, if any, and stops
+// connecting again in background. Later port queries will connect again.
+func (c *ControlLink) Close() error {
+	c.lock(context.Background())
+	defer c.unlock()
+	if c.stopReconnect != nil {
+		c.stopReconnect()
+		c.stopReconnect = nil
+		c.outage.Store(nil)
+	}
+	if c.rconn == nil {
+		return nil
+	}
+	err := c.rconn.Close()
 	c.rconn = nil
-	c.Sf.Write("c", c.id, "B")
+	c.setStatus(false, nil)
+	return err
+}
+
+// setBroken closes the control link if any, so that it no longer counts
+// against the limits of the server.
+func (c *ControlLink) setBroken(err error) {
+	if c.rconn != nil {
+		util.CloseCloser(c.rconn)
+		c.rconn = nil
+	}
+	ev := stat.Event{Kind: "c", ID: c.id, Code: "B", Remote: c.addr}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	c.Sf.WriteEvent(ev)
+	if st := c.Status(); st.Connected {
+		c.setStatus(false, err)
+	} else if err != nil {
+		// Failed to connect, the link stays down since it broke.
+		st.Error, st.Failures = err.Error(), st.Failures+1
+		if st.Since.IsZero() {
+			st.Since = time.Now()
+		}
+		c.status.Store(&st)
+	}
 	c.id = c.cntr.Tick()
 }
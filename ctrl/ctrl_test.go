@@ -0,0 +1,255 @@
+package ctrl
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/ray"
+)
+
+var testKey = ray.NewKey([]byte("alice"), []byte("secret"))
+
+func TestUpdateRTT(t *testing.T) {
+	c := NewCtrlLinkKey("", testKey, time.Second)
+	for _, tc := range []struct{ rtt, srtt, jitter time.Duration }{
+		// The first sample, then R' = 7/8 R + 1/8 sample and
+		// V' = 3/4 V + 1/4 |R - sample|.
+		{100 * time.Millisecond, 100 * time.Millisecond, 50 * time.Millisecond},
+		{200 * time.Millisecond, 112500 * time.Microsecond, 62500 * time.Microsecond},
+		{112500 * time.Microsecond, 112500 * time.Microsecond, 46875 * time.Microsecond},
+		{16500 * time.Microsecond, 100500 * time.Microsecond, 59156250 * time.Nanosecond},
+	} {
+		st := c.updateRTT(tc.rtt)
+		if st.RTT != tc.srtt || st.Jitter != tc.jitter {
+			t.Fatalf("sample %v: want RTT %v jitter %v, got %v %v", tc.rtt, tc.srtt, tc.jitter, st.RTT, st.Jitter)
+		}
+		if c.Status() != st {
+			t.Fatalf("sample %v: status not stored", tc.rtt)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		n    int
+		base time.Duration
+	}{
+		{0, ReconnectMin},
+		{1, 2 * ReconnectMin},
+		{5, 32 * ReconnectMin},
+		{6, ReconnectMax},
+		{16, ReconnectMax},
+		{100, ReconnectMax},
+	} {
+		lo, hi := tc.base, time.Duration(0)
+		for i := 0; i < 1000; i++ {
+			d := backoff(tc.n)
+			if d < tc.base/2 || d > tc.base {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", tc.n, d, tc.base/2, tc.base)
+			}
+			lo, hi = min(lo, d), max(hi, d)
+		}
+		if hi-lo < tc.base/4 {
+			t.Errorf("backoff(%d) within [%v, %v] only, not randomized", tc.n, lo, hi)
+		}
+	}
+}
+
+// fakeServer serves control links on a loopback port, replying requests with
+// reply, no reply if it returns nil. It returns the address and the count of
+// control links connected.
+func fakeServer(t *testing.T, reply func(req byte) []byte) (string, *atomic.Int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var links atomic.Int32
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		l.Close()
+		mux.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mux.Unlock()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mux.Lock()
+			conns = append(conns, conn)
+			mux.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				rconn, _, err := ray.FromConnAny(conn, []ray.Key{testKey})
+				if err != nil {
+					return
+				}
+				links.Add(1)
+				buf := make([]byte, 1)
+				for {
+					if _, err := rconn.Read(buf); err != nil {
+						return
+					}
+					if p := reply(buf[0]); p != nil {
+						rconn.Write(p)
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), &links
+}
+
+// portReply returns the reply of port p.
+func portReply(p uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, p)
+}
+
+// waitFor polls cond until it's true, or fails the test after 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHeartbeatOldServer(t *testing.T) {
+	var pings atomic.Int32
+	addr, links := fakeServer(t, func(req byte) []byte {
+		if req == ReqPing {
+			// Taken as ReqUDP.
+			pings.Add(1)
+		}
+		return portReply(1234)
+	})
+	c := NewCtrlLinkKey(addr, testKey, time.Second)
+	c.Heartbeat = 10 * time.Millisecond
+	defer c.Close()
+
+	if port, err := c.GetPortTCP(); err != nil || port != 1234 {
+		t.Fatalf("want port 1234, got %d, %v", port, err)
+	}
+	waitFor(t, "ping", func() bool { return pings.Load() > 0 })
+	time.Sleep(10 * c.Heartbeat)
+	if n := pings.Load(); n != 1 {
+		t.Errorf("want heartbeats stopped after errNoPong, got %d pings", n)
+	}
+	if st := c.Status(); !st.Connected || st.Connects != 1 || links.Load() != 1 {
+		t.Errorf("want link kept after errNoPong, got %+v with %d links", st, links.Load())
+	}
+	if port, err := c.GetPortTCP(); err != nil || port != 1234 {
+		t.Errorf("want port 1234, got %d, %v", port, err)
+	}
+}
+
+func TestHeartbeatLost(t *testing.T) {
+	var pongs atomic.Int32
+	addr, links := fakeServer(t, func(req byte) []byte {
+		if req != ReqPing {
+			return portReply(1234)
+		}
+		// The 4th ping is lost, breaking the first control link.
+		if pongs.Add(1) == 4 {
+			return nil
+		}
+		return []byte{0, 0, ReplyPong}
+	})
+	c := NewCtrlLinkKey(addr, testKey, 100*time.Millisecond)
+	c.Heartbeat = 10 * time.Millisecond
+	defer c.Close()
+
+	if err := c.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "reconnect", func() bool { return c.Status().Connects == 2 })
+	if links.Load() != 2 {
+		t.Errorf("want 2 control links, got %d", links.Load())
+	}
+	var broken *Status
+	h := c.History()
+	for i := range h {
+		if !h[i].Connected {
+			broken = &h[i]
+		}
+	}
+	if broken == nil || broken.Error == "" {
+		t.Fatalf("want link broken by lost pong in history, got %+v", c.History())
+	}
+	if !c.Status().Connected {
+		t.Errorf("want connected again, got %+v", c.Status())
+	}
+	waitFor(t, "RTT", func() bool { return c.Status().RTT > 0 })
+}
+
+func TestUnreachable(t *testing.T) {
+	addr, _ := fakeServer(t, func(req byte) []byte { return portReply(1234) })
+	errDown := errors.New("network down")
+	var down atomic.Bool
+	var dials atomic.Int32
+	down.Store(true)
+
+	c := NewCtrlLinkKey(addr, testKey, time.Second)
+	c.Log = func(*log.Entry) {}
+	c.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		if down.Load() {
+			return nil, errDown
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	defer c.Close()
+
+	_, err := c.GetPortTCP()
+	var ue *UnreachableError
+	if !errors.As(err, &ue) || !errors.Is(err, errDown) {
+		t.Fatalf("want UnreachableError, got %v", err)
+	}
+	since := ue.Since
+
+	// Failing fast while connecting again in background, the first
+	// attempt is not before ReconnectMin/2.
+	start := time.Now()
+	_, err = c.GetPortTCP()
+	if !errors.As(err, &ue) || ue.Since != since {
+		t.Fatalf("want UnreachableError since %v, got %v", since, err)
+	}
+	if d := time.Since(start); d > ReconnectMin/4 {
+		t.Errorf("want query failed at once, took %v", d)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("want no dial by queries during outage, got %d dials", n)
+	}
+	if st := c.Status(); st.Connected || st.Failures == 0 {
+		t.Errorf("want link down with failures, got %+v", st)
+	}
+
+	down.Store(false)
+	waitFor(t, "reconnect", func() bool { return c.Status().Connected })
+	if port, err := c.GetPortTCP(); err != nil || port != 1234 {
+		t.Errorf("want port 1234 once reachable, got %d, %v", port, err)
+	}
+}
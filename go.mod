@@ -3,8 +3,12 @@ module github.com/fishBone000/xcat
 go 1.21.1
 
 require (
-	github.com/fatih/color v1.15.0 // indirect
+	github.com/fatih/color v1.15.0
+	github.com/mattn/go-isatty v0.0.17
+	golang.org/x/sys v0.6.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.17 // indirect
-	golang.org/x/sys v0.6.0 // indirect
 )
@@ -0,0 +1,280 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
+)
+
+// Fields describe what an entry is about, empty ones are omitted.
+type Fields struct {
+	Subsystem string `json:"subsystem,omitempty"` // See [Logger.Named]
+	ConnID    string `json:"conn_id,omitempty"`
+	User      string `json:"user,omitempty"`
+	Local     string `json:"local,omitempty"`
+	Remote    string `json:"remote,omitempty"`
+	Event     string `json:"event,omitempty"`
+}
+
+// fill sets fields of f that are empty to those of o.
+func (f *Fields) fill(o Fields) {
+	for _, p := range []struct {
+		dst *string
+		src string
+	}{
+		{&f.Subsystem, o.Subsystem},
+		{&f.ConnID, o.ConnID},
+		{&f.User, o.User},
+		{&f.Local, o.Local},
+		{&f.Remote, o.Remote},
+		{&f.Event, o.Event},
+	} {
+		if *p.dst == "" {
+			*p.dst = p.src
+		}
+	}
+}
+
+// Entry is a logged message.
+type Entry struct {
+	Time  time.Time
+	Level int
+	Msg   string
+	Fields
+
+	key string // Entries of the same key are sampled together
+}
+
+// Backend writes entries, it must be safe for concurrent use.
+type Backend interface {
+	Write(e *Entry) error
+}
+
+var (
+	backendMux sync.RWMutex
+	backend    Backend = NewTextBackend(os.Stdout)
+)
+
+// SetBackend makes b the backend of entries and returns the previous one.
+func SetBackend(b Backend) Backend {
+	backendMux.Lock()
+	defer backendMux.Unlock()
+	old := backend
+	backend = b
+	return old
+}
+
+func write(e *Entry) {
+	if e.Level > LevelOf(e.Subsystem) {
+		return
+	}
+	if s := sampling.Load(); s != nil {
+		key := e.key
+		if key == "" {
+			key = e.Msg
+		}
+		ok, dropped := s.pass(strconv.Itoa(e.Level)+"\x00"+e.Subsystem+"\x00"+key, e.Time)
+		if !ok {
+			return
+		}
+		if dropped > 0 {
+			e.Msg = fmt.Sprintf("%s (%d similar messages suppressed)", strings.TrimSpace(e.Msg), dropped)
+		}
+	}
+	backendMux.RLock()
+	defer backendMux.RUnlock()
+	if err := backend.Write(e); err != nil {
+		fmt.Fprintf(os.Stderr, "log: %s\n", err)
+	}
+}
+
+func output(level int, fl Fields, key, msg string) {
+	write(&Entry{Time: time.Now(), Level: level, Msg: msg, Fields: fl, key: key})
+}
+
+// sprintf is fmt.Sprintf accepting %w like fmt.Errorf does.
+func sprintf(f string, a ...any) string {
+	if !strings.Contains(f, "%w") {
+		return fmt.Sprintf(f, a...)
+	}
+	var b strings.Builder
+	for i := 0; i < len(f); i++ {
+		b.WriteByte(f[i])
+		if f[i] != '%' || i+1 == len(f) {
+			continue
+		}
+		i++
+		if f[i] == 'w' {
+			b.WriteByte('v')
+		} else {
+			b.WriteByte(f[i])
+		}
+	}
+	return fmt.Sprintf(b.String(), a...)
+}
+
+var severities = [...]string{LvlErr: "ERROR", LvlWarn: "WARN", LvlInfo: "INFO", LvlDbg: "DEBUG"}
+
+func severity(level int) string {
+	if level < 0 || level >= len(severities) {
+		return fmt.Sprint(level)
+	}
+	return severities[level]
+}
+
+// TextBackend writes entries as human readable text, colored by level if
+// enabled. Fields are not written.
+type TextBackend struct {
+	mux    sync.Mutex
+	w      io.Writer
+	colors [len(severities)]*color.Color
+}
+
+// NewTextBackend returns a TextBackend writing to w, colors are enabled if w
+// is a terminal and the NO_COLOR environment variable is not set.
+func NewTextBackend(w io.Writer) *TextBackend {
+	b := &TextBackend{w: w}
+	b.colors = [...]*color.Color{
+		LvlErr:  color.New(color.FgRed, color.Bold),
+		LvlWarn: color.New(color.FgYellow, color.Bold),
+		LvlInfo: color.New(),
+		LvlDbg:  color.New(color.FgHiBlack),
+	}
+	b.SetColor(IsTerminal(w) && os.Getenv("NO_COLOR") == "")
+	return b
+}
+
+// SetColor enables or disables colors.
+func (b *TextBackend) SetColor(on bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for _, c := range b.colors {
+		if on {
+			c.EnableColor()
+		} else {
+			c.DisableColor()
+		}
+	}
+}
+
+func (b *TextBackend) Write(e *Entry) error {
+	s := format(severity(e.Level), e.Time, e.Msg)
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if e.Level >= 0 && e.Level < len(b.colors) {
+		_, err := b.colors[e.Level].Fprint(b.w, s)
+		return err
+	}
+	_, err := io.WriteString(b.w, s)
+	return err
+}
+
+// JSONBackend writes entries as JSON objects, one per line, with fields
+// time, level and msg, followed by non-empty ones of [Fields].
+type JSONBackend struct {
+	mux sync.Mutex
+	enc *json.Encoder
+}
+
+// MarshalJSON encodes e like [JSONBackend] does.
+func (e *Entry) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(&struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+		Fields
+	}{e.Time.Format(time.RFC3339Nano), strings.ToLower(severity(e.Level)), strings.TrimSpace(e.Msg), e.Fields})
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), err
+}
+
+func NewJSONBackend(w io.Writer) *JSONBackend {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &JSONBackend{enc: enc}
+}
+
+func (b *JSONBackend) Write(e *Entry) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.enc.Encode(e)
+}
+
+// Tee returns a backend writing entries to all of bs, the first error is
+// returned.
+func Tee(bs ...Backend) Backend {
+	return tee(bs)
+}
+
+type tee []Backend
+
+func (t tee) Write(e *Entry) error {
+	var first error
+	for _, b := range t {
+		if err := b.Write(e); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// History is a backend keeping the latest entries of a level or more severe,
+// for showing them elsewhere. See [Tee].
+type History struct {
+	mux     sync.Mutex
+	level   int
+	entries []Entry // A ring of the latest ones
+	seq     uint64  // Of the latest entry, counting from 1
+}
+
+// NewHistory returns a History keeping size entries of level or more severe.
+func NewHistory(size, level int) *History {
+	return &History{level: level, entries: make([]Entry, size)}
+}
+
+func (h *History) Write(e *Entry) error {
+	if e.Level > h.level || len(h.entries) == 0 {
+		return nil
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.seq++
+	h.entries[h.seq%uint64(len(h.entries))] = *e
+	return nil
+}
+
+// Since returns entries kept after seq, oldest first, and the seq of the
+// latest entry. Pass 0 for all entries kept.
+func (h *History) Since(seq uint64) ([]Entry, uint64) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	n := uint64(len(h.entries))
+	if h.seq-seq < n {
+		n = h.seq - seq
+	}
+	es := make([]Entry, 0, n)
+	for i := h.seq - n + 1; i <= h.seq; i++ {
+		es = append(es, h.entries[i%uint64(len(h.entries))])
+	}
+	return es, h.seq
+}
+
+// IsTerminal reports whether w is a terminal.
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
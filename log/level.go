@@ -0,0 +1,110 @@
+package log
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Subsystems have levels of their own, see [SetLevels].
+var Subsystems = []string{"ray", "ctrl", "relay", "listener", "udp"}
+
+var levels atomic.Pointer[map[string]int]
+
+// SetLevels sets levels of subsystems by name, those not in m follow Level.
+func SetLevels(m map[string]int) {
+	m = maps.Clone(m)
+	levels.Store(&m)
+}
+
+// Levels returns levels set by SetLevels.
+func Levels() map[string]int {
+	if m := levels.Load(); m != nil {
+		return maps.Clone(*m)
+	}
+	return nil
+}
+
+// LevelOf returns the level of subsystem name.
+func LevelOf(name string) int {
+	if m := levels.Load(); m != nil {
+		if l, ok := (*m)[name]; ok {
+			return l
+		}
+	}
+	return Level
+}
+
+// enabled reports whether entries of level are written for any subsystem.
+func enabled(level int) bool {
+	if level <= Level {
+		return true
+	}
+	if m := levels.Load(); m != nil {
+		for _, l := range *m {
+			if level <= l {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var sampling atomic.Pointer[sampler]
+
+// SetSampling limits entries of the same level, subsystem and format to
+// burst per interval, further ones are dropped, and counted in the first
+// one written afterwards. Sampling is disabled if burst is 0.
+func SetSampling(burst int, interval time.Duration) {
+	if burst <= 0 || interval <= 0 {
+		sampling.Store(nil)
+		return
+	}
+	sampling.Store(&sampler{burst: burst, interval: interval, m: make(map[string]*window)})
+}
+
+// Windows of sampling kept before expired ones are removed.
+const maxWindows = 4096
+
+type sampler struct {
+	burst    int
+	interval time.Duration
+
+	mux sync.Mutex
+	m   map[string]*window
+}
+
+type window struct {
+	start   time.Time
+	n       int
+	dropped int
+}
+
+// pass reports whether an entry of key at t is written, with the number of
+// entries dropped before it.
+func (s *sampler) pass(key string, t time.Time) (ok bool, dropped int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	w := s.m[key]
+	if w == nil {
+		if len(s.m) >= maxWindows {
+			for k, w := range s.m {
+				if t.Sub(w.start) >= s.interval {
+					delete(s.m, k)
+				}
+			}
+		}
+		w = &window{start: t}
+		s.m[key] = w
+	} else if t.Sub(w.start) >= s.interval {
+		dropped = w.dropped
+		*w = window{start: t}
+	}
+	if w.n >= s.burst {
+		w.dropped++
+		return false, 0
+	}
+	w.n++
+	return true, dropped
+}
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"strings"
 	"time"
-
-	"github.com/fatih/color"
 )
 
 var Level int = 0
@@ -17,24 +15,17 @@ const (
 	LvlDbg  = 3
 )
 
-var (
-	errColor  = color.New(color.FgRed, color.Bold)
-	warnColor = color.New(color.FgYellow, color.Bold)
-	infoColor = color.New()
-	dbgColor  = color.New(color.FgHiBlack)
-)
-
-func prefix(severity string) string {
-	return fmt.Sprintf("[%s] %s", severity, time.Now().Format("15:04:05.000"))
+func prefix(severity string, t time.Time) string {
+	return fmt.Sprintf("[%s] %s", severity, t.Format("15:04:05.000"))
 }
 
-func format(severity, s string) string {
+func format(severity string, t time.Time, s string) string {
 	res := ""
 	lines := strings.FieldsFunc(s, func(r rune) bool { return r == '\n' })
 	indent := ""
 	for i, line := range lines {
 		if i == 0 {
-			p := prefix(severity)
+			p := prefix(severity, t)
 			indent = strings.Repeat(" ", len(p))
 			res += fmt.Sprint(p, " ", line, "\n")
 			continue
@@ -48,54 +39,139 @@ func Err(a ...any) {
   if Level < LvlErr {
     return
   }
-	errColor.Print(format("ERROR", fmt.Sprint(a...)))
+	output(LvlErr, Fields{}, "", fmt.Sprint(a...))
 }
 
 func Errf(f string, a ...any) {
   if Level < LvlErr {
     return
   }
-	errColor.Print(format("ERROR", fmt.Errorf(f, a...).Error()))
+	output(LvlErr, Fields{}, f, sprintf(f, a...))
 }
 
 func Warn(a ...any) {
   if Level < LvlWarn {
     return
   }
-	warnColor.Print(format("WARN", fmt.Sprint(a...)))
+	output(LvlWarn, Fields{}, "", fmt.Sprint(a...))
 }
 
 func Warnf(f string, a ...any) {
   if Level < LvlWarn {
     return
   }
-	warnColor.Print(format("WARN", fmt.Errorf(f, a...).Error()))
+	output(LvlWarn, Fields{}, f, sprintf(f, a...))
 }
 
 func Info(a ...any) {
   if Level < LvlInfo {
     return
   }
-	infoColor.Print(format("INFO", fmt.Sprint(a...)))
+	output(LvlInfo, Fields{}, "", fmt.Sprint(a...))
 }
 
 func Infof(f string, a ...any) {
   if Level < LvlInfo {
     return
   }
-	infoColor.Print(format("INFO", fmt.Errorf(f, a...).Error()))
+	output(LvlInfo, Fields{}, f, sprintf(f, a...))
 }
 
 func Debug(a ...any) {
   if Level < LvlDbg {
     return
   }
-	dbgColor.Print(format("DEBUG", fmt.Sprint(a...)))
+	output(LvlDbg, Fields{}, "", fmt.Sprint(a...))
 }
 
 func Debugf(f string, a ...any) {
   if Level < LvlDbg {
     return
   }
-	dbgColor.Print(format("DEBUG", fmt.Errorf(f, a...).Error()))
+	output(LvlDbg, Fields{}, f, sprintf(f, a...))
+}
+
+// Logger receives entries logged through it, it can be used to attach
+// fields to entries, see [Logger.With]. A nil Logger writes entries to the
+// current backend.
+type Logger func(e *Entry)
+
+// With returns a Logger attaching fl to entries.
+func With(fl Fields) Logger {
+	return Logger(nil).With(fl)
+}
+
+// With returns a Logger attaching fields of fl not set yet to entries,
+// then passing them to l.
+func (l Logger) With(fl Fields) Logger {
+	return func(e *Entry) {
+		e.Fields.fill(fl)
+		l.emit(e)
+	}
+}
+
+// Event returns a Logger attaching event name to entries.
+func (l Logger) Event(name string) Logger {
+	return l.With(Fields{Event: name})
+}
+
+// Named returns a Logger of subsystem name, entries of it are written if
+// not above the level of the subsystem, see [SetLevels].
+func Named(name string) Logger {
+	return Logger(nil).Named(name)
+}
+
+func (l Logger) Named(name string) Logger {
+	return l.With(Fields{Subsystem: name})
+}
+
+func (l Logger) emit(e *Entry) {
+	if l != nil {
+		l(e)
+		return
+	}
+	write(e)
+}
+
+func (l Logger) log(level int, key string, msg func() string) {
+	if !enabled(level) {
+		return
+	}
+	l.emit(&Entry{Time: time.Now(), Level: level, Msg: msg(), key: key})
+}
+
+func (l Logger) logf(level int, f string, a ...any) {
+	l.log(level, f, func() string { return sprintf(f, a...) })
+}
+
+func (l Logger) Err(a ...any) {
+	l.log(LvlErr, "", func() string { return fmt.Sprint(a...) })
+}
+
+func (l Logger) Errf(f string, a ...any) {
+	l.logf(LvlErr, f, a...)
+}
+
+func (l Logger) Warn(a ...any) {
+	l.log(LvlWarn, "", func() string { return fmt.Sprint(a...) })
+}
+
+func (l Logger) Warnf(f string, a ...any) {
+	l.logf(LvlWarn, f, a...)
+}
+
+func (l Logger) Info(a ...any) {
+	l.log(LvlInfo, "", func() string { return fmt.Sprint(a...) })
+}
+
+func (l Logger) Infof(f string, a ...any) {
+	l.logf(LvlInfo, f, a...)
+}
+
+func (l Logger) Debug(a ...any) {
+	l.log(LvlDbg, "", func() string { return fmt.Sprint(a...) })
+}
+
+func (l Logger) Debugf(f string, a ...any) {
+	l.logf(LvlDbg, f, a...)
 }
@@ -0,0 +1,147 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSprintf(t *testing.T) {
+	err := errors.New("boom")
+	// Formats are not constant so that vet allows %w.
+	cases := []struct{ f, want string }{
+		{"failed: %w", "failed: boom"},
+		{"failed: %v", "failed: boom"},
+		{"100%% %w", "100% boom"},
+	}
+	for _, c := range cases {
+		if got := sprintf(c.f, err); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.f, got, c.want)
+		}
+	}
+}
+
+func TestJSONBackend(t *testing.T) {
+	var b strings.Builder
+	old := SetBackend(NewJSONBackend(&b))
+	defer SetBackend(old)
+	defer func(l int) { Level = l }(Level)
+	Level = LvlInfo
+
+	l := With(Fields{ConnID: "7", User: "alice"}).Event("relay_started")
+	l.Infof("Relay for %s started. ", "alice")
+	l.Debug("Dropped. ")
+
+	var v map[string]string
+	if err := json.Unmarshal([]byte(b.String()), &v); err != nil {
+		t.Fatalf("%s: %q", err, b.String())
+	}
+	for k, want := range map[string]string{
+		"level":   "info",
+		"msg":     "Relay for alice started.",
+		"conn_id": "7",
+		"user":    "alice",
+		"event":   "relay_started",
+	} {
+		if v[k] != want {
+			t.Errorf("%s: got %q, want %q", k, v[k], want)
+		}
+	}
+	if _, ok := v["remote"]; ok {
+		t.Error("empty field remote written")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xcat.log")
+	r, err := OpenRotatingFile(path, 10, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := r.Write([]byte("12345678\n")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond) // Backups are named by milliseconds
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Errorf("expecting 1 backup, got %v", backups)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "12345678\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
+
+func TestLevelsAndSampling(t *testing.T) {
+	var b strings.Builder
+	old := SetBackend(NewJSONBackend(&b))
+	defer SetBackend(old)
+	defer func(l int) { Level = l }(Level)
+	Level = LvlInfo
+	SetLevels(map[string]int{"ctrl": LvlDbg, "listener": LvlErr})
+	defer SetLevels(nil)
+	SetSampling(2, time.Hour)
+	defer SetSampling(0, 0)
+
+	Named("ctrl").Debugf("ctrl %d. ", 1)
+	Named("listener").Infof("listener %d. ", 1)
+	Named("relay").Debugf("relay %d. ", 1)
+	for i := 0; i < 5; i++ {
+		Named("relay").Infof("repeated %d. ", i)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	var msgs []string
+	for _, line := range lines {
+		var v struct{ Msg string }
+		json.Unmarshal([]byte(line), &v)
+		msgs = append(msgs, v.Msg)
+	}
+	want := []string{"ctrl 1.", "repeated 0.", "repeated 1."}
+	if strings.Join(msgs, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", msgs, want)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := &sampler{burst: 1, interval: time.Second, m: make(map[string]*window)}
+	now := time.Now()
+	if ok, _ := s.pass("k", now); !ok {
+		t.Fatal("first entry dropped")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := s.pass("k", now.Add(time.Millisecond)); ok {
+			t.Fatal("entry beyond burst passed")
+		}
+	}
+	ok, dropped := s.pass("k", now.Add(time.Second))
+	if !ok || dropped != 3 {
+		t.Fatalf("got %v, %d dropped, want true, 3", ok, dropped)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(2, LvlWarn)
+	for i, l := range []int{LvlErr, LvlInfo, LvlWarn, LvlErr} {
+		h.Write(&Entry{Level: l, Msg: strconv.Itoa(i)})
+	}
+	es, seq := h.Since(0)
+	if seq != 3 || len(es) != 2 || es[0].Msg != "2" || es[1].Msg != "3" {
+		t.Fatalf("got %v, %d", es, seq)
+	}
+	if es, _ := h.Since(2); len(es) != 1 || es[0].Msg != "3" {
+		t.Fatalf("got %v after 2", es)
+	}
+	if es, _ := h.Since(3); len(es) != 0 {
+		t.Fatalf("got %v after 3", es)
+	}
+}
@@ -0,0 +1,140 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotateRetry is how long rotation is put off after it fails.
+const rotateRetry = time.Minute
+
+// RotatingFile is a log file renamed with the time appended, then recreated
+// when it grows over MaxSize bytes or has been written for Interval.
+// Zero values disable the respective rotation.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	Interval   time.Duration
+	MaxBackups int           // Renamed files kept, all are kept if 0
+	Header     func() []byte // Written at the beginning of each new file if not nil
+
+	mux         sync.Mutex
+	f           *os.File
+	closed      bool
+	size        int64
+	opened      time.Time
+	rotateAfter time.Time // Rotation failed, put off till then
+}
+
+// OpenRotatingFile opens path for appending, creating it if needed.
+func OpenRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{Path: path, MaxSize: maxSize, Interval: interval, MaxBackups: maxBackups}
+	if err := r.Open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Open opens r.Path for appending, creating it if needed.
+func (r *RotatingFile) Open() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.closed = false
+	return r.open()
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	if r.size == 0 && r.Header != nil {
+		n, err := f.Write(r.Header())
+		r.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.f == nil {
+		// Reopening failed last time.
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.size > 0 && time.Now().After(r.rotateAfter) &&
+		(r.MaxSize > 0 && r.size+int64(len(p)) > r.MaxSize ||
+			r.Interval > 0 && time.Since(r.opened) >= r.Interval) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames and recreates the file. On failure, the file is reopened so
+// that only the current write fails, and rotation is put off for rotateRetry.
+func (r *RotatingFile) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	if err == nil {
+		backup := r.Path + "." + time.Now().Format("20060102-150405.000")
+		err = os.Rename(r.Path, backup)
+	}
+	if err != nil {
+		r.rotateAfter = time.Now().Add(rotateRetry)
+		return errors.Join(err, r.open())
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune removes the oldest renamed files beyond MaxBackups.
+func (r *RotatingFile) prune() {
+	if r.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(r.Path + ".????????-??????.???")
+	if err != nil || len(backups) <= r.MaxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, b := range backups[:len(backups)-r.MaxBackups] {
+		os.Remove(b)
+	}
+}
+
+func (r *RotatingFile) Close() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.closed = true
+	if r.f == nil {
+		return nil
+	}
+	err := errors.Join(r.f.Sync(), r.f.Close())
+	r.f = nil
+	return err
+}
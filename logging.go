@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/fishBone000/xcat/config"
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/util"
+)
+
+var (
+	logOutput *logOutputSetting // Applied by setupLog
+	logFile   io.Closer         // Opened by setupLog, nil if standard output
+	// Latest warnings and errors, for the admin endpoint.
+	logHistory = log.NewHistory(200, log.LvlWarn)
+)
+
+// logOutputSetting is where and how logs are written.
+type logOutputSetting struct {
+	format, file string
+	maxSize      config.Size
+	rotate       config.Duration
+	maxBackups   int
+}
+
+// setupLog applies c, the backend is replaced only if the output changed.
+// Nothing is changed if failed.
+func setupLog(c config.Log) error {
+	out := logOutputSetting{c.Format, c.File, c.MaxSize, c.Rotate, c.MaxBackups}
+	if logOutput == nil || *logOutput != out {
+		var w io.Writer = os.Stdout
+		var f io.Closer
+		if c.File != "" {
+			rf, err := log.OpenRotatingFile(c.File, int64(c.MaxSize), time.Duration(c.Rotate), c.MaxBackups)
+			if err != nil {
+				return err
+			}
+			w, f = rf, rf
+		}
+
+		var b log.Backend = log.NewTextBackend(w)
+		if c.Format == "json" {
+			b = log.NewJSONBackend(w)
+		}
+		log.SetBackend(log.Tee(b, logHistory))
+		if logFile != nil {
+			util.CloseCloser(logFile)
+		}
+		logOutput, logFile = &out, f
+	}
+
+	log.Level = c.Level
+	debugMux.Lock()
+	debugAll = false
+	log.SetLevels(c.Levels)
+	debugMux.Unlock()
+	log.SetSampling(c.SampleBurst, time.Duration(c.SampleInterval))
+	return nil
+}
+
+var (
+	debugMux sync.Mutex
+	debugAll bool // Set by toggleDebug
+)
+
+// toggleDebug sets all subsystems to debug level, or back to the configured
+// levels if done before.
+func toggleDebug() {
+	debugMux.Lock()
+	defer debugMux.Unlock()
+	debugAll = !debugAll
+	if !debugAll {
+		log.SetLevels(cur.Load().Log.Levels)
+		log.Info("Subsystem log levels restored. ")
+		return
+	}
+	m := make(map[string]int)
+	for _, name := range log.Subsystems {
+		m[name] = log.LvlDbg
+	}
+	log.SetLevels(m)
+	log.Info("Debug logging enabled for all subsystems. ")
+}
+
+// watchDebugSignals toggles debug logging on debugSignals.
+func watchDebugSignals() {
+	if len(debugSignals) == 0 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, debugSignals...)
+	go func() {
+		for range ch {
+			toggleDebug()
+		}
+	}()
+}
@@ -1,14 +1,86 @@
 package main
 
-var version = "undefined"
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/fishBone000/xcat/acl"
+	"github.com/fishBone000/xcat/config"
 
-const udpIoRetries = 4
+	"github.com/fishBone000/xcat/log"
+)
+
+var version = "undefined"
 
 func main() {
-	switch Mode {
-	case ModeServer:
-		runServer()
-	case ModeClient:
-		runClient()
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stat" {
+		os.Exit(runStat(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		os.Exit(runTop(os.Args[2:]))
+	}
+
+	parseArgs()
+	watchDebugSignals()
+
+	switch cur.Load().Mode {
+	case config.ModeServer:
+		os.Exit(runServer())
+	case config.ModeClient:
+		os.Exit(runClient())
+	}
+}
+
+// checkConfig validates configuration files, printing errors found.
+func checkConfig(files []string) int {
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: xcat check-config FILE...")
+		return 2
+	}
+	code := 0
+	for _, file := range files {
+		c, err := config.Load(file)
+		if err == nil {
+			err = c.Validate()
+		}
+		if err != nil {
+			printConfigErrors(os.Stdout, file, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: OK\n", file)
+	}
+	return code
+}
+
+// acceptSrc checks the peer at addr against the source filter of s, logging
+// rejections.
+// The first rejection of a peer is logged as a warning, the rest and those of
+// peers not counted apart are debug messages.
+func acceptSrc(s *settings, addr net.Addr, what string) bool {
+	ok, cnt := s.SourceFilter().Check(addr)
+	if ok {
+		return true
+	}
+	peer := acl.OtherIPs
+	if cnt > 0 {
+		peer, _, _ = net.SplitHostPort(addr.String())
+	}
+	sourceRejections.With(peer).Inc()
+	switch cnt {
+	case 0:
+		log.Debugf("Rejected %s from %s by source address filter. ", what, addr)
+	case 1:
+		log.Warnf("Rejected %s from %s by source address filter. ", what, addr)
+	default:
+		log.Debugf("Rejected %s from %s by source address filter (%d times). ", what, addr, cnt)
 	}
+	return false
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/metrics"
+	"github.com/fishBone000/xcat/util"
+)
+
+// sourceRejections counts peers rejected by the source address filter, by
+// IP for up to acl.MaxRejectedIPs of them, the others by acl.OtherIPs.
+var sourceRejections = metrics.NewCounter("xcat_source_rejections_total",
+	"Peers rejected by the source address filter.", "peer")
+
+// serveMetrics serves the metrics endpoint of s if enabled, on the listener in
+// inherited first. The listener is returned, nil if disabled.
+func serveMetrics(s *settings, inherited map[string]*util.MultiListenerTCP) (*util.MultiListenerTCP, error) {
+	addr := s.Metrics.Listen
+	if addr == "" {
+		return nil, nil
+	}
+	l := inherited[addr]
+	delete(inherited, addr)
+	if l == nil {
+		var err error
+		l, err = util.ListenMultipleTCP("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Infof("Serving metrics on http://%s/metrics. ", l.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go func() {
+		err := http.Serve(l, mux)
+		if !stopping.Get() {
+			log.Errf("Metrics endpoint stopped: %v. ", err)
+		}
+	}()
+	return l, nil
+}
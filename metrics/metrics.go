@@ -0,0 +1,223 @@
+// Package metrics keeps counters, gauges and histograms, and exports them in
+// the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type family struct {
+	name    string
+	help    string
+	kind    string // counter, gauge or histogram
+	labels  []string
+	buckets []float64 // Upper bounds, histograms only
+
+	mux    sync.Mutex
+	series map[string]*series // By label values joined
+}
+
+type series struct {
+	values []string
+	v      Value
+	counts []uint64 // Of buckets, histograms only
+	sum    float64
+	count  uint64
+}
+
+var (
+	registryMux sync.Mutex
+	registry    []*family
+)
+
+func register(f *family) *family {
+	f.series = make(map[string]*series)
+	registryMux.Lock()
+	defer registryMux.Unlock()
+	for _, r := range registry {
+		if r.name == f.name {
+			panic("metrics: duplicate metric " + f.name)
+		}
+	}
+	registry = append(registry, f)
+	return f
+}
+
+// get returns the series of label values, which must be as many as the
+// labels.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	s := f.series[key]
+	if s == nil {
+		s = &series{values: append([]string(nil), values...)}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Value is a float64 updated atomically.
+type Value struct {
+	bits atomic.Uint64
+}
+
+func (v *Value) Add(d float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+d)) {
+			return
+		}
+	}
+}
+
+func (v *Value) Set(x float64) {
+	v.bits.Store(math.Float64bits(x))
+}
+
+func (v *Value) Inc() { v.Add(1) }
+func (v *Value) Dec() { v.Add(-1) }
+
+func (v *Value) Get() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+// Counter is a family of values that only go up, by label values.
+type Counter struct {
+	f *family
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{register(&family{name: name, help: help, kind: "counter", labels: labels})}
+}
+
+// With returns the value of label values, it should only be added to.
+func (c *Counter) With(values ...string) *Value {
+	return &c.f.get(values).v
+}
+
+// Gauge is a family of values that go up and down, by label values.
+type Gauge struct {
+	f *family
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{register(&family{name: name, help: help, kind: "gauge", labels: labels})}
+}
+
+func (g *Gauge) With(values ...string) *Value {
+	return &g.f.get(values).v
+}
+
+// Histogram counts observations in buckets, by label values.
+type Histogram struct {
+	f *family
+}
+
+// NewHistogram makes a histogram of buckets, which are upper bounds in
+// increasing order. The +Inf bucket is implied.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{register(&family{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})}
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	s := h.f.get(values)
+	h.f.mux.Lock()
+	defer h.f.mux.Unlock()
+	for i, b := range h.f.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// WriteText writes all metrics in the Prometheus text format.
+func WriteText(w io.Writer) error {
+	registryMux.Lock()
+	families := append([]*family(nil), registry...)
+	registryMux.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (f *family) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := f.series[k]
+		if f.buckets == nil {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelStr(s.values, ""), formatFloat(s.v.Get()))
+			continue
+		}
+		for i, b := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelStr(s.values, formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelStr(s.values, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labelStr(s.values, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labelStr(s.values, ""), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelStr formats label values, with le appended if not empty.
+func (f *family) labelStr(values []string, le string) string {
+	var pairs []string
+	for i, l := range f.labels {
+		pairs = append(pairs, l+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w)
+	})
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	c := NewCounter("test_bytes_total", "Bytes.", "user")
+	c.With("alice").Add(3)
+	c.With(`b"ob`).Inc()
+	h := NewHistogram("test_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var b strings.Builder
+	if err := WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE test_bytes_total counter",
+		`test_bytes_total{user="alice"} 3`,
+		`test_bytes_total{user="b\"ob"} 1`,
+		`test_seconds_bucket{le="0.1"} 0`,
+		`test_seconds_bucket{le="1"} 1`,
+		`test_seconds_bucket{le="+Inf"} 2`,
+		"test_seconds_sum 2.5",
+		"test_seconds_count 2",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, b.String())
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package ratelimit limits bandwidth with token buckets.
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinBurst is the minimum bucket size, so that the largest UDP datagram can
+// pass through in one go.
+const MinBurst = 64 * 1024
+
+// Limiter is a token bucket refilled at a rate of bytes per second, the
+// bucket holds tokens of 1 second, or [MinBurst] if larger.
+//
+// A nil Limiter doesn't limit.
+// All methods can be called simultaneously.
+type Limiter struct {
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+	mux    sync.Mutex
+}
+
+// NewLimiter returns a Limiter of rate bytes per second, or nil if rate is not
+// positive.
+func NewLimiter(rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := int(max(rate, MinBurst))
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// WaitN blocks until n bytes are allowed to pass.
+func (l *Limiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+	for n > 0 {
+		m := min(n, l.burst)
+		n -= m
+
+		l.mux.Lock()
+		now := time.Now()
+		l.tokens = min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		// Tokens may go below zero, so that later callers queue up behind.
+		l.tokens -= float64(m)
+		var wait time.Duration
+		if l.tokens < 0 {
+			wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		}
+		l.mux.Unlock()
+
+		time.Sleep(wait)
+	}
+}
+
+// Limiters waits on all of its limiters, nil ones are skipped.
+type Limiters []*Limiter
+
+func (ls Limiters) WaitN(n int) {
+	for _, l := range ls {
+		l.WaitN(n)
+	}
+}
+
+func (ls Limiters) active() bool {
+	for _, l := range ls {
+		if l != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// chunk is the largest size of a single Read or Write of a Conn, so that
+// limiters of a large buffer are waited on piece by piece.
+const chunk = 16 * 1024
+
+// Conn limits a net.Conn, its Read calls are limited by the read limiters
+// and Write calls by the write limiters.
+type Conn struct {
+	net.Conn
+	read  Limiters
+	write Limiters
+}
+
+// NewConn returns c as is if no limiter is effective.
+func NewConn(c net.Conn, read, write Limiters) net.Conn {
+	if !read.active() && !write.active() {
+		return c
+	}
+	return &Conn{Conn: c, read: read, write: write}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := c.Conn.Read(b)
+	c.read.WaitN(n)
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		p := b[:min(len(b), chunk)]
+		c.write.WaitN(len(p))
+		var n2 int
+		n2, err = c.Conn.Write(p)
+		n += n2
+		if err != nil {
+			return
+		}
+		b = b[n2:]
+	}
+	return
+}
+
+// ParseRate parses a rate in bytes per second, with an optional suffix of
+// k, M or G, in powers of 1024. "0" or "" means unlimited.
+func ParseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mul := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mul = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mul = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mul = 1 << 30
+	}
+	num := s
+	if mul != 1 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return n * mul, nil
+}
+
+// FormatRate is the reverse of ParseRate.
+func FormatRate(rate int64) string {
+	switch {
+	case rate == 0:
+		return "0"
+	case rate%(1<<30) == 0:
+		return strconv.FormatInt(rate>>30, 10) + "G"
+	case rate%(1<<20) == 0:
+		return strconv.FormatInt(rate>>20, 10) + "M"
+	case rate%(1<<10) == 0:
+		return strconv.FormatInt(rate>>10, 10) + "k"
+	}
+	return strconv.FormatInt(rate, 10)
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	const rate = 1 << 20
+	l := NewLimiter(rate)
+
+	begin := time.Now()
+	// The first second's worth passes at once, the next takes a second.
+	for i := 0; i < 2*rate/chunk; i++ {
+		l.WaitN(chunk)
+	}
+	elapsed := time.Since(begin)
+	if elapsed < 900*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Fatalf("expecting about 1s, took %s", elapsed)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	if l := NewLimiter(0); l != nil {
+		t.Fatal("expecting nil limiter for rate 0")
+	}
+	var ls Limiters = []*Limiter{nil, nil}
+	ls.WaitN(1 << 30)
+}
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]int64{
+		"":     0,
+		"0":    0,
+		"1000": 1000,
+		"512k": 512 << 10,
+		"10M":  10 << 20,
+		"1G":   1 << 30,
+	}
+	for s, want := range cases {
+		got, err := ParseRate(s)
+		if err != nil || got != want {
+			t.Errorf("%q: want %d, got %d, %v", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"k", "-1", "1T", "1.5M"} {
+		if _, err := ParseRate(s); err == nil || !strings.Contains(err.Error(), strconv.Quote(s)) {
+			t.Errorf("%q: expecting error quoting it, got %v", s, err)
+		}
+	}
+}
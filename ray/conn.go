@@ -1,9 +1,11 @@
 package ray
 
 import (
+	"context"
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fishBone000/xcat/util"
@@ -25,12 +27,43 @@ func FromConn(conn net.Conn, usr, pwd []byte) (*RayConn, error) {
 	}, nil
 }
 
+func FromConnKey(conn net.Conn, key Key) (*RayConn, error) {
+	ray, err := NegotiateKey(conn, key)
+	if err != nil {
+		return nil, err
+	}
+	return &RayConn{
+		Conn: conn,
+		Ray:  ray,
+	}, nil
+}
+
+// FromConnAny is like FromConn, but accepts peers with any one of keys, and
+// returns the index of the key the peer used. See [NegotiateAny].
+func FromConnAny(conn net.Conn, keys []Key) (*RayConn, int, error) {
+	ray, i, err := NegotiateAny(conn, keys)
+	if err != nil {
+		return nil, -1, err
+	}
+	return &RayConn{
+		Conn: conn,
+		Ray:  ray,
+	}, i, nil
+}
+
 func Dial(network string, addr string, usr, pwd []byte) (*RayConn, error) {
 	return DialTimeout(network, addr, usr, pwd, 0)
 }
 
 func DialTimeout(network string, addr string, usr, pwd []byte, d time.Duration) (*RayConn, error) {
-	ddl := time.Now().Add(d)
+	return DialTimeoutKey(network, addr, NewKey(usr, pwd), d)
+}
+
+func DialKey(network string, addr string, key Key) (*RayConn, error) {
+	return DialTimeoutKey(network, addr, key, 0)
+}
+
+func DialTimeoutKey(network string, addr string, key Key, d time.Duration) (*RayConn, error) {
 	dialer := &net.Dialer{
 		Timeout:   d,
 		KeepAlive: 10 * time.Second,
@@ -39,23 +72,60 @@ func DialTimeout(network string, addr string, usr, pwd []byte, d time.Duration)
 	if err != nil {
 		return nil, err
 	}
+	rconn, err := FromConnTimeout(conn, key, d)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rconn, nil
+}
+
+// DialContext dials addr and negotiates with key, the connection is closed
+// and ctx.Err() is returned if ctx is done before it's established.
+func DialContext(ctx context.Context, network string, addr string, key Key) (*RayConn, error) {
+	dialer := &net.Dialer{
+		KeepAlive: 10 * time.Second,
+	}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	rconn, err := FromConnContext(ctx, conn, key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rconn, nil
+}
+
+// FromConnContext is like FromConnKey, but see [NegotiateContext].
+func FromConnContext(ctx context.Context, conn net.Conn, key Key) (*RayConn, error) {
+	ray, err := NegotiateContext(ctx, conn, key)
+	if err != nil {
+		return nil, err
+	}
+	return &RayConn{
+		Conn: conn,
+		Ray:  ray,
+	}, nil
+}
+
+// FromConnTimeout is like FromConnKey, but fails if negotiation takes longer
+// than d. A d of 0 means no timeout.
+func FromConnTimeout(conn net.Conn, key Key, d time.Duration) (*RayConn, error) {
 	if d > 0 {
-		err = conn.SetDeadline(ddl)
-		if err != nil {
-			conn.Close()
+		if err := conn.SetDeadline(time.Now().Add(d)); err != nil {
 			return nil, err
 		}
 	}
 
-	ray, err := Negotiate(conn, usr, pwd)
+	ray, err := NegotiateKey(conn, key)
 	if err != nil {
 		return nil, err
 	}
 
 	if d > 0 {
-		err = conn.SetDeadline(time.Time{})
-		if err != nil {
-			conn.Close()
+		if err := conn.SetDeadline(time.Time{}); err != nil {
 			return nil, err
 		}
 	}
@@ -74,6 +144,18 @@ func (rc *RayConn) Write(p []byte) (n int, err error) {
 	return rc.Ray.Write(p)
 }
 
+// A RayUDP carries datagrams over UDP, or over its TCP connection if set
+// with [RayUDP.SetStream], for networks dropping UDP. Over TCP each datagram
+// is a Ray packet of TYPE (1) and BODY, where TYPE is one of:
+//
+//	DATA  (0x00): BODY is a datagram.
+//	HELLO (0x01): Sent by the dialing side once established, and replied by
+//	              the other, telling that streaming is supported. BODY is
+//	              about path MTU, see [RayUDP.SetMTU].
+//
+// An empty packet over UDP is a probe, echoed by the listening side, see
+// [RayUDP.ProbeUDP]. The listening side replies over what the last datagram
+// came from.
 type RayUDP struct {
 	udp          *net.UDPConn
 	preconnected bool
@@ -83,6 +165,34 @@ type RayUDP struct {
 	raddr        net.Addr
 	mux          sync.Mutex
 	errTCP       util.Fatal
+
+	in        chan udpRead
+	closed    util.Fatal
+	stream    atomic.Bool
+	hello     chan struct{} // Closed once HELLO is echoed
+	helloOnce sync.Once
+	pong      chan struct{}
+
+	mtu      atomic.Int32 // Path MTU, see [RayUDP.SetMTU]
+	fragment atomic.Bool  // Fragmenting datagrams over the payload MTU
+	peerFrag atomic.Bool  // Peer reassembling fragments
+	fragID   atomic.Uint32
+	partials map[uint32]*partial // Of readUDP only
+
+	// OnOversize is called for datagrams over the payload MTU written, if
+	// not nil. Set it before writing.
+	OnOversize func(size int, fragmented bool)
+}
+
+const (
+	streamData  byte = 0x00
+	streamHello byte = 0x01
+)
+
+// udpRead is a datagram or an error read by a RayUDP.
+type udpRead struct {
+	p   []byte
+	err error
 }
 
 func NewRayUDP(u *net.UDPConn, preconnected bool, t net.Conn, r *Ray) *RayUDP {
@@ -92,23 +202,21 @@ func NewRayUDP(u *net.UDPConn, preconnected bool, t net.Conn, r *Ray) *RayUDP {
 		ray:          r,
 		preconnected: preconnected,
 		laddr:        util.NewStrAddr("ray udp", t.LocalAddr().String()),
+		in:           make(chan udpRead),
+		hello:        make(chan struct{}),
+		pong:         make(chan struct{}, 1),
+		partials:     make(map[uint32]*partial),
 	}
 	if raddr := u.RemoteAddr(); raddr != nil {
 		ru.raddr = raddr
 	}
+	if preconnected {
+		ru.mtu.Store(int32(discoverMTU(u)))
+		ru.fragment.Store(true)
+	}
 
-	go func() {
-		for {
-			buffer := make([]byte, 1)
-			_, err := ru.tcp.Read(buffer)
-			if err != nil {
-				ru.errTCP.Set(err)
-				ru.tcp.Close()
-				ru.udp.Close()
-				return
-			}
-		}
-	}()
+	go ru.readTCP()
+	go ru.readUDP()
 	return ru
 }
 
@@ -117,21 +225,17 @@ func DialUDP(network, addr string, usr, pwd []byte) (*RayUDP, error) {
 }
 
 func DialTimeoutUDP(network, addr string, usr, pwd []byte, d time.Duration) (*RayUDP, error) {
-	var nwTcp string
-	switch network {
-	case "udp":
-		nwTcp = "tcp"
-	case "udp4":
-		nwTcp = "tcp4"
-	case "udp6":
-		nwTcp = "tcp6"
-	default:
-		return nil, net.UnknownNetworkError(network)
+	return DialTimeoutUDPKey(network, addr, NewKey(usr, pwd), d)
+}
+
+func DialTimeoutUDPKey(network, addr string, key Key, d time.Duration) (*RayUDP, error) {
+	nwTcp, err := tcpNetwork(network)
+	if err != nil {
+		return nil, err
 	}
 
-	ddl := time.Now().Add(d)
 	dialer := net.Dialer{
-		Deadline:  ddl,
+		Timeout:   d,
 		KeepAlive: 10 * time.Second,
 	}
 
@@ -139,36 +243,98 @@ func DialTimeoutUDP(network, addr string, usr, pwd []byte, d time.Duration) (*Ra
 	if err != nil {
 		return nil, err
 	}
+	ru, err := FromConnUDP(tcp, network, key, d)
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	return ru, nil
+}
 
+// FromConnUDP makes a UDP data link over tcp, which is connected to the
+// server. UDP packets are sent to the remote address of tcp.
+// Negotiation fails if it takes longer than d, a d of 0 means no timeout.
+func FromConnUDP(tcp net.Conn, network string, key Key, d time.Duration) (*RayUDP, error) {
 	raddr, _ := net.ResolveUDPAddr("udp", tcp.RemoteAddr().String())
 	udp, err := net.DialUDP(network, nil, raddr)
 	if err != nil {
-		tcp.Close()
 		return nil, err
 	}
 
+	var ddl time.Time
+	if d > 0 {
+		ddl = time.Now().Add(d)
+	}
 	if err := tcp.SetDeadline(ddl); err != nil {
-		tcp.Close()
 		udp.Close()
 		return nil, err
 	}
-	ray, err := Negotiate(tcp, usr, pwd)
+	ray, err := NegotiateKey(tcp, key)
 	if err != nil {
-		tcp.Close()
 		udp.Close()
 		return nil, err
 	}
 	if err := tcp.SetDeadline(time.Time{}); err != nil {
-		tcp.Close()
 		udp.Close()
 		return nil, err
 	}
 
-	ru := NewRayUDP(udp, true, tcp, ray)
+	return NewRayUDP(udp, true, tcp, ray), nil
+}
 
+// DialUDPContext is like DialTimeoutUDPKey, but the connections are closed and
+// ctx.Err() is returned if ctx is done before the data link is established.
+func DialUDPContext(ctx context.Context, network, addr string, key Key) (*RayUDP, error) {
+	nwTcp, err := tcpNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{
+		KeepAlive: 10 * time.Second,
+	}
+	tcp, err := dialer.DialContext(ctx, nwTcp, addr)
+	if err != nil {
+		return nil, err
+	}
+	ru, err := FromConnUDPContext(ctx, tcp, network, key)
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
 	return ru, nil
 }
 
+// FromConnUDPContext is like FromConnUDP, but negotiation is aborted once ctx
+// is done, see [NegotiateContext].
+func FromConnUDPContext(ctx context.Context, tcp net.Conn, network string, key Key) (*RayUDP, error) {
+	raddr, _ := net.ResolveUDPAddr("udp", tcp.RemoteAddr().String())
+	udp, err := net.DialUDP(network, nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ray, err := NegotiateContext(ctx, tcp, key)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+
+	return NewRayUDP(udp, true, tcp, ray), nil
+}
+
+func tcpNetwork(udpNetwork string) (string, error) {
+	switch udpNetwork {
+	case "udp":
+		return "tcp", nil
+	case "udp4":
+		return "tcp4", nil
+	case "udp6":
+		return "tcp6", nil
+	}
+	return "", net.UnknownNetworkError(udpNetwork)
+}
+
 // Deprecated. Check code before use.
 func ListenRayUDPTimeout(network, addr string, usr, pwd []byte, d time.Duration) (*RayUDP, error) {
 	var nwTcp string
@@ -229,58 +395,215 @@ func ListenRayUDPTimeout(network, addr string, usr, pwd []byte, d time.Duration)
 		return nil, err
 	}
 
-	return &RayUDP{
-		tcp: tcp,
-		udp: udp,
-		ray: ray,
-	}, nil
+	return NewRayUDP(udp, true, tcp, ray), nil
 }
 
 func (r *RayUDP) Read(b []byte) (n int, err error) {
-	var addr net.Addr
+	select {
+	case rd := <-r.in:
+		if rd.err != nil {
+			return 0, rd.err
+		}
+		return copy(b, rd.p), nil
+	case <-r.closed.Chan():
+		return 0, r.closed.Get()
+	}
+}
+
+// Write sends b over UDP, or over TCP if streaming. Empty datagrams are
+// dropped, as they are probes. Datagrams over the payload MTU are
+// fragmented, or rejected with [DatagramTooLargeError].
+func (r *RayUDP) Write(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if r.stream.Load() {
+		return r.writeStream(streamData, b)
+	}
+	if mtu := r.PayloadMTU(); len(b) > mtu {
+		return r.writeOversize(b, mtu)
+	}
+	return r.writeUDP(b)
+}
+
+func (r *RayUDP) writeUDP(b []byte) (n int, err error) {
+	var p []byte
+	p, err = r.ray.EncapPacket(b)
+	if err != nil {
+		return
+	}
+	if err := r.sendUDP(p); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (r *RayUDP) sendUDP(p []byte) (err error) {
+	if r.preconnected {
+		_, err = r.udp.Write(p)
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	_, err = r.udp.WriteTo(p, r.raddr)
+	return
+}
+
+func (r *RayUDP) writeStream(typ byte, b []byte) (int, error) {
+	if len(b)+1 > MaxPlaintextSize {
+		return 0, PacketTooLargeError(len(b))
+	}
+	p := make([]byte, 1+len(b))
+	p[0] = typ
+	copy(p[1:], b)
+	if _, err := r.ray.Write(p); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// push queues rd for Read, false if r is closed.
+func (r *RayUDP) push(rd udpRead) bool {
+	select {
+	case r.in <- rd:
+		return true
+	case <-r.closed.Chan():
+		return false
+	}
+}
+
+func (r *RayUDP) readUDP() {
+	// ceil((2+0xFFFF) / aes.BlockSize) * aes.BlockSize + sha512.Size256
+	buffer := make([]byte, 65584)
 	for {
-		n, addr, err = r.udp.ReadFrom(b)
-		if addr == nil {
-			if n == 0 && err != nil {
+		n, addr, err := r.udp.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				r.closed.Set(err)
 				return
 			}
-			panic("IMPOSSIBLE! net.UDPConn.ReadFrom returned unexpected values. ")
+			if !r.push(udpRead{err: err}) {
+				return
+			}
+			continue
 		}
 		r.mux.Lock()
 		if r.raddr == nil {
 			r.raddr = addr
+		} else if r.raddr.String() != addr.String() {
 			r.mux.Unlock()
-			break
-		} else {
-			r.mux.Unlock()
-			if r.raddr.String() == addr.String() {
-				break
+			continue
+		}
+		r.mux.Unlock()
+
+		p, fragment, err := r.ray.decapUDP(buffer[:n])
+		if fragment {
+			if p = r.reassemble(p); p == nil {
+				continue
+			}
+		}
+		switch {
+		case err != nil:
+			if !r.push(udpRead{err: err}) {
+				return
+			}
+		case len(p) == 0 && r.preconnected:
+			select {
+			case r.pong <- struct{}{}:
+			default:
+			}
+		case len(p) == 0:
+			r.writeUDP(nil)
+		default:
+			if !r.preconnected {
+				r.stream.Store(false)
+			}
+			if !r.push(udpRead{p: p}) {
+				return
 			}
 		}
 	}
+}
 
-	if n > 0 {
-		p, dcErr := r.ray.DecapPacket(b[:n])
-		if dcErr != nil {
-			return 0, errors.Join(dcErr, err)
+// readTCP reads datagrams streamed over TCP, r is closed once TCP fails.
+func (r *RayUDP) readTCP() {
+	if r.preconnected {
+		r.sendHello()
+	}
+	buffer := make([]byte, MaxPlaintextSize)
+	for {
+		n, err := r.ray.Read(buffer)
+		if err != nil {
+			r.errTCP.Set(err)
+			r.tcp.Close()
+			r.udp.Close()
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		switch buffer[0] {
+		case streamData:
+			if !r.preconnected {
+				r.stream.Store(true)
+			}
+			if !r.push(udpRead{p: append([]byte(nil), buffer[1:n]...)}) {
+				return
+			}
+		case streamHello:
+			r.handleHello(buffer[1:n])
 		}
-		n = copy(b, p)
 	}
-	return
 }
 
-func (r *RayUDP) Write(b []byte) (n int, err error) {
-	var p []byte
-	p, err = r.ray.EncapPacket(b)
-	if err != nil {
-		return
+// SetStream sets whether datagrams are sent over TCP instead of UDP. Only the
+// dialing side should call it, the other side follows.
+func (r *RayUDP) SetStream(on bool) {
+	r.stream.Store(on)
+}
+
+// Stream reports whether datagrams are sent over TCP.
+func (r *RayUDP) Stream() bool {
+	return r.stream.Load()
+}
+
+// StreamSupported reports whether the peer has told that it supports
+// streaming datagrams over TCP.
+func (r *RayUDP) StreamSupported() bool {
+	select {
+	case <-r.hello:
+		return true
+	default:
+		return false
 	}
-	if r.preconnected {
-		return r.udp.Write(p)
+}
+
+// ProbeUDP sends a probe over UDP every interval until one is echoed, and
+// reports false if ctx is done or r is closed before that.
+func (r *RayUDP) ProbeUDP(ctx context.Context, interval time.Duration) bool {
+	select {
+	case <-r.pong:
+	default:
 	}
-	r.mux.Lock()
-	defer r.mux.Unlock()
-	return r.udp.WriteTo(p, r.raddr)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.writeUDP(nil)
+		select {
+		case <-r.pong:
+			return true
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		case <-r.closed.Chan():
+			return false
+		}
+	}
+}
+
+// Done is closed once r is closed.
+func (r *RayUDP) Done() <-chan struct{} {
+	return r.closed.Chan()
 }
 
 func (r *RayUDP) LocalAddr() net.Addr { // FIXME Improper! In this way the network would be "udp"
@@ -294,6 +617,7 @@ func (r *RayUDP) RemoteAddr() net.Addr {
 }
 
 func (r *RayUDP) Close() error {
+	r.closed.Set(net.ErrClosed)
 	e1 := r.tcp.Close()
 	e2 := r.udp.Close()
 	return errors.Join(e1, e2)
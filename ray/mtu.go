@@ -0,0 +1,249 @@
+package ray
+
+// # Path MTU of RayUDP
+//
+// A datagram over UDP takes 2 bytes of SZ, padding to the AES block size
+// and 32 bytes of SUM more, so the payload MTU of a path MTU is less. See
+// [PayloadMTU]. Datagrams over it are fragmented if both sides agree,
+// otherwise rejected. A fragment is a Ray packet of:
+//
+//	+----+-------+-------+-------  ...  -------+
+//	| ID | INDEX | COUNT |         DATA         |
+//	+----+-------+-------+-------  ...  -------+
+//	  4      1       1             VAR
+//
+// whose SUM is of "ray fragment" followed by what's summed normally, so
+// that it can't be taken as a datagram. Fragments of ID not completed in
+// [fragmentTimeout] are dropped.
+//
+// The dialing side tells its path MTU and whether to fragment in HELLO,
+// whose BODY is FLAGS (1) and MTU (2). The other side replies HELLO with
+// FLAGS only, and takes MTU as its path MTU too.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultMTU is the path MTU taken if it's neither set nor discovered.
+const DefaultMTU = 1500
+
+// MinMTU is the minimum path MTU, of IPv4.
+const MinMTU = 576
+
+const (
+	helloReassemble byte = 1 << iota // Fragments can be reassembled
+	helloFragment                    // Peer should fragment instead of rejecting
+)
+
+const fragHeaderSize = 6
+
+// maxPartials is the max datagrams being reassembled of a RayUDP.
+const maxPartials = 64
+
+const fragmentTimeout = 5 * time.Second
+
+var fragmentDomain = []byte("ray fragment")
+
+// DatagramTooLargeError is returned by [RayUDP.Write] for datagrams over the
+// payload MTU which are not fragmented.
+type DatagramTooLargeError struct {
+	Size    int
+	MTU     int // Payload MTU
+	PathMTU int
+}
+
+func (e *DatagramTooLargeError) Error() string {
+	return fmt.Sprintf("datagram of %d bytes exceeds payload MTU %d", e.Size, e.MTU)
+}
+
+// PayloadMTU returns the max datagram size over UDP of path MTU mtu, for
+// IPv6 if v6.
+func PayloadMTU(mtu int, v6 bool) int {
+	ipOverhead := 20 + 8
+	if v6 {
+		ipOverhead = 40 + 8
+	}
+	n := (mtu-ipOverhead-sha512.Size256)/aes.BlockSize*aes.BlockSize - 2
+	return min(n, MaxPlaintextSize)
+}
+
+// SetMTU sets the path MTU, discovered or [DefaultMTU] if 0, and whether
+// datagrams over the payload MTU are fragmented or rejected. The other side
+// follows, if it's the dialing side.
+func (r *RayUDP) SetMTU(mtu int, fragment bool) {
+	if mtu <= 0 {
+		mtu = discoverMTU(r.udp)
+	}
+	r.mtu.Store(int32(mtu))
+	r.fragment.Store(fragment)
+	if r.preconnected {
+		r.sendHello()
+	}
+}
+
+// PathMTU returns the path MTU of r.
+func (r *RayUDP) PathMTU() int {
+	if mtu := int(r.mtu.Load()); mtu > 0 {
+		return mtu
+	}
+	return DefaultMTU
+}
+
+// PayloadMTU returns the max datagram size over UDP without fragmenting.
+func (r *RayUDP) PayloadMTU() int {
+	addr, _ := r.udp.LocalAddr().(*net.UDPAddr)
+	return PayloadMTU(r.PathMTU(), addr != nil && addr.IP.To4() == nil)
+}
+
+func (r *RayUDP) sendHello() {
+	flags := helloReassemble
+	if r.fragment.Load() {
+		flags |= helloFragment
+	}
+	body := binary.BigEndian.AppendUint16([]byte{flags}, uint16(min(r.PathMTU(), 0xFFFF)))
+	r.writeStream(streamHello, body)
+}
+
+// handleHello handles HELLO with body from the peer.
+func (r *RayUDP) handleHello(body []byte) {
+	var flags byte
+	if len(body) > 0 {
+		flags = body[0]
+	}
+	r.peerFrag.Store(flags&helloReassemble != 0)
+	if r.preconnected {
+		r.helloOnce.Do(func() { close(r.hello) })
+		return
+	}
+	r.fragment.Store(flags&helloFragment != 0)
+	if len(body) >= 3 {
+		if mtu := int(binary.BigEndian.Uint16(body[1:])); mtu >= MinMTU {
+			r.mtu.Store(int32(mtu))
+		}
+	}
+	r.writeStream(streamHello, []byte{helloReassemble})
+}
+
+// writeOversize fragments b or rejects it, as it's over mtu.
+func (r *RayUDP) writeOversize(b []byte, mtu int) (int, error) {
+	size := mtu - fragHeaderSize
+	count := (len(b) + size - 1) / size
+	fragment := r.fragment.Load() && r.peerFrag.Load() && count <= 0xFF
+	if r.OnOversize != nil {
+		r.OnOversize(len(b), fragment)
+	}
+	if !fragment {
+		return 0, &DatagramTooLargeError{Size: len(b), MTU: mtu, PathMTU: r.PathMTU()}
+	}
+
+	id := r.fragID.Add(1)
+	for i := 0; i < count; i++ {
+		data := b[i*size : min((i+1)*size, len(b))]
+		p := make([]byte, fragHeaderSize, fragHeaderSize+len(data))
+		binary.BigEndian.PutUint32(p, id)
+		p[4], p[5] = byte(i), byte(count)
+		if err := r.sendUDP(r.ray.encapFragment(append(p, data...))); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// partial is a datagram being reassembled.
+type partial struct {
+	parts [][]byte
+	left  int
+	since time.Time
+}
+
+// reassemble adds fragment p, and returns the datagram once completed.
+// Called by readUDP only.
+func (r *RayUDP) reassemble(p []byte) []byte {
+	if len(p) < fragHeaderSize {
+		return nil
+	}
+	id, i, count := binary.BigEndian.Uint32(p), int(p[4]), int(p[5])
+	if i >= count {
+		return nil
+	}
+	pt := r.partials[id]
+	if pt == nil || len(pt.parts) != count {
+		r.expirePartials()
+		pt = &partial{parts: make([][]byte, count), left: count, since: time.Now()}
+		r.partials[id] = pt
+	}
+	if pt.parts[i] == nil {
+		pt.parts[i] = p[fragHeaderSize:]
+		pt.left--
+	}
+	if pt.left > 0 {
+		return nil
+	}
+	delete(r.partials, id)
+	return bytes.Join(pt.parts, nil)
+}
+
+// expirePartials drops timed out partials, and the oldest one if there
+// are still maxPartials.
+func (r *RayUDP) expirePartials() {
+	var oldest uint32
+	var since time.Time
+	for id, pt := range r.partials {
+		if time.Since(pt.since) > fragmentTimeout {
+			delete(r.partials, id)
+		} else if since.IsZero() || pt.since.Before(since) {
+			oldest, since = id, pt.since
+		}
+	}
+	if len(r.partials) >= maxPartials {
+		delete(r.partials, oldest)
+	}
+}
+
+// encapFragment is like EncapPacket, but for fragments.
+func (r *Ray) encapFragment(p []byte) []byte {
+	nBlock := calcNBlock(len(p))
+	result := make([]byte, nBlock*aes.BlockSize+sha512.Size256)
+	binary.BigEndian.PutUint16(result[:2], uint16(len(p)))
+	copy(result[2:], p)
+	sum := fragmentSum(result[:nBlock*aes.BlockSize])
+	copy(result[nBlock*aes.BlockSize:], sum)
+	r.encryptPacket(result, 0)
+	return result
+}
+
+// decapUDP is like DecapPacket, but accepts fragments too.
+func (r *Ray) decapUDP(p []byte) (content []byte, fragment bool, err error) {
+	if len(p) > 65584 {
+		return nil, false, PacketTooLargeError(len(p))
+	}
+	if len(p)%aes.BlockSize != 0 {
+		return nil, false, IncorrectPacketSizeError(len(p))
+	}
+	result, err := r.decrypt(p)
+	if err != nil {
+		return nil, false, err
+	}
+	sz := int(binary.BigEndian.Uint16(result[:2]))
+	switch {
+	case validateSum(result):
+	case bytes.Equal(fragmentSum(result[:len(result)-sha512.Size256]), result[len(result)-sha512.Size256:]):
+		fragment = true
+	default:
+		return nil, false, ErrIntegrityCompromised
+	}
+	return result[2 : 2+sz], fragment, nil
+}
+
+func fragmentSum(blocks []byte) []byte {
+	h := sha512.New512_256()
+	h.Write(fragmentDomain)
+	h.Write(blocks)
+	return h.Sum(nil)
+}
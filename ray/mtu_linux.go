@@ -0,0 +1,28 @@
+package ray
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// discoverMTU returns the path MTU known by the kernel of connected u, 0 if
+// unknown.
+func discoverMTU(u *net.UDPConn) int {
+	raw, err := u.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	level, opt := unix.IPPROTO_IP, unix.IP_MTU
+	if addr, ok := u.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_MTU
+	}
+	var mtu int
+	raw.Control(func(fd uintptr) {
+		mtu, err = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		return 0
+	}
+	return mtu
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package ray
+
+import "net"
+
+// discoverMTU returns 0, as discovering is only supported on Linux.
+func discoverMTU(u *net.UDPConn) int {
+	return 0
+}
@@ -1,20 +1,48 @@
 package ray
 
 import (
+	"context"
 	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha512"
 	"io"
+	"net"
 	"reflect"
 )
 
-// Can be called simultaneously.
-func Negotiate(rw io.ReadWriter, usr []byte, pwd []byte) (*Ray, error) {
+// Key is derived from a pair of username and password, it's all that
+// negotiation needs to know about the credentials.
+type Key [32]byte
+
+func NewKey(usr, pwd []byte) Key {
 	usum := sha512.Sum512_256(usr)
 	psum := sha512.Sum512_256(pwd)
-	mask := make([]byte, 32)
-	copy(mask, usum[:16])
-	copy(mask[16:], psum[:16])
+	var key Key
+	copy(key[:], usum[:16])
+	copy(key[16:], psum[:16])
+	return key
+}
+
+// Can be called simultaneously.
+func Negotiate(rw io.ReadWriter, usr []byte, pwd []byte) (*Ray, error) {
+	return NegotiateKey(rw, NewKey(usr, pwd))
+}
+
+// NegotiateContext is like NegotiateKey, but conn is closed and ctx.Err() is
+// returned if ctx is done before negotiation finishes.
+func NegotiateContext(ctx context.Context, conn net.Conn, key Key) (*Ray, error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	ray, err := NegotiateKey(conn, key)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	return ray, err
+}
+
+// Can be called simultaneously.
+func NegotiateKey(rw io.ReadWriter, key Key) (*Ray, error) {
+	mask := key[:]
 
 	wkey := make([]byte, 32)
 	if _, err := rand.Read(wkey); err != nil {
@@ -73,3 +101,72 @@ func Negotiate(rw io.ReadWriter, usr []byte, pwd []byte) (*Ray, error) {
 		rw:     rw,
 	}, nil
 }
+
+// NegotiateAny negotiates with a peer calling [NegotiateKey] with any one of
+// keys, and returns the index of the key the peer used.
+//
+// Instead of a key masked random key, a plain random message is sent first.
+// Unmasked with each one of keys, it yields a different random write key for
+// each candidate, the one the peer used is identified by its verification
+// message, which is then replied under the write key of that candidate.
+//
+// Can be called simultaneously.
+func NegotiateAny(rw io.ReadWriter, keys []Key) (*Ray, int, error) {
+	msg := make([]byte, 32)
+	if _, err := rand.Read(msg); err != nil {
+		panic(err)
+	}
+	if _, err := rw.Write(msg); err != nil {
+		return nil, -1, err
+	}
+
+	peerMsg := make([]byte, 32)
+	if _, err := io.ReadFull(rw, peerMsg); err != nil {
+		return nil, -1, err
+	}
+	verify := make([]byte, 32)
+	if _, err := io.ReadFull(rw, verify); err != nil {
+		return nil, -1, err
+	}
+
+	key := make([]byte, 32)
+	plain := make([]byte, 32)
+	for i := range keys {
+		mask := keys[i][:]
+		for j := range key {
+			key[j] = mask[j] ^ peerMsg[j]
+		}
+		rblock, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, -1, err
+		}
+		rblock.Decrypt(plain, verify)
+		rblock.Decrypt(plain[aes.BlockSize:], verify[aes.BlockSize:])
+		if !reflect.DeepEqual(plain, mask) {
+			continue
+		}
+
+		for j := range key {
+			key[j] = mask[j] ^ msg[j]
+		}
+		var wblock cipher.Block
+		wblock, err = aes.NewCipher(key)
+		if err != nil {
+			return nil, -1, err
+		}
+		copy(plain, mask)
+		wblock.Encrypt(plain, plain)
+		wblock.Encrypt(plain[aes.BlockSize:], plain[aes.BlockSize:])
+		if _, err := rw.Write(plain); err != nil {
+			return nil, -1, err
+		}
+
+		return &Ray{
+			rblock: rblock,
+			wblock: wblock,
+			rw:     rw,
+		}, i, nil
+	}
+
+	return nil, -1, ErrAuthFailed
+}
@@ -247,6 +247,20 @@ func (r *Ray) DecapPacket(p []byte) ([]byte, error) {
 		return nil, IncorrectPacketSizeError(len(p))
 	}
 
+	result, err := r.decrypt(p)
+	if err != nil {
+		return nil, err
+	}
+	if !validateSum(result) {
+		return nil, ErrIntegrityCompromised
+	}
+
+	sz := int(binary.BigEndian.Uint16(result[:2]))
+	return result[2 : 2+sz], nil
+}
+
+// decrypt returns the plaintext of packet p, whose sum is not validated.
+func (r *Ray) decrypt(p []byte) ([]byte, error) {
 	result := make([]byte, len(p))
 	copy(result, p)
 
@@ -260,12 +274,7 @@ func (r *Ray) DecapPacket(p []byte) ([]byte, error) {
 	}
 
 	r.decryptPacket(result, 1)
-
-	if !validateSum(result) {
-		return nil, ErrIntegrityCompromised
-	}
-
-	return result[2 : 2+sz], nil
+	return result, nil
 }
 
 func (r *Ray) decryptPacket(p []byte, begin int) {
@@ -1,12 +1,17 @@
 package ray
 
 import (
+	"context"
 	"crypto/aes"
 	"errors"
 	"io"
+	"net"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func FuzzRayCap(f *testing.F) {
@@ -129,3 +134,202 @@ func FuzzRayRW(f *testing.F) {
     }
   })
 }
+
+func TestNegotiateAny(t *testing.T) {
+	keys := []Key{
+		NewKey([]byte("alice"), []byte("pwd a")),
+		NewKey([]byte("bob"), []byte("pwd b")),
+		NewKey([]byte("carol"), []byte("pwd c")),
+	}
+
+	for want := range keys {
+		rwA, rwB := ChanPipe()
+		var rayA, rayB *Ray
+		var errA, errB error
+		got := -1
+		wg := sync.WaitGroup{}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rayA, errA = NegotiateKey(rwA, keys[want])
+		}()
+		go func() {
+			defer wg.Done()
+			rayB, got, errB = NegotiateAny(rwB, keys)
+		}()
+		wg.Wait()
+		if errA != nil || errB != nil {
+			t.Fatalf("error negotiating\nerror A: %s\nerror B: %s\n", errA, errB)
+		}
+		if got != want {
+			t.Fatalf("want key %d, got %d", want, got)
+		}
+
+		data := []byte("hello")
+		if _, err := rayA.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(rayB, buf); err != nil || !reflect.DeepEqual(buf, data) {
+			t.Fatalf("want %q, got %q, %v", data, buf, err)
+		}
+	}
+
+	rwA, rwB := ChanPipe()
+	go NegotiateKey(rwA, NewKey([]byte("mallory"), nil))
+	if _, _, err := NegotiateAny(rwB, keys); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("want %v, got %v", ErrAuthFailed, err)
+	}
+}
+
+func TestNegotiateContext(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	// Drain what a writes, but never reply.
+	go io.Copy(io.Discard, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := NegotiateContext(ctx, a, NewKey([]byte("alice"), nil))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("negotiation aborted after %s", d)
+	}
+	if _, err := a.Write([]byte{0}); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("want conn closed, got %v", err)
+	}
+}
+
+// pairRayUDP returns a UDP data link dialed and its other side.
+func pairRayUDP(t *testing.T) (cli, srv *RayUDP) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	key := NewKey([]byte("alice"), []byte("secret"))
+
+	srvCh := make(chan *RayUDP, 1)
+	go func() {
+		tcp, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		laddr, _ := net.ResolveUDPAddr("udp", tcp.LocalAddr().String())
+		udp, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		r, err := NegotiateKey(tcp, key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		srvCh <- NewRayUDP(udp, false, tcp, r)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli, err = DialUDPContext(ctx, "udp", ln.Addr().String(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	srv = <-srvCh
+	t.Cleanup(func() { srv.Close() })
+	return cli, srv
+}
+
+// exchange writes msgs to from, and checks them read from to.
+func exchange(t *testing.T, from, to *RayUDP, msgs ...string) {
+	t.Helper()
+	for _, m := range msgs {
+		if _, err := from.Write([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 65535)
+	for _, m := range msgs {
+		n, err := to.Read(buf)
+		if err != nil || string(buf[:n]) != m {
+			t.Fatalf("want %d bytes, got %d, %v", len(m), n, err)
+		}
+	}
+}
+
+func TestRayUDPStream(t *testing.T) {
+	cli, srv := pairRayUDP(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if !cli.ProbeUDP(ctx, 100*time.Millisecond) {
+		t.Fatal("UDP probe not echoed")
+	}
+	exchange(t, cli, srv, "a")
+	exchange(t, srv, cli, "b")
+	// HELLO is replied over TCP, maybe after the datagrams.
+	for i := 0; !cli.StreamSupported(); i++ {
+		if i == 100 {
+			t.Fatal("streaming not supported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cli.SetStream(true)
+	exchange(t, cli, srv, "c", "dd", "eee")
+	if !srv.Stream() {
+		t.Fatal("server not following client to stream")
+	}
+	exchange(t, srv, cli, "f", "gg")
+
+	cli.SetStream(false)
+	exchange(t, cli, srv, "h")
+	if srv.Stream() {
+		t.Fatal("server not following client back to UDP")
+	}
+}
+
+func TestRayUDPMTU(t *testing.T) {
+	if n := PayloadMTU(1500, false); n != 1438 {
+		t.Fatalf("want payload MTU 1438, got %d", n)
+	}
+	cli, srv := pairRayUDP(t)
+	var fragmented, rejected atomic.Int32
+	cli.OnOversize = func(size int, ok bool) {
+		if ok {
+			fragmented.Add(1)
+		} else {
+			rejected.Add(1)
+		}
+	}
+
+	// Wait for the server to take the path MTU and reply HELLO.
+	cli.SetMTU(MinMTU, true)
+	for i := 0; srv.PathMTU() != MinMTU || !cli.StreamSupported(); i++ {
+		if i == 100 {
+			t.Fatalf("server path MTU %d, want %d", srv.PathMTU(), MinMTU)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	big := strings.Repeat("x", 3000)
+	exchange(t, cli, srv, "a", big, "b")
+	exchange(t, srv, cli, big)
+	if fragmented.Load() != 1 || rejected.Load() != 0 {
+		t.Fatalf("want 1 fragmented, got %d, and %d rejected", fragmented.Load(), rejected.Load())
+	}
+
+	cli.SetMTU(MinMTU, false)
+	var tooLarge *DatagramTooLargeError
+	if _, err := cli.Write([]byte(big)); !errors.As(err, &tooLarge) || tooLarge.MTU != cli.PayloadMTU() {
+		t.Fatalf("want datagram too large, got %v", err)
+	}
+	if rejected.Load() != 1 {
+		t.Fatalf("want 1 rejected, got %d", rejected.Load())
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fishBone000/xcat/log"
+)
+
+// reload loads the configuration again and passes the new settings to apply,
+// which puts them in effect.
+// The current settings stay in effect if anything failed.
+func reload(apply func(s *settings) error) error {
+	c, err := loadConfig()
+	if err != nil {
+		b := new(strings.Builder)
+		printConfigErrors(b, ConfigFile, err)
+		return fmt.Errorf("invalid configuration:\n%s", strings.TrimSpace(b.String()))
+	}
+	old := cur.Load()
+	if c.Mode != old.Mode {
+		return errors.New("mode cannot be changed by reload")
+	}
+	if c.Metrics != old.Metrics {
+		log.Warn("Metrics endpoint cannot be changed by reload, restart to apply. ")
+		c.Metrics = old.Metrics
+	}
+	if c.Admin.Listen != old.Admin.Listen {
+		log.Warn("Admin endpoint cannot be changed by reload, restart to apply. ")
+		c.Admin.Listen = old.Admin.Listen
+	}
+	if c.Stat != old.Stat {
+		log.Warn("Statistic file cannot be changed by reload, restart to apply. ")
+		c.Stat = old.Stat
+	}
+
+	if err := apply(newSettings(c)); err != nil {
+		return err
+	}
+	if err := setupLog(c.Log); err != nil {
+		log.Errf("Failed to open log file, keeping the current log output: %v. ", err)
+	}
+	return nil
+}
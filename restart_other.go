@@ -0,0 +1,32 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/fishBone000/xcat/util"
+)
+
+// Handing off listeners, reloading and toggling debug logging on signals are
+// not supported on this platform.
+var (
+	restartSignals []os.Signal
+	reloadSignals  []os.Signal
+	debugSignals   []os.Signal
+)
+
+func handOff(listeners map[string]*util.MultiListenerTCP) error {
+	return errors.ErrUnsupported
+}
+
+func inheritedListeners() (map[string]*util.MultiListenerTCP, error) {
+	return nil, nil
+}
+
+func notifyReady() {}
+
+func inheritCredentials() error {
+	return nil
+}
@@ -0,0 +1,282 @@
+//go:build unix
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fishBone000/xcat/config"
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/util"
+)
+
+// restartSignals make the server hand off its listener to a new process.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// reloadSignals make us reload the configuration.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// debugSignals toggle debug logging of all subsystems.
+var debugSignals = []os.Signal{syscall.SIGUSR1}
+
+// Environment variables telling the new process about inherited files.
+const (
+	envListenFDs    = "XCAT_LISTEN_FDS"
+	envReadyFD      = "XCAT_READY_FD"
+	envCredentialFD = "XCAT_CREDENTIAL_FD"
+)
+
+// listenFDs is an entry of envListenFDs, a JSON list, N sockets of the
+// listener on Addr follow those of the previous entry.
+type listenFDs struct {
+	Addr string `json:"addr"`
+	N    int    `json:"n"`
+}
+
+// handOffTimeout is how long to wait for the new process to become ready.
+const handOffTimeout = 10 * time.Second
+
+// handOff starts a new process of the current executable with the same
+// arguments, passing the sockets of listeners to it.
+// It returns once the new process is accepting on them.
+func handOff(listeners map[string]*util.MultiListenerTCP) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var fds []listenFDs
+	for addr, l := range listeners {
+		fs, err := l.Files()
+		if err != nil {
+			return fmt.Errorf("get files of listener %s: %w", addr, err)
+		}
+		files = append(files, fs...)
+		fds = append(fds, listenFDs{addr, len(fs)})
+	}
+	fdsJSON, err := json.Marshal(fds)
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Extra files start from fd 3.
+	cmd.ExtraFiles = append(files, w)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, envListenFDs+"=") && !strings.HasPrefix(env, envReadyFD+"=") &&
+			!strings.HasPrefix(env, envCredentialFD+"=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		envListenFDs+"="+string(fdsJSON),
+		envReadyFD+"="+strconv.Itoa(3+len(files)),
+	)
+	// Credentials taken from the environment on start up, through a pipe so
+	// that they don't show in the environment of the new process.
+	cred, err := credentialPipe()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if cred != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, cred)
+		cmd.Env = append(cmd.Env, envCredentialFD+"="+strconv.Itoa(3+len(files)+1))
+	}
+
+	err = cmd.Start()
+	w.Close()
+	if cred != nil {
+		cred.Close()
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Started new process %d, waiting for it to be ready. ", cmd.Process.Pid)
+
+	if err := r.SetReadDeadline(time.Now().Add(handOffTimeout)); err != nil {
+		log.Warnf("Failed to set deadline for ready pipe: %v. ", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("new process not ready in %s", handOffTimeout)
+		}
+		return fmt.Errorf("new process exited before ready: %w", err)
+	}
+
+	// The new process outlives us.
+	return cmd.Process.Release()
+}
+
+// Tags of credentials sent through the credential pipe, each followed by
+// LEN(4) and the value.
+const (
+	credUsername = 'U'
+	credPassword = 'P'
+)
+
+// credentialPipe returns the read end of a pipe filled with envUsr and envPwd,
+// or nil if there are none.
+func credentialPipe() (*os.File, error) {
+	var b []byte
+	put := func(tag byte, v []byte) {
+		b = append(b, tag)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+		b = append(b, v...)
+	}
+	if envUsr != nil {
+		put(credUsername, []byte(*envUsr))
+	}
+	if envPwd != nil {
+		put(credPassword, envPwd)
+	}
+	if b == nil {
+		return nil, nil
+	}
+	defer clear(b)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	// Way smaller than the pipe buffer, so it doesn't block.
+	_, err = w.Write(b)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("write credentials: %w", err)
+	}
+	return r, nil
+}
+
+// inheritCredentials reads credentials handed by the parent process into
+// envUsr and envPwd, if any.
+func inheritCredentials() error {
+	s := os.Getenv(envCredentialFD)
+	if s == "" {
+		return nil
+	}
+	os.Unsetenv(envCredentialFD)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", envCredentialFD, s)
+	}
+	f := os.NewFile(uintptr(fd), "credential pipe")
+	b, err := io.ReadAll(f)
+	f.Close()
+	defer clear(b)
+	if err != nil {
+		return err
+	}
+	for len(b) > 0 {
+		if len(b) < 5 || len(b)-5 < int(binary.BigEndian.Uint32(b[1:])) {
+			return errors.New("truncated credentials")
+		}
+		v := b[5 : 5+binary.BigEndian.Uint32(b[1:])]
+		switch b[0] {
+		case credUsername:
+			u := string(v)
+			envUsr = &u
+		case credPassword:
+			envPwd = append(config.Secret{}, v...)
+		}
+		b = b[5+len(v):]
+	}
+	return nil
+}
+
+// inheritedListeners returns the listeners handed off by the parent process
+// by listening address, or nil if there's none.
+func inheritedListeners() (map[string]*util.MultiListenerTCP, error) {
+	s := os.Getenv(envListenFDs)
+	if s == "" {
+		return nil, nil
+	}
+	os.Unsetenv(envListenFDs)
+
+	var fds []listenFDs
+	if err := json.Unmarshal([]byte(s), &fds); err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %w", envListenFDs, s, err)
+	}
+	listeners := make(map[string]*util.MultiListenerTCP)
+	fd := 3
+	for _, entry := range fds {
+		addr, n := entry.Addr, entry.N
+		var err error
+		if n <= 0 {
+			err = fmt.Errorf("invalid %s %q", envListenFDs, s)
+		}
+		files := make([]*os.File, max(n, 0))
+		for i := range files {
+			files[i] = os.NewFile(uintptr(fd), "inherited listener "+strconv.Itoa(fd))
+			fd++
+		}
+		var l *util.MultiListenerTCP
+		if err == nil {
+			l, err = util.FileMultiListenerTCP(files, addr)
+		}
+		for _, f := range files {
+			f.Close()
+		}
+		if err != nil {
+			for _, l := range listeners {
+				util.CloseCloser(l)
+			}
+			return nil, err
+		}
+		listeners[addr] = l
+	}
+	return listeners, nil
+}
+
+// notifyReady tells the parent process that we are accepting on the
+// inherited listener, if there's a parent waiting.
+func notifyReady() {
+	s := os.Getenv(envReadyFD)
+	if s == "" {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		log.Warnf("Invalid %s %q. ", envReadyFD, s)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready pipe")
+	if _, err := f.Write([]byte{0x00}); err != nil {
+		log.Warnf("Failed to notify parent process: %v. ", err)
+	}
+	f.Close()
+}
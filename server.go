@@ -1,249 +1,321 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/fishBone000/xcat/acl"
+	"github.com/fishBone000/xcat/config"
 	"github.com/fishBone000/xcat/log"
-	"github.com/fishBone000/xcat/ray"
+	"github.com/fishBone000/xcat/ratelimit"
+	"github.com/fishBone000/xcat/tunnel"
 	"github.com/fishBone000/xcat/util"
 )
 
-func runServer() {
+func runServer() int {
 	log.Info("Server startup! ")
 	log.Infof("Version: %s", version)
+	if err := openStat(cur.Load(), "server"); err != nil {
+		log.Errf("Failed to open statistic file, exitting: %v", err)
+		return 1
+	}
+	defer closeStat()
 
-	l, err := util.ListenMultipleTCP("tcp", LAddr)
+	inherited, err := inheritedListeners()
 	if err != nil {
-		log.Errf("Failed to listen control link, exitting: %w", err)
-		os.Exit(1)
+		log.Errf("Failed to use inherited listeners, exitting: %v", err)
+		return 1
 	}
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Errf("Failed to accept control link, exitting: %w", err)
-			os.Exit(1)
+	fatal := util.Fatal{}
+	srv := tunnel.NewServer(serverOptions(cur.Load()))
+	ls := &ctrlListeners{srv: srv, fatal: &fatal}
+	err = ls.update(cur.Load(), inherited)
+	var ml *util.MultiListenerTCP
+	var admin *adminEndpoint
+	var mErr, aErr error
+	if err == nil {
+		ml, mErr = serveMetrics(cur.Load(), inherited)
+	}
+	if err == nil && mErr == nil {
+		admin, aErr = serveAdmin(cur.Load(), srv, inherited)
+	}
+	for addr, l := range inherited {
+		log.Infof("Closing inherited listener %s not in use. ", addr)
+		util.CloseCloser(l)
+	}
+	if err != nil {
+		log.Errf("Failed to listen control link, exitting: %v", err)
+		return 1
+	}
+	if mErr != nil {
+		util.CloseCloser(ls)
+		log.Errf("Failed to listen metrics endpoint, exitting: %v", mErr)
+		return 1
+	}
+	if aErr != nil {
+		util.CloseCloser(ls)
+		if ml != nil {
+			util.CloseCloser(ml)
 		}
-
-		go serveControlLink(conn)
+		log.Errf("Failed to listen admin endpoint, exitting: %v", aErr)
+		return 1
 	}
-}
 
-func serveControlLink(conn net.Conn) {
-	log.Info("New control link " + util.ConnStr(conn))
+	notifyReady()
 
-	rconn, err := ray.FromConn(conn, []byte(Usr), []byte(Pwd))
-	if err != nil {
-		log.Warnf("Ray negotiation on control link %s failed: %w", util.ConnStr(conn), err)
-		util.CloseCloser(conn)
-		return
-	}
-
-	buf := make([]byte, 16)
-	for {
-		n, err := rconn.Read(buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				log.Debugf("Finished serving control link %s: EOF", util.ConnStr(rconn))
-			} else {
-				log.Errf(
-					"Error reading request on control link %s, closing: %w. ",
-					util.ConnStr(rconn), err,
-				)
+	closers := []io.Closer{srv, ls}
+	if ml != nil {
+		closers = append(closers, ml)
+	}
+	if admin != nil {
+		closers = append(closers, admin)
+	}
+	return waitStop(
+		&fatal,
+		func() error {
+			listeners := ls.listeners()
+			if ml != nil {
+				listeners[cur.Load().Metrics.Listen] = ml
 			}
-			util.CloseCloser(rconn)
-			return
-		}
-
-		for i := 0; i < n; i++ {
-			log.Debugf("New port allocating request from %s type 0x%02X", conn.RemoteAddr(), buf[i])
-			l, err := util.ListenMultipleTCP("tcp", net.JoinHostPort(LHost, "0"))
-			if err != nil {
-				log.Errf("Allocate port for new data link failed: %w. ", err)
-				util.CloseCloser(rconn)
-				return
+			if admin != nil {
+				undo := admin.prepareHandOff(listeners)
+				if err := handOff(listeners); err != nil {
+					undo()
+					return err
+				}
+				return nil
 			}
+			return handOff(listeners)
+		},
+		func() error { return reload(func(s *settings) error { return ls.update(s, nil) }) },
+		closers...,
+	)
+}
 
-			port, err := util.ParsePortFromAddr(l.Addr())
-			if err != nil {
-				panic(fmt.Errorf("IMPOSSIBLE! Failed to parse port from listener address %s: %w", l.Addr(), err))
-			}
+// forwardKey is the context key of the listening address of the forward
+// being served.
+type forwardKey struct{}
 
-			portBuf := make([]byte, 2)
-			binary.BigEndian.PutUint16(portBuf, uint16(port))
-			if _, err := rconn.Write(portBuf); err != nil {
-				log.Err("Failed to reply allocated port on control link " + util.ConnStr(rconn) + ". ")
-				util.CloseCloser(rconn)
-				return
-			}
+// requestForward returns the forward of s that r is made on, nil if removed.
+func requestForward(s *settings, r *tunnel.Request) *config.Forward {
+	listen, _ := r.Context.Value(forwardKey{}).(string)
+	return s.forward(listen)
+}
 
-			log.Debugf("Port %d allocated on control link %s, start serving. ", port, util.ConnStr(rconn))
-			if buf[i] == 0x00 {
-				go serveDataLinkTCP(l)
-			} else {
-				go serveDataLinkUDP(l)
+// serverOptions returns options of the tunnel server following s.
+func serverOptions(s *settings) *tunnel.ServerOptions {
+	opts := &tunnel.ServerOptions{
+		Authorize: func(r *tunnel.Request) (string, error) {
+			fwd := requestForward(s, r)
+			usr := s.FindUser(config.Username(r.User))
+			if fwd == nil || usr == nil {
+				return "", errors.New("forward or user removed")
 			}
-		}
+			return resolveTarget(r.Context, s, fwd, usr, r.Network)
+		},
+		Dial: func(ctx context.Context, r *tunnel.Request, target string) (net.Conn, error) {
+			if r.Network == "tcp" {
+				if cmd := execCmd(requestForward(s, r), s.FindUser(config.Username(r.User))); cmd != "" {
+					return startExecOutbound(cmd, r)
+				}
+			}
+			return tunnel.DialTarget(ctx, r.Network, target)
+		},
+		Accept: func(remote net.Addr) bool {
+			return acceptSrc(s, remote, "control link")
+		},
+		Limiters: func(r *tunnel.Request) (up, down ratelimit.Limiters) {
+			return s.relayLimiters(requestForward(s, r), config.Username(r.User))
+		},
+		DataLinkTimeout:     time.Duration(s.Timeouts.DataLinkListen),
+		MaxCtrlLinksPerUser: s.Limits.MaxCtrlLinksPerUser,
+		MaxCtrlLinksPerIP:   s.Limits.MaxCtrlLinksPerIP,
+		MaxPending:          s.Limits.MaxPending,
+		MaxRelays:           s.Limits.MaxRelays,
+		Relays:              &active,
+		Stat:                sf,
+	}
+	for i, u := range s.Users {
+		opts.Users = append(opts.Users, tunnel.User{Name: string(u.Name), Key: s.keys[i]})
 	}
+	return opts
 }
 
-func serveDataLinkTCP(l *util.MultiListenerTCP) {
-	dialed := make(chan struct{})
-	var outbound net.Conn
-	var dialErr error
-	go func() {
-		outbound, dialErr = net.Dial("tcp", net.JoinHostPort(Host, strconv.Itoa(Port)))
-		close(dialed)
-	}()
+// ctrlListeners are listeners of control links by listening address,
+// following forwards of the current settings.
+type ctrlListeners struct {
+	srv   *tunnel.Server
+	mux   sync.Mutex
+	m     map[string]*ctrlListener
+	fatal *util.Fatal // Set if accepting failed
+}
 
-	if DataLinkListenTimeout > 0 {
-		err := l.SetDeadline(time.Now().Add(time.Second * time.Duration(DataLinkListenTimeout)))
-		if err != nil {
-			log.Warnf("Failed to set deadline for listener %s: %w. ", l.Addr(), err)
+type ctrlListener struct {
+	*util.MultiListenerTCP
+	cancel context.CancelFunc // Stops serving the forward
+}
+
+// update listens for forwards of s not listened yet, using those in inherited
+// first, then puts s in effect and stops serving removed forwards.
+// Nothing is changed if failed.
+func (ls *ctrlListeners) update(s *settings, inherited map[string]*util.MultiListenerTCP) error {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+
+	added := make(map[string]*ctrlListener)
+	for i := range s.Forwards {
+		fwd := &s.Forwards[i]
+		if ls.m[fwd.Listen] != nil {
+			continue
 		}
-	}
-	c, err := l.Accept()
-	if err != nil {
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-			log.Warnf("Timed out listening for TCP data link at %s. ", l.Addr())
+		l := inherited[fwd.Listen]
+		delete(inherited, fwd.Listen)
+		if l != nil {
+			log.Infof("Serving control links of forward %s on inherited listener %s. ", fwd.Name, l.Addr())
 		} else {
-			log.Errf("Failed to accept TCP data link on %s: %w", l.Addr(), err)
+			var err error
+			l, err = util.ListenMultipleTCP("tcp", fwd.Listen)
+			if err != nil {
+				for _, l := range added {
+					util.CloseCloser(l)
+				}
+				return fmt.Errorf("forward %s: %w", fwd.Name, err)
+			}
+			log.Infof("Listening control links of forward %s on %s. ", fwd.Name, l.Addr())
 		}
-		util.CloseCloser(l)
-		return
+		added[fwd.Listen] = &ctrlListener{MultiListenerTCP: l}
 	}
-	util.CloseCloser(l)
 
-	rconn, err := ray.FromConn(c, []byte(Usr), []byte(Pwd))
-	if err != nil {
-		log.Errf("Ray negotiation on TCP data link %s failed: %w", l.Addr(), err)
-		return
-	}
-	log.Debugf("TCP data link established: %s. ", util.ConnStr(rconn))
-	defer util.CloseCloser(rconn)
+	cur.Store(s)
+	ls.srv.Reconfigure(serverOptions(s))
 
-	select {
-	case <-dialed:
+	if ls.m == nil {
+		ls.m = make(map[string]*ctrlListener)
 	}
-
-	if dialErr != nil {
-		log.Errf("Error dial outbound for TCP data link %s.\n%w", util.ConnStr(rconn), dialErr)
-		return
+	for addr, l := range ls.m {
+		if s.forward(addr) == nil {
+			log.Infof("Stopped listening control links on %s. ", addr)
+			l.cancel()
+			delete(ls.m, addr)
+		}
 	}
-
-	log.Debugf("Relaying for TCP data link %s started. ", util.ConnStr(rconn))
-	if err := util.Relay(rconn, outbound); err != nil {
-		log.Warnf("Error relaying TCP for inbound %s: \n%w", util.ConnStr(rconn), err)
-	} else {
-		log.Debugf("Relay TCP finished for inbound %s. ", util.ConnStr(rconn))
+	for addr, l := range added {
+		ctx := context.WithValue(context.Background(), forwardKey{}, addr)
+		ctx = tunnel.WithForward(ctx, s.forward(addr).Name)
+		ctx, l.cancel = context.WithCancel(ctx)
+		ls.m[addr] = l
+		go func(l *ctrlListener) {
+			if err := ls.srv.Serve(ctx, l); err != nil {
+				log.Errf("Failed to accept control link, exitting: %v", err)
+				ls.fatal.Set(err)
+			}
+		}(l)
 	}
+	return nil
 }
 
-func serveDataLinkUDP(l *util.MultiListenerTCP) {
-	if DataLinkListenTimeout > 0 {
-		err := l.SetDeadline(time.Now().Add(time.Second * time.Duration(DataLinkListenTimeout)))
-		if err != nil {
-			log.Warnf("Failed to set deadline for listener %s: %w. ", l.Addr(), err)
-		}
+// listeners returns the current listeners by listening address.
+func (ls *ctrlListeners) listeners() map[string]*util.MultiListenerTCP {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	m := make(map[string]*util.MultiListenerTCP)
+	for addr, l := range ls.m {
+		m[addr] = l.MultiListenerTCP
 	}
+	return m
+}
 
-	tcpIn, err := l.Accept()
-	if err != nil {
-		if errors.Is(err, os.ErrDeadlineExceeded) {
-			log.Warnf("Timed out listening for data link at %s. ", l.Addr())
-		} else {
-			log.Errf("Failed to accept data link on %s: %w", l.Addr(), err)
-		}
+func (ls *ctrlListeners) Close() error {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	for _, l := range ls.m {
 		util.CloseCloser(l)
-		return
 	}
-	util.CloseCloser(l)
+	return nil
+}
 
-	udpOut, err := net.Dial("udp", net.JoinHostPort(Host, strconv.Itoa(int(Port))))
+// startExecOutbound runs cmd in place of an outbound connection for the
+// data link request r.
+func startExecOutbound(cmd string, r *tunnel.Request) (*util.CmdConn, error) {
+	env := []string{
+		"XCAT_USER=" + r.User,
+		"XCAT_CLIENT_ADDR=" + r.Remote.String(),
+		"XCAT_LOCAL_ADDR=" + r.Local.String(),
+	}
+	cc, err := util.StartCmdConn(cmd, env, func(pid int, line string) {
+		log.Warnf("Command pid %d stderr: %s", pid, line)
+	})
 	if err != nil {
-		log.Errf("Failed to dial UDP outbound for UDP data link %s: %w. ", util.ConnStr(tcpIn), err)
-		util.CloseCloser(tcpIn)
-		return
+		return nil, fmt.Errorf("start command %q: %w", cmd, err)
 	}
+	log.Debugf("Started command %q (pid %d) for TCP data link of %s. ", cmd, cc.Pid(), r.Remote)
+	go func() {
+		<-cc.Done()
+		if err := cc.ExitErr(); err != nil {
+			log.Warnf("Command %q (pid %d) for TCP data link of %s exited: %v", cmd, cc.Pid(), r.Remote, err)
+		}
+	}()
+	return cc, nil
+}
 
-	laddr, _ := net.ResolveUDPAddr("udp", tcpIn.LocalAddr().String())
-	udpIn, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		log.Errf("Failed to dial UDP inbound for UDP data link %s: %w. ", util.ConnStr(tcpIn), err)
-		util.CloseCloser(tcpIn)
-		util.CloseCloser(udpOut)
-		return
+// resolveTimeout is how long resolving the target of a request may take.
+const resolveTimeout = 5 * time.Second
+
+// resolveTarget checks the outbound of a data link of usr on fwd against
+// the ACL, and returns the address to dial.
+func resolveTarget(ctx context.Context, s *settings, fwd *config.Forward, usr *config.User, proto string) (string, error) {
+	if proto == "tcp" && execCmd(fwd, usr) != "" {
+		return "", nil
+	}
+	if fwd.Target == "" {
+		return "", errors.New("no target for " + proto)
+	}
+	rules := s.ACLRules()
+	if rules == nil {
+		rules = acl.Builtin
+	}
+	if path, ok := util.SplitUnixAddr(fwd.Target); ok {
+		if proto != "tcp" {
+			return "", errors.New("cannot relay " + proto + " to unix domain socket")
+		}
+		dest := acl.Dest{Host: path, Proto: "unix"}
+		if d := rules.Check(string(usr.Name), dest); d.Action != acl.Allow {
+			return "", fmt.Errorf("%s %s", dest, d)
+		}
+		return fwd.Target, nil
 	}
 
-	r, err := ray.Negotiate(tcpIn, []byte(Usr), []byte(Pwd))
+	host, portStr, _ := net.SplitHostPort(fwd.Target)
+	port, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
-		log.Errf("Ray negotiation failed for UDP data link %s: %w. ", util.ConnStr(tcpIn), err)
-		util.CloseCloser(tcpIn)
-		util.CloseCloser(udpOut)
-		util.CloseCloser(udpIn)
-		return
+		return "", fmt.Errorf("invalid port of target %s", fwd.Target)
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", host, err)
 	}
 
-	ru := ray.NewRayUDP(udpIn, false, tcpIn, r)
-	log.Debugf("UDP data link %s established. ", util.ConnStr(ru))
-
-	fatal := util.Fatal{}
-	go func() {
-		buffer := make([]byte, 65535)
-		wRetry := util.Retry{Max: udpIoRetries}
-		rRetry := util.Retry{Max: udpIoRetries}
-		for {
-			n, err := ru.Read(buffer)
-			if n > 0 {
-				if _, werr := udpOut.Write(buffer[:n]); wRetry.Test(werr) {
-					fatal.Set(werr)
-					return
-				}
-			}
-			if rRetry.Test(err) {
-				fatal.Set(err)
-				return
-			}
-		}
-	}()
-	go func() {
-		buffer := make([]byte, 65535)
-		wRetry := util.Retry{Max: udpIoRetries}
-		rRetry := util.Retry{Max: udpIoRetries}
-		for {
-			n, err := udpOut.Read(buffer)
-			if n > 0 {
-				if _, werr := ru.Write(buffer[:n]); wRetry.Test(werr) {
-					fatal.Set(werr)
-					return
-				}
-			}
-			if rRetry.Test(err) {
-				fatal.Set(err)
-				return
-			}
+	var denial error
+	for _, addr := range addrs {
+		ip := addr.IP
+		dest := acl.Dest{Host: host, IP: ip, Port: uint16(port), Proto: proto}
+		d := rules.Check(string(usr.Name), dest)
+		if d.Action == acl.Allow {
+			log.Debugf("Allowed %s for user %s: %s. ", dest, usr.Name, d)
+			return net.JoinHostPort(ip.String(), portStr), nil
 		}
-	}()
-
-	<-fatal.Chan()
-	if err := ru.ErrTCP(); err != nil {
-		if errors.Is(err, io.EOF) {
-			log.Debugf("Relay UDP for inbound %s finished: EOF", util.ConnStr(ru))
-		} else {
-			log.Errf("Error relaying UDP for inbound %s: %w", util.ConnStr(ru), err)
+		if denial == nil {
+			denial = fmt.Errorf("%s %s", dest, d)
 		}
-	} else {
-		log.Errf("Error relaying UDP for inbound %s: %w", util.ConnStr(ru), fatal.Get())
 	}
-	util.CloseCloser(tcpIn)
-	util.CloseCloser(udpIn)
-	util.CloseCloser(udpOut)
-	return
+	return "", denial
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/fishBone000/xcat/config"
+	"github.com/fishBone000/xcat/ratelimit"
+	"github.com/fishBone000/xcat/ray"
+)
+
+// settings are derived from a validated configuration.
+type settings struct {
+	*config.Config
+	// Passwords of Config are zeroed once keys are derived.
+	keys    []ray.Key          // Of Users, server side only
+	fwdKeys map[string]ray.Key // By forward name, client side only
+
+	// Bandwidth limiters shared among relays, up is the direction from client
+	// to host, and down the reverse.
+	upLimiter       *ratelimit.Limiter
+	downLimiter     *ratelimit.Limiter
+	fwdLimiters     map[string][2]*ratelimit.Limiter // By forward name
+	userLimiters    map[config.Username][2]*ratelimit.Limiter
+	userLimitersMux sync.Mutex
+}
+
+// cur is the settings in effect, replaced as a whole on reload.
+// Relays keep the settings they started with.
+var cur atomic.Pointer[settings]
+
+func newSettings(c *config.Config) *settings {
+	s := &settings{
+		Config:       c,
+		upLimiter:    ratelimit.NewLimiter(int64(c.Rate.Up)),
+		downLimiter:  ratelimit.NewLimiter(int64(c.Rate.Down)),
+		fwdLimiters:  make(map[string][2]*ratelimit.Limiter),
+		userLimiters: make(map[config.Username][2]*ratelimit.Limiter),
+	}
+	for _, u := range c.Users {
+		s.keys = append(s.keys, ray.NewKey([]byte(u.Name), u.Password))
+	}
+	for i := range c.Forwards {
+		fwd := &c.Forwards[i]
+		if c.Mode == config.ModeClient {
+			if s.fwdKeys == nil {
+				s.fwdKeys = make(map[string]ray.Key)
+			}
+			usr, pwd := c.Credential(fwd)
+			s.fwdKeys[fwd.Name] = ray.NewKey([]byte(usr), pwd)
+		}
+		s.fwdLimiters[fwd.Name] = [2]*ratelimit.Limiter{
+			ratelimit.NewLimiter(int64(fwd.Rate.Up)),
+			ratelimit.NewLimiter(int64(fwd.Rate.Down)),
+		}
+	}
+	c.ZeroSecrets()
+	return s
+}
+
+// forward returns the forward listening on listen, nil if not found.
+func (s *settings) forward(listen string) *config.Forward {
+	for i := range s.Forwards {
+		if s.Forwards[i].Listen == listen {
+			return &s.Forwards[i]
+		}
+	}
+	return nil
+}
+
+// user returns the user of name with key, nil if not found or the
+// credential has changed.
+func (s *settings) user(name config.Username, key ray.Key) *config.User {
+	for i := range s.Users {
+		if s.Users[i].Name == name && s.keys[i] == key {
+			return &s.Users[i]
+		}
+	}
+	return nil
+}
+
+// relayLimiters returns limiters of a new relay of usr on fwd, the per
+// connection ones are created for the relay.
+func (s *settings) relayLimiters(fwd *config.Forward, usr config.Username) (up, down ratelimit.Limiters) {
+	s.userLimitersMux.Lock()
+	ul, ok := s.userLimiters[usr]
+	if !ok && s.Rate.User > 0 {
+		ul = [2]*ratelimit.Limiter{
+			ratelimit.NewLimiter(int64(s.Rate.User)),
+			ratelimit.NewLimiter(int64(s.Rate.User)),
+		}
+		s.userLimiters[usr] = ul
+	}
+	s.userLimitersMux.Unlock()
+
+	fl := s.fwdLimiters[fwd.Name]
+	conn := s.Rate.Conn
+	if fwd.Rate.Conn > 0 {
+		conn = fwd.Rate.Conn
+	}
+	up = ratelimit.Limiters{s.upLimiter, fl[0], ul[0], ratelimit.NewLimiter(int64(conn))}
+	down = ratelimit.Limiters{s.downLimiter, fl[1], ul[1], ratelimit.NewLimiter(int64(conn))}
+	return
+}
+
+// execCmd returns the command to run for TCP data links of usr on fwd,
+// or an empty string if outbounds should be dialed.
+func execCmd(fwd *config.Forward, usr *config.User) string {
+	if usr.Exec != "" {
+		return usr.Exec
+	}
+	return fwd.Exec
+}
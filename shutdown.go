@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/util"
+)
+
+var (
+	// Set once a stop signal is received, accept loops should return quietly
+	// afterwards.
+	stopping util.FlagOnce
+	// Relays and data links being served, drained before exit.
+	active util.Group
+)
+
+// waitStop blocks until a SIGINT or SIGTERM is received, or fatal is set.
+// On signal, listeners are closed, and active relays are given the drain
+// timeout to finish before being closed.
+// If handOff is not nil, it's called on restartSignals, and we stop likewise
+// if it succeeded.
+// If reload is not nil, it's called on reloadSignals and reloadRequests.
+// Returns the exit code: 0 if drained in time, 1 otherwise.
+func waitStop(fatal *util.Fatal, handOff, reload func() error, listeners ...io.Closer) int {
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	restartCh := make(chan os.Signal, 1)
+	if handOff != nil && len(restartSignals) > 0 {
+		signal.Notify(restartCh, restartSignals...)
+		defer signal.Stop(restartCh)
+	}
+
+	reloadCh := make(chan os.Signal, 1)
+	if reload != nil && len(reloadSignals) > 0 {
+		signal.Notify(reloadCh, reloadSignals...)
+		defer signal.Stop(reloadCh)
+	}
+	reloadReqs := reloadRequests
+	if reload == nil {
+		reloadReqs = nil
+	}
+
+Wait:
+	for {
+		select {
+		case <-fatal.Chan():
+			return 1
+		case sig := <-sigCh:
+			log.Infof("Received %s, stopping. ", sig)
+			break Wait
+		case sig := <-restartCh:
+			log.Infof("Received %s, handing off listeners to a new process. ", sig)
+			if err := handOff(); err != nil {
+				log.Errf("Failed to hand off listeners, keep serving: %v. ", err)
+				continue
+			}
+			log.Info("New process is serving, stopping. ")
+			break Wait
+		case sig := <-reloadCh:
+			log.Infof("Received %s, reloading configuration. ", sig)
+			if err := reload(); err != nil {
+				log.Errf("Failed to reload, keep using the current configuration: %v. ", err)
+				continue
+			}
+			log.Info("Configuration reloaded. ")
+		case done := <-reloadReqs:
+			log.Info("Reloading configuration by admin request. ")
+			err := reload()
+			if err != nil {
+				log.Errf("Failed to reload, keep using the current configuration: %v. ", err)
+			} else {
+				log.Info("Configuration reloaded. ")
+			}
+			done <- err
+		}
+	}
+
+	stopping.Set()
+	for _, l := range listeners {
+		util.CloseCloser(l)
+	}
+
+	drained := make(chan bool, 1)
+	go func() {
+		n := active.Len()
+		if n > 0 {
+			log.Infof("Draining %d active relays, timeout %s. ", n, time.Duration(cur.Load().Timeouts.Drain))
+		}
+		drained <- active.Wait(time.Duration(cur.Load().Timeouts.Drain))
+	}()
+
+	ok := false
+	select {
+	case ok = <-drained:
+	case sig := <-sigCh:
+		log.Warnf("Received %s again, closing all relays. ", sig)
+	}
+
+	if !ok {
+		log.Warnf("Drain timed out with %d active relays, closing them. ", active.Len())
+		util.CloseCloser(&active)
+		active.Wait(time.Second)
+		return 1
+	}
+	log.Info("All relays finished. ")
+	return 0
+}
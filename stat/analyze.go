@@ -0,0 +1,383 @@
+package stat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Event is a line of a statistic file.
+type Event struct {
+	// "t" TCP inbound, "u" UDP inbound, "c" control link on client side,
+	// "s" control link on server side.
+	Kind string `json:"kind"`
+	ID   int    `json:"id"`
+	Time int64  `json:"time_ms"` // Since the process started
+	Code string `json:"code"`
+
+	// Set with events they are known at, none in version 1 files.
+	Forward  string `json:"forward,omitempty"`
+	User     string `json:"user,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	Up       int64  `json:"up,omitempty"`   // Bytes relayed from client to host
+	Down     int64  `json:"down,omitempty"` // Bytes relayed from host to client
+	Duration int64  `json:"duration_ms,omitempty"`
+	Error    string `json:"error,omitempty"`
+	RTT      int64  `json:"rtt_us,omitempty"`    // Of a heartbeat
+	Jitter   int64  `json:"jitter_us,omitempty"` // Smoothed, at a heartbeat
+}
+
+// Events of inbounds:
+//
+//	n: New inbound
+//	p: Got port (P: failed)
+//	r: Data link established (R: failed)
+//	l: Relay finished (L: failed)
+//
+// Events of control links on client side, whose ID changes after broken:
+//
+//	r: Connecting
+//	c: Connected
+//	B: Broken
+//	h: Heartbeat replied (H: failed)
+//
+// Events of control links on server side:
+//
+//	c: Accepted and authenticated
+//	A: Authentication failed
+//	e: Ended
+var descriptions = map[string]string{
+	"n": "new inbound",
+	"p": "got port",
+	"P": "port query failed",
+	"r": "data link established",
+	"R": "data link failed",
+	"l": "relay finished",
+	"L": "relay failed",
+
+	"cr": "connecting control link",
+	"cc": "control link connected",
+	"cB": "control link broken",
+	"ch": "control link heartbeat",
+	"cH": "control link heartbeat failed",
+
+	"sc": "control link accepted",
+	"sA": "control link authentication failed",
+	"se": "control link ended",
+}
+
+// Describe returns what e means.
+func (e Event) Describe() string {
+	if e.Kind == "c" || e.Kind == "s" {
+		if d, ok := descriptions[e.Kind+e.Code]; ok {
+			return d
+		}
+	} else if d, ok := descriptions[e.Code]; ok {
+		return d
+	}
+	return "unknown event " + e.Code
+}
+
+// ParseEvents reads events from a statistic file, of the current version or
+// version 1, which has lines of kind, id, time and code.
+func ParseEvents(r io.Reader) ([]Event, error) {
+	var events []Event
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if b := sc.Bytes(); len(b) > 0 && b[0] == '{' {
+			var h Header
+			if err := json.Unmarshal(b, &h); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if h.Format != "" {
+				if h.Format != "xcat-stat" || h.Version > Version {
+					return nil, fmt.Errorf("line %d: unsupported format %s version %d", line, h.Format, h.Version)
+				}
+				continue
+			}
+			var e Event
+			json.Unmarshal(b, &e)
+			events = append(events, e)
+			continue
+		}
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expecting 4 fields, got %d", line, len(fields))
+		}
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid id %q", line, fields[1])
+		}
+		t, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid time %q", line, fields[2])
+		}
+		events = append(events, Event{Kind: fields[0], ID: id, Time: t, Code: fields[3]})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time < events[j].Time })
+	return events, nil
+}
+
+// Phases of an inbound, in order.
+var Phases = []string{"port", "link", "relay"}
+
+// Conn is the lifecycle of an inbound, or a data link on server side.
+// Durations of phases are in milliseconds, -1 if not reached.
+type Conn struct {
+	Kind    string `json:"kind"` // "tcp" or "udp"
+	ID      int    `json:"id"`
+	Start   int64  `json:"start_ms"`
+	Port    int64  `json:"port_ms"`
+	Link    int64  `json:"link_ms"`
+	Relay   int64  `json:"relay_ms"`
+	Failed  string `json:"failed,omitempty"` // Phase failed
+	Done    bool   `json:"done"`             // False if the file ends before
+	Forward string `json:"forward,omitempty"`
+	User    string `json:"user,omitempty"`
+	Remote  string `json:"remote,omitempty"`
+	Up      int64  `json:"up"`
+	Down    int64  `json:"down"`
+	Error   string `json:"error,omitempty"` // Cause of failure
+}
+
+func (c *Conn) phase(name string) int64 {
+	switch name {
+	case "port":
+		return c.Port
+	case "link":
+		return c.Link
+	}
+	return c.Relay
+}
+
+// PhaseStats are latencies in milliseconds and failures of a phase of
+// inbounds of kind.
+type PhaseStats struct {
+	Kind        string  `json:"kind"`
+	Phase       string  `json:"phase"`
+	Count       int     `json:"count"` // Inbounds finished the phase
+	Failed      int     `json:"failed"`
+	FailureRate float64 `json:"failure_rate"`
+	P50         int64   `json:"p50_ms"`
+	P90         int64   `json:"p90_ms"`
+	P99         int64   `json:"p99_ms"`
+	Max         int64   `json:"max_ms"`
+}
+
+// Outage is a window in which the control link was broken, End is -1 if
+// it was not connected again.
+type Outage struct {
+	ID       int   `json:"id"` // Of the broken control link
+	Start    int64 `json:"start_ms"`
+	End      int64 `json:"end_ms"`
+	Attempts int   `json:"attempts"` // To connect meanwhile
+}
+
+// Cause is an error that Count inbounds failed with at a phase.
+type Cause struct {
+	Kind  string `json:"kind"`
+	Phase string `json:"phase"`
+	Error string `json:"error"`
+	Count int    `json:"count"`
+}
+
+// CtrlLinks counts control links on server side.
+type CtrlLinks struct {
+	Accepted   int `json:"accepted"`
+	AuthFailed int `json:"auth_failed"`
+	Ended      int `json:"ended"`
+}
+
+// Heartbeats are round trip times in microseconds of heartbeats on control
+// links on client side.
+type Heartbeats struct {
+	Count  int   `json:"count"`
+	Failed int   `json:"failed"`
+	P50    int64 `json:"p50_us"`
+	P90    int64 `json:"p90_us"`
+	P99    int64 `json:"p99_us"`
+	Max    int64 `json:"max_us"`
+	Jitter int64 `json:"jitter_us"` // Mean of the smoothed jitter
+}
+
+// Report is the analysis of a statistic file.
+type Report struct {
+	Conns      []*Conn      `json:"conns"`
+	Phases     []PhaseStats `json:"phases"`
+	Causes     []Cause      `json:"causes"` // Most frequent first
+	Outages    []Outage     `json:"outages"`
+	CtrlLinks  CtrlLinks    `json:"ctrl_links"`
+	Heartbeats Heartbeats   `json:"heartbeats"`
+}
+
+// Analyze reconstructs lifecycles of inbounds and outages of control links
+// from events sorted by time. Control links of different forwards are not
+// told apart.
+func Analyze(events []Event) *Report {
+	rep := &Report{Conns: []*Conn{}, Causes: []Cause{}, Outages: []Outage{}}
+	conns := make(map[string]*Conn)
+	last := make(map[*Conn]int64) // Time of the last event of conns
+	var outage *Outage
+	var rtts []int64
+	var jitter int64
+
+	for _, e := range events {
+		if e.Kind == "s" {
+			switch e.Code {
+			case "c":
+				rep.CtrlLinks.Accepted++
+			case "A":
+				rep.CtrlLinks.AuthFailed++
+			case "e":
+				rep.CtrlLinks.Ended++
+			}
+			continue
+		}
+		if e.Kind == "c" {
+			switch e.Code {
+			case "r":
+				if outage != nil {
+					outage.Attempts++
+				}
+			case "c":
+				if outage != nil {
+					outage.End = e.Time
+					rep.Outages = append(rep.Outages, *outage)
+					outage = nil
+				}
+			case "B":
+				if outage == nil {
+					outage = &Outage{ID: e.ID, Start: e.Time, End: -1}
+				}
+			case "h":
+				rtts = append(rtts, e.RTT)
+				jitter += e.Jitter
+			case "H":
+				rep.Heartbeats.Failed++
+			}
+			continue
+		}
+
+		key := e.Kind + strconv.Itoa(e.ID)
+		c := conns[key]
+		if c == nil {
+			kind := "tcp"
+			if e.Kind == "u" {
+				kind = "udp"
+			}
+			c = &Conn{Kind: kind, ID: e.ID, Start: e.Time, Port: -1, Link: -1, Relay: -1}
+			conns[key] = c
+			last[c] = e.Time
+			rep.Conns = append(rep.Conns, c)
+		}
+		d := e.Time - last[c]
+		last[c] = e.Time
+		for _, f := range []struct {
+			dst *string
+			src string
+		}{
+			{&c.Forward, e.Forward},
+			{&c.User, e.User},
+			{&c.Remote, e.Remote},
+			{&c.Error, e.Error},
+		} {
+			if f.src != "" {
+				*f.dst = f.src
+			}
+		}
+		c.Up += e.Up
+		c.Down += e.Down
+		switch e.Code {
+		case "p", "P":
+			c.Port = d
+		case "r", "R":
+			c.Link = d
+		case "l", "L":
+			c.Relay = d
+			c.Done = true
+		}
+		switch e.Code {
+		case "P":
+			c.Failed, c.Done = "port", true
+		case "R":
+			c.Failed, c.Done = "link", true
+		case "L":
+			c.Failed = "relay"
+		}
+	}
+	if outage != nil {
+		rep.Outages = append(rep.Outages, *outage)
+	}
+	if n := len(rtts); n > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		hb := &rep.Heartbeats
+		hb.Count = n
+		hb.P50, hb.P90, hb.P99 = percentile(rtts, 50), percentile(rtts, 90), percentile(rtts, 99)
+		hb.Max = rtts[n-1]
+		hb.Jitter = jitter / int64(n)
+	}
+
+	causes := make(map[Cause]int)
+	for _, c := range rep.Conns {
+		if c.Failed != "" {
+			causes[Cause{Kind: c.Kind, Phase: c.Failed, Error: c.Error}]++
+		}
+	}
+	for cause, n := range causes {
+		cause.Count = n
+		rep.Causes = append(rep.Causes, cause)
+	}
+	sort.Slice(rep.Causes, func(i, j int) bool {
+		a, b := rep.Causes[i], rep.Causes[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return fmt.Sprint(a) < fmt.Sprint(b)
+	})
+
+	for _, kind := range []string{"tcp", "udp"} {
+		for _, phase := range Phases {
+			st := PhaseStats{Kind: kind, Phase: phase}
+			var ds []int64
+			for _, c := range rep.Conns {
+				if c.Kind != kind || c.phase(phase) < 0 {
+					continue
+				}
+				st.Count++
+				if c.Failed == phase {
+					st.Failed++
+				}
+				ds = append(ds, c.phase(phase))
+			}
+			if st.Count == 0 {
+				continue
+			}
+			sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+			st.FailureRate = float64(st.Failed) / float64(st.Count)
+			st.P50, st.P90, st.P99 = percentile(ds, 50), percentile(ds, 90), percentile(ds, 99)
+			st.Max = ds[len(ds)-1]
+			rep.Phases = append(rep.Phases, st)
+		}
+	}
+	return rep
+}
+
+// percentile returns the p-th percentile of sorted ds by nearest rank.
+func percentile(ds []int64, p int) int64 {
+	i := (len(ds)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return ds[i-1]
+}
@@ -0,0 +1,113 @@
+package stat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	events, err := ParseEvents(strings.NewReader(`c 0 0 r
+c 0 5 c
+t 1 10 n
+t 1 12 p
+t 1 15 r
+t 1 115 l
+t 2 20 n
+t 2 30 P
+c 0 40 B
+c 1 50 r
+c 1 60 r
+c 1 70 c
+u 3 80 n
+u 3 81 p
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := Analyze(events)
+
+	if len(rep.Conns) != 3 {
+		t.Fatalf("expecting 3 inbounds, got %d", len(rep.Conns))
+	}
+	c := rep.Conns[0]
+	if c.Port != 2 || c.Link != 3 || c.Relay != 100 || c.Failed != "" || !c.Done {
+		t.Errorf("unexpected lifecycle %+v", *c)
+	}
+	if c := rep.Conns[1]; c.Failed != "port" || c.Link != -1 {
+		t.Errorf("unexpected lifecycle %+v", *c)
+	}
+	if c := rep.Conns[2]; c.Done {
+		t.Errorf("unexpected lifecycle %+v", *c)
+	}
+
+	port := rep.Phases[0]
+	if port.Kind != "tcp" || port.Phase != "port" || port.Count != 2 || port.Failed != 1 || port.Max != 10 {
+		t.Errorf("unexpected phase stats %+v", port)
+	}
+
+	if len(rep.Outages) != 1 {
+		t.Fatalf("expecting 1 outage, got %d", len(rep.Outages))
+	}
+	if o := rep.Outages[0]; o.Start != 40 || o.End != 70 || o.Attempts != 2 {
+		t.Errorf("unexpected outage %+v", o)
+	}
+}
+
+func TestParseEventsError(t *testing.T) {
+	if _, err := ParseEvents(strings.NewReader("t 1 10 n\nt x 11 p\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expecting error of line 2, got %v", err)
+	}
+}
+
+func TestStatFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xcat.stat")
+	sf, err := Open(path, "server", 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.WriteEvent(Event{Kind: "t", ID: 1, Code: "n", User: "alice", Forward: "echo"})
+	sf.WriteEvent(Event{Kind: "t", ID: 1, Code: "r"})
+	sf.WriteEvent(Event{Kind: "t", ID: 1, Code: "L", Up: 10, Down: 20, Error: "reset"})
+	sf.WriteEvent(Event{Kind: "s", ID: 2, Code: "A"})
+	sf.WriteEvent(Event{Kind: "c", ID: 3, Code: "h", RTT: 1000, Jitter: 500})
+	sf.WriteEvent(Event{Kind: "c", ID: 3, Code: "h", RTT: 3000, Jitter: 700})
+	sf.WriteEvent(Event{Kind: "c", ID: 3, Code: "H", Error: "i/o timeout"})
+	if err := sf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := ParseEvents(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := Analyze(events)
+	if len(rep.Conns) != 1 {
+		t.Fatalf("expecting 1 inbound, got %d", len(rep.Conns))
+	}
+	c := rep.Conns[0]
+	if c.User != "alice" || c.Forward != "echo" || c.Up != 10 || c.Down != 20 || c.Failed != "relay" {
+		t.Errorf("unexpected lifecycle %+v", *c)
+	}
+	if len(rep.Causes) != 1 || rep.Causes[0].Error != "reset" {
+		t.Errorf("unexpected causes %+v", rep.Causes)
+	}
+	if rep.CtrlLinks.AuthFailed != 1 {
+		t.Errorf("unexpected control links %+v", rep.CtrlLinks)
+	}
+	hb := rep.Heartbeats
+	if hb.Count != 2 || hb.Failed != 1 || hb.P50 != 1000 || hb.Max != 3000 || hb.Jitter != 600 {
+		t.Errorf("unexpected heartbeats %+v", hb)
+	}
+
+	_, err = ParseEvents(strings.NewReader(`{"format":"xcat-stat","version":99}` + "\n"))
+	if err == nil {
+		t.Error("expecting error of unsupported version")
+	}
+}
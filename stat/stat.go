@@ -1,8 +1,7 @@
 package stat
 
 import (
-	"fmt"
-	"os"
+	"encoding/json"
 	"sync"
 	"time"
 
@@ -13,31 +12,67 @@ var (
 	birth time.Time
 )
 
+// Version of the statistic file format.
+const Version = 2
+
+// Header is the first line of each statistic file, followed by events of
+// [Event] in JSON, one per line.
+type Header struct {
+	Format  string    `json:"format"` // Always "xcat-stat"
+	Version int       `json:"version"`
+	Side    string    `json:"side"`  // "client" or "server"
+	Start   time.Time `json:"start"` // Of the process, times of events are since it
+}
+
 type StatFile struct {
-	f *os.File
+	f *log.RotatingFile
 }
 
-func (s *StatFile) Init() {
-	f, err := os.CreateTemp("", "xcat-*")
-	if err != nil {
-		log.Errf("Cannot create temp file for statistic: %v", err)
-		os.Exit(255)
+// Open opens the statistic file at path for side, it is rotated like log
+// files, see [log.RotatingFile].
+func Open(path, side string, maxSize int64, rotate time.Duration, maxBackups int) (*StatFile, error) {
+	f := &log.RotatingFile{
+		Path:       path,
+		MaxSize:    maxSize,
+		Interval:   rotate,
+		MaxBackups: maxBackups,
+		Header: func() []byte {
+			b, _ := json.Marshal(&Header{"xcat-stat", Version, side, birth})
+			return append(b, '\n')
+		},
 	}
-	s.f = f
+	if err := f.Open(); err != nil {
+		return nil, err
+	}
+	return &StatFile{f}, nil
 }
 
 func (s *StatFile) Name() string {
-	return s.f.Name()
+	return s.f.Path
 }
 
+// Close flushes the statistic file to disk and closes it.
+func (s *StatFile) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// Write writes an event of code msg of the connection of kind t and id.
 func (s *StatFile) Write(t string, id int, msg string) {
-  if s.f == nil {
+	s.WriteEvent(Event{Kind: t, ID: id, Code: msg})
+}
+
+// WriteEvent writes e, with its time set to now.
+func (s *StatFile) WriteEvent(e Event) {
+  if s == nil || s.f == nil {
     return
   }
-	_, err := fmt.Fprintf(s.f, "%v %v %v %v\n", t, id, time.Since(birth).Milliseconds(), msg)
-	if err != nil {
-		log.Errf("Failed to write to statistic temp file: %v", err)
-		os.Exit(255)
+	e.Time = time.Since(birth).Milliseconds()
+	b, _ := json.Marshal(&e)
+	if _, err := s.f.Write(append(b, '\n')); err != nil {
+		log.Errf("Failed to write to statistic file: %v. ", err)
 	}
 }
 
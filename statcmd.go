@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/stat"
+)
+
+const statUsage = `Usage: xcat stat analyze [-format text|json|csv] [-timeline] FILE
+
+Analyzes a statistic file written by the client or the server, of version 1
+or 2. The text report has latency percentiles and failure rates of phases of
+inbounds (port query, data link and relay), causes of failures, and outages
+of the control link.
+JSON has the report with lifecycles of all inbounds, CSV has the lifecycles.
+`
+
+// runStat runs the stat subcommand with args following it.
+func runStat(args []string) int {
+	if len(args) == 0 || args[0] != "analyze" {
+		fmt.Fprint(os.Stderr, statUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("stat analyze", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), statUsage) }
+	format := fs.String("format", "text", "output format, text, json or csv")
+	timeline := fs.Bool("timeline", false, "print all events in time order, text format only")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	events, err := stat.ParseEvents(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", fs.Arg(0), err)
+		return 1
+	}
+	rep := stat.Analyze(events)
+
+	switch *format {
+	case "text":
+		writeStatText(os.Stdout, rep)
+		if *timeline {
+			writeStatTimeline(os.Stdout, events)
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rep)
+	case "csv":
+		err = writeStatCSV(os.Stdout, rep)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func ms(d int64) string {
+	return (time.Duration(d) * time.Millisecond).String()
+}
+
+func us(d int64) string {
+	return (time.Duration(d) * time.Microsecond).String()
+}
+
+func writeStatText(w io.Writer, rep *stat.Report) {
+	counts := make(map[string]int)
+	unfinished := 0
+	for _, c := range rep.Conns {
+		counts[c.Kind]++
+		if !c.Done {
+			unfinished++
+		}
+	}
+	fmt.Fprintf(w, "Inbounds: %d TCP, %d UDP, %d unfinished\n\n", counts["tcp"], counts["udp"], unfinished)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Phase\tCount\tFailed\tRate\tp50\tp90\tp99\tMax\t")
+	for _, p := range rep.Phases {
+		fmt.Fprintf(tw, "%s %s\t%d\t%d\t%.1f%%\t%s\t%s\t%s\t%s\t\n",
+			p.Kind, p.Phase, p.Count, p.Failed, p.FailureRate*100, ms(p.P50), ms(p.P90), ms(p.P99), ms(p.Max))
+	}
+	tw.Flush()
+
+	if len(rep.Causes) > 0 {
+		fmt.Fprintln(w, "\nFailure causes:")
+		for _, c := range rep.Causes {
+			cause := c.Error
+			if cause == "" {
+				cause = "unknown"
+			}
+			fmt.Fprintf(w, "  %d %s %s: %s\n", c.Count, c.Kind, c.Phase, cause)
+		}
+	}
+	if l := rep.CtrlLinks; l != (stat.CtrlLinks{}) {
+		fmt.Fprintf(w, "\nControl links: %d accepted, %d authentication failed, %d ended\n", l.Accepted, l.AuthFailed, l.Ended)
+	}
+
+	if hb := rep.Heartbeats; hb.Count > 0 || hb.Failed > 0 {
+		fmt.Fprintf(w, "\nHeartbeats: %d, %d failed, RTT p50 %s, p90 %s, p99 %s, max %s, jitter %s\n",
+			hb.Count, hb.Failed, us(hb.P50), us(hb.P90), us(hb.P99), us(hb.Max), us(hb.Jitter))
+	}
+
+	fmt.Fprintf(w, "\nControl link outages: %d\n", len(rep.Outages))
+	for _, o := range rep.Outages {
+		if o.End < 0 {
+			fmt.Fprintf(w, "  %s - end of file, %d connect attempts\n", ms(o.Start), o.Attempts)
+			continue
+		}
+		fmt.Fprintf(w, "  %s - %s (%s), %d connect attempts\n", ms(o.Start), ms(o.End), ms(o.End-o.Start), o.Attempts)
+	}
+}
+
+func writeStatTimeline(w io.Writer, events []stat.Event) {
+	fmt.Fprintln(w, "\nTimeline:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, e := range events {
+		fmt.Fprintf(tw, "  %s\t%s#%d\t%s\n", ms(e.Time), e.Kind, e.ID, e.Describe())
+	}
+	tw.Flush()
+}
+
+func writeStatCSV(w io.Writer, rep *stat.Report) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "id", "start_ms", "port_ms", "link_ms", "relay_ms", "failed", "done"})
+	for _, c := range rep.Conns {
+		cw.Write([]string{
+			c.Kind, strconv.Itoa(c.ID),
+			strconv.FormatInt(c.Start, 10), strconv.FormatInt(c.Port, 10),
+			strconv.FormatInt(c.Link, 10), strconv.FormatInt(c.Relay, 10),
+			c.Failed, strconv.FormatBool(c.Done),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// sf is the statistic file, nil if disabled.
+var sf *stat.StatFile
+
+// openStat opens the statistic file of s for side if configured.
+func openStat(s *settings, side string) error {
+	c := s.Stat
+	if c.File == "" {
+		return nil
+	}
+	f, err := stat.Open(c.File, side, int64(c.MaxSize), time.Duration(c.Rotate), c.MaxBackups)
+	if err != nil {
+		return err
+	}
+	sf = f
+	log.Infof("Recording statistics in %s. ", c.File)
+	return nil
+}
+
+func closeStat() {
+	if err := sf.Close(); err != nil {
+		log.Errf("Failed to close statistic file: %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "errors"
+
+// Raw mode is not supported on this platform, keys are read once Enter is
+// pressed.
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errors.ErrUnsupported
+}
+
+func termSize(fd int) (width, height int, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
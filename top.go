@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/tunnel"
+)
+
+const topUsage = `Usage: xcat top [-c FILE] [-addr ADDR] [-interval D]
+
+Shows live throughput of relays, users and forwards of a running client or
+server, its control links and recent errors, fed by its admin endpoint.
+The endpoint is located like "xcat ctl" does.
+
+Keys:
+  r, u, f     show relays, users or forwards
+  s, S        sort by the next column, reverse the order
+  /           filter rows by text, Enter to apply, empty to clear
+  up, down    select a row, or k and j
+  K           kill the selected relay or user, confirmed by y
+  q           quit
+
+Flags:
+`
+
+// Views of xcat top, and columns they can be sorted by.
+var topSorts = map[string][]string{
+	"relays":   {"down/s", "up/s", "total", "age", "id"},
+	"users":    {"down/s", "up/s", "total", "relays", "name"},
+	"forwards": {"down/s", "up/s", "total", "relays", "name"},
+}
+
+// topLog is a log entry in a feed update.
+type topLog struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+	log.Fields
+}
+
+// topUpdate is a feed update, see adminUpdate.
+type topUpdate struct {
+	Time time.Time `json:"time"`
+	adminStatus
+	Logs []topLog `json:"logs"`
+}
+
+// topRow is a row of the table of the current view.
+type topRow struct {
+	key      string // Relay ID or name of the user or forward
+	cols     []string
+	up, down float64 // Bytes per second
+	total    int64
+	age      time.Duration
+	relays   int
+}
+
+// topState is the state of xcat top.
+type topState struct {
+	view    string
+	sortBy  int // Index in topSorts of view
+	reverse bool
+	filter  string
+	editing bool // The filter
+	input   string
+	sel     int    // Selected row
+	confirm string // Row key to kill once confirmed
+	msg     string // Shown in the footer until the next key
+
+	last  *topUpdate
+	rates map[int][2]float64 // Up and down by relay ID
+	logs  []topLog           // Latest ones last
+	err   error              // Of the feed, cleared on the next update
+}
+
+const maxTopLogs = 100
+
+// runTop runs the top subcommand with args following it.
+func runTop(args []string) int {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), topUsage)
+		fs.PrintDefaults()
+	}
+	file, addr := adminFlags(fs)
+	interval := fs.Duration("interval", time.Second, "interval of updates")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	ac, code := adminClientOf("top", *file, *addr)
+	if ac == nil {
+		return code
+	}
+	if !log.IsTerminal(os.Stdout) {
+		fmt.Fprintln(os.Stderr, "xcat top: standard output is not a terminal")
+		return 1
+	}
+
+	restore, err := makeRaw(int(os.Stdin.Fd()))
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		fmt.Fprintf(os.Stderr, "xcat top: %s\n", err)
+		return 1
+	}
+	if restore != nil {
+		defer restore()
+	}
+	// Alternate screen, cursor hidden.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	updates := make(chan *topUpdate)
+	feedErrs := make(chan error)
+	go followFeed(ac, *interval, updates, feedErrs)
+	keys := make(chan string)
+	go readKeys(keys)
+
+	st := &topState{view: "relays", rates: make(map[int][2]float64)}
+	st.render()
+	for {
+		select {
+		case u := <-updates:
+			st.update(u)
+		case err := <-feedErrs:
+			st.err = err
+		case k, ok := <-keys:
+			if !ok || !st.key(k, ac) {
+				return 0
+			}
+		}
+		st.render()
+	}
+}
+
+// followFeed sends updates of the feed of ac, connecting again after errors.
+func followFeed(ac *adminClient, interval time.Duration, updates chan<- *topUpdate, errs chan<- error) {
+	for {
+		body, err := ac.stream("/feed?" + url.Values{"interval": {interval.String()}}.Encode())
+		if err == nil {
+			dec := json.NewDecoder(bufio.NewReader(body))
+			for {
+				u := &topUpdate{}
+				if err = dec.Decode(u); err != nil {
+					break
+				}
+				updates <- u
+			}
+			body.Close()
+		}
+		errs <- err
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// readKeys sends keys read from standard input, arrow keys as "up" and
+// "down". keys is closed once standard input is closed.
+func readKeys(keys chan<- string) {
+	defer close(keys)
+	r := bufio.NewReader(os.Stdin)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		if b != 0x1b {
+			keys <- string(b)
+			continue
+		}
+		// Escape sequences of arrow keys, "\x1b[A" and "\x1b[B".
+		if r.Buffered() < 2 {
+			keys <- "esc"
+			continue
+		}
+		seq := make([]byte, 2)
+		r.Read(seq)
+		switch string(seq) {
+		case "[A":
+			keys <- "up"
+		case "[B":
+			keys <- "down"
+		}
+	}
+}
+
+// update takes in u, computing rates of relays from the last update.
+func (st *topState) update(u *topUpdate) {
+	rates := make(map[int][2]float64)
+	if st.last != nil {
+		dt := u.Time.Sub(st.last.Time).Seconds()
+		prev := make(map[int]tunnel.RelayInfo)
+		for _, r := range st.last.Relays {
+			prev[r.ID] = r
+		}
+		for _, r := range u.Relays {
+			p, ok := prev[r.ID]
+			if ok && dt > 0 {
+				rates[r.ID] = [2]float64{float64(r.Up-p.Up) / dt, float64(r.Down-p.Down) / dt}
+			}
+		}
+	}
+	st.last, st.rates, st.err = u, rates, nil
+	st.logs = append(st.logs, u.Logs...)
+	if len(st.logs) > maxTopLogs {
+		st.logs = st.logs[len(st.logs)-maxTopLogs:]
+	}
+}
+
+// key handles key k, false is returned to quit.
+func (st *topState) key(k string, ac *adminClient) bool {
+	st.msg = ""
+	if st.editing {
+		switch k {
+		case "\r", "\n":
+			st.filter, st.editing, st.sel = st.input, false, 0
+		case "esc":
+			st.editing = false
+		case "\x7f", "\b":
+			if st.input != "" {
+				st.input = st.input[:len(st.input)-1]
+			}
+		default:
+			if len(k) == 1 && k[0] >= ' ' {
+				st.input += k
+			}
+		}
+		return true
+	}
+	if st.confirm != "" {
+		if k == "y" {
+			st.msg = st.kill(st.confirm, ac)
+		} else {
+			st.msg = "Not killed."
+		}
+		st.confirm = ""
+		return true
+	}
+
+	switch k {
+	case "q", "\x03":
+		return false
+	case "r", "u", "f":
+		view := map[string]string{"r": "relays", "u": "users", "f": "forwards"}[k]
+		if view != st.view {
+			st.view, st.sortBy, st.reverse, st.sel = view, 0, false, 0
+		}
+	case "s":
+		st.sortBy = (st.sortBy + 1) % len(topSorts[st.view])
+	case "S":
+		st.reverse = !st.reverse
+	case "/":
+		st.editing, st.input = true, st.filter
+	case "up", "k":
+		st.sel--
+	case "down", "j":
+		st.sel++
+	case "K":
+		rows := st.rows()
+		switch {
+		case st.view == "forwards":
+			st.msg = "Select a relay or a user to kill."
+		case st.sel < 0 || st.sel >= len(rows):
+			st.msg = "Nothing selected."
+		default:
+			st.confirm = rows[st.sel].key
+		}
+	}
+	return true
+}
+
+// kill kills the relay or user of key in the current view.
+func (st *topState) kill(key string, ac *adminClient) string {
+	what := "user"
+	if st.view == "relays" {
+		what = "relay"
+	}
+	var reply struct{ Killed int }
+	if err := ac.do(http.MethodPost, "/kill?"+url.Values{what: {key}}.Encode(), &reply); err != nil {
+		return fmt.Sprintf("Failed to kill %s %s: %s", what, key, err)
+	}
+	return fmt.Sprintf("Killed %s %s (%d closed).", what, key, reply.Killed)
+}
+
+// rows returns rows of the current view, filtered and sorted.
+func (st *topState) rows() []topRow {
+	if st.last == nil {
+		return nil
+	}
+	var rows []topRow
+	if st.view == "relays" {
+		for _, r := range st.last.Relays {
+			rate := st.rates[r.ID]
+			age := st.last.Time.Sub(r.Since)
+			rows = append(rows, topRow{
+				key:  strconv.Itoa(r.ID),
+				cols: []string{strconv.Itoa(r.ID), r.Network, r.Forward, r.User, r.Remote, age.Truncate(time.Second).String()},
+				up:   rate[0], down: rate[1], total: r.Up + r.Down, age: age, relays: 1,
+			})
+		}
+	} else {
+		byKey := make(map[string]*topRow)
+		for _, r := range st.last.Relays {
+			key := r.User
+			if st.view == "forwards" {
+				key = r.Forward
+			}
+			row := byKey[key]
+			if row == nil {
+				row = &topRow{key: key}
+				byKey[key] = row
+			}
+			rate := st.rates[r.ID]
+			row.up += rate[0]
+			row.down += rate[1]
+			row.total += r.Up + r.Down
+			row.relays++
+		}
+		for _, row := range byKey {
+			row.cols = []string{row.key, strconv.Itoa(row.relays)}
+			rows = append(rows, *row)
+		}
+	}
+
+	if st.filter != "" {
+		f := strings.ToLower(st.filter)
+		kept := rows[:0]
+		for _, row := range rows {
+			if strings.Contains(strings.ToLower(strings.Join(row.cols, " ")), f) {
+				kept = append(kept, row)
+			}
+		}
+		rows = kept
+	}
+
+	by := topSorts[st.view][st.sortBy]
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		var less bool
+		switch by {
+		case "down/s":
+			less = a.down > b.down
+		case "up/s":
+			less = a.up > b.up
+		case "total":
+			less = a.total > b.total
+		case "age":
+			less = a.age > b.age
+		case "relays":
+			less = a.relays > b.relays
+		case "id":
+			ai, _ := strconv.Atoi(a.key)
+			bi, _ := strconv.Atoi(b.key)
+			less = ai < bi
+		default:
+			less = a.key < b.key
+		}
+		if st.reverse {
+			return !less
+		}
+		return less
+	})
+	return rows
+}
+
+// render draws the screen.
+func (st *topState) render() {
+	width, height, err := termSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	var lines []string
+	add := func(f string, a ...any) {
+		lines = append(lines, fmt.Sprintf(f, a...))
+	}
+
+	if st.last == nil {
+		add("xcat top, waiting for the feed...")
+	} else {
+		var up, down float64
+		for _, r := range st.rates {
+			up += r[0]
+			down += r[1]
+		}
+		add("xcat top - %s %s - %s - %d relays, up %s/s, down %s/s",
+			st.last.Mode, st.last.Version, st.last.Time.Local().Format("15:04:05"),
+			len(st.last.Relays), formatBytes(int64(up)), formatBytes(int64(down)))
+	}
+	if st.err != nil {
+		add("\x1b[31mFeed: %s, retrying\x1b[0m", st.err)
+	}
+
+	// Control links, at most a quarter of the screen.
+	if st.last != nil {
+		links := st.last.CtrlLinks
+		add("")
+		add("Control links: %d", len(links))
+		limit := height / 4
+		for i, c := range links {
+			if i == limit {
+				add("  ... %d more", len(links)-limit)
+				break
+			}
+			add("  %s", ctrlLinkLine(c, st.last.Time))
+		}
+	}
+
+	// Recent errors, at most a fifth of the screen.
+	var logLines []string
+	nlogs := height / 5
+	for i := max(0, len(st.logs)-nlogs); i < len(st.logs); i++ {
+		l := st.logs[i]
+		line := fmt.Sprintf("  %s %-5s %s", l.Time.Local().Format("15:04:05"), strings.ToUpper(l.Level), strings.Join(strings.Fields(l.Msg), " "))
+		if l.Level == "error" {
+			line = "\x1b[31m" + line + "\x1b[0m"
+		}
+		logLines = append(logLines, line)
+	}
+
+	rows := st.rows()
+	if st.sel >= len(rows) {
+		st.sel = len(rows) - 1
+	}
+	if st.sel < 0 {
+		st.sel = 0
+	}
+	header := []string{"ID", "NET", "FORWARD", "USER", "REMOTE", "AGE"}
+	switch st.view {
+	case "users":
+		header = []string{"USER", "RELAYS"}
+	case "forwards":
+		header = []string{"FORWARD", "RELAYS"}
+	}
+	header = append(header, "UP/S", "DOWN/S", "TOTAL")
+	table := [][]string{header}
+	for _, row := range rows {
+		table = append(table, append(append([]string{}, row.cols...),
+			formatBytes(int64(row.up)), formatBytes(int64(row.down)), formatBytes(row.total)))
+	}
+
+	sortName := topSorts[st.view][st.sortBy]
+	if st.reverse {
+		sortName += ", reversed"
+	}
+	filter := ""
+	if st.filter != "" {
+		filter = fmt.Sprintf(", filter %q", st.filter)
+	}
+	add("")
+	add("%s%s: %d, sorted by %s%s", strings.ToUpper(st.view[:1]), st.view[1:], len(rows), sortName, filter)
+
+	// The table takes the rest, scrolled to the selected row.
+	room := height - len(lines) - len(logLines) - 3
+	if len(logLines) > 0 {
+		room--
+	}
+	room = max(room, 1)
+	first := 0
+	if st.sel >= room {
+		first = st.sel - room + 1
+	}
+	widths := make([]int, len(header))
+	for _, r := range table {
+		for i, c := range r {
+			widths[i] = max(widths[i], len(c))
+		}
+	}
+	formatRow := func(r []string) string {
+		var b strings.Builder
+		b.WriteString("  ")
+		for i, c := range r {
+			fmt.Fprintf(&b, "%-*s  ", widths[i], c)
+		}
+		return b.String()
+	}
+	add("\x1b[1m%s\x1b[0m", formatRow(header))
+	for i := first; i < len(rows) && i < first+room; i++ {
+		line := formatRow(table[i+1])
+		if i == st.sel {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+
+	if len(logLines) > 0 {
+		for len(lines) < height-len(logLines)-2 {
+			add("")
+		}
+		add("Recent warnings and errors:")
+		lines = append(lines, logLines...)
+	}
+	for len(lines) < height-1 {
+		add("")
+	}
+
+	footer := "r/u/f view  s/S sort  / filter  j/k select  K kill  q quit"
+	switch {
+	case st.editing:
+		footer = "Filter: " + st.input + "_"
+	case st.confirm != "":
+		footer = fmt.Sprintf("Kill %s %s? (y/n)", strings.TrimSuffix(st.view, "s"), st.confirm)
+	case st.msg != "":
+		footer = st.msg
+	}
+	add("\x1b[7m%s\x1b[0m", footer)
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range lines[:min(len(lines), height)] {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(truncate(line, width))
+		b.WriteString("\x1b[K")
+	}
+	b.WriteString("\x1b[J")
+	os.Stdout.WriteString(b.String())
+}
+
+// ctrlLinkLine describes control link c at now.
+func ctrlLinkLine(c tunnel.CtrlLinkInfo, now time.Time) string {
+	since := func(t time.Time) string {
+		return now.Sub(t).Truncate(time.Second).String()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s@%s ", c.Forward, c.User, c.Remote)
+	switch {
+	case c.Since.IsZero():
+		b.WriteString("idle")
+	case c.Connected:
+		fmt.Fprintf(&b, "\x1b[32mup\x1b[0m %s", since(c.Since))
+		if c.RTT > 0 {
+			fmt.Fprintf(&b, ", rtt %s ±%s", roundRTT(c.RTT), roundRTT(c.Jitter))
+		}
+	default:
+		fmt.Fprintf(&b, "\x1b[31mdown\x1b[0m %s", since(c.Since))
+		if c.Failures > 0 {
+			fmt.Fprintf(&b, ", %d failed attempts", c.Failures)
+		}
+		if c.Error != "" {
+			fmt.Fprintf(&b, " (%s)", c.Error)
+		}
+	}
+	if c.Pending > 0 {
+		fmt.Fprintf(&b, ", %d pending", c.Pending)
+	}
+	if c.Connects > 1 {
+		fmt.Fprintf(&b, ", %d reconnects", c.Connects-1)
+	}
+	// The latest outages.
+	var outages []string
+	for i, h := range c.History {
+		if h.Connected || i+1 >= len(c.History) {
+			continue
+		}
+		next := c.History[i+1]
+		outages = append(outages, fmt.Sprintf("%s for %s", h.Time.Local().Format("15:04:05"), next.Time.Sub(h.Time).Truncate(time.Second)))
+	}
+	if len(outages) > 0 {
+		fmt.Fprintf(&b, ", outages: %s", strings.Join(outages[max(0, len(outages)-3):], ", "))
+	}
+	return b.String()
+}
+
+// truncate cuts s to width visible characters, escape sequences are kept.
+func truncate(s string, width int) string {
+	var b strings.Builder
+	n := 0
+	esc := false
+	for _, r := range s {
+		switch {
+		case esc:
+			esc = r < '@' || r > '~' || r == '['
+		case r == 0x1b:
+			esc = true
+		default:
+			if n == width {
+				continue
+			}
+			n++
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,683 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fishBone000/xcat/ctrl"
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/ratelimit"
+	"github.com/fishBone000/xcat/ray"
+	"github.com/fishBone000/xcat/stat"
+	"github.com/fishBone000/xcat/util"
+)
+
+// ClientOptions configure a [Client].
+type ClientOptions struct {
+	Name   string  // Of the forward, labels metrics
+	Server string  // Address of the server
+	User   string  // Name of Key, only used in requests passed to hooks
+	Key    ray.Key // See [ray.NewKey]
+
+	CtrlLinkTimeout time.Duration // Of connecting the control link
+	Heartbeat       time.Duration // Interval of heartbeats on the control link, 0 for none
+	DataLinkTimeout time.Duration // Of establishing UDP data links
+	UDPTimeout      time.Duration // UDP relays without activity are closed, 0 for never
+	// UDPMux relays UDP inbounds as flows of one data link, which needs
+	// servers supporting [ctrl.ReqUDPMux].
+	UDPMux bool
+	// UDPTransport is how UDP data links carry datagrams, see [UDPTransport].
+	UDPTransport UDPTransport
+	UDPMTU       int // Path MTU to the server, discovered if 0, see [ray.RayUDP.SetMTU]
+	// UDPRejectOversize rejects datagrams over the payload MTU, which are
+	// fragmented otherwise if the server supports it.
+	UDPRejectOversize bool
+
+	// Dial dials the server for control links and data links, net.Dialer if
+	// nil.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Accept checks the remote address of new inbounds if not nil, rejected
+	// ones are closed.
+	Accept   func(remote net.Addr) bool
+	Limiters LimitersFunc // No bandwidth limits if nil
+
+	// Relays being served are joined to Relays, so that they can be drained
+	// or closed. Only read by NewClient, a private group is used if nil.
+	Relays *util.Group
+	Stat   *stat.StatFile // Statistics are written to it if not nil
+	Log    log.Logger
+}
+
+// Client relays inbounds through data links to a server.
+type Client struct {
+	state    atomic.Pointer[clientState]
+	relays   *util.Group
+	sessions sessions
+
+	mux       sync.Mutex
+	listeners map[io.Closer]struct{}
+	closed    util.FlagOnce
+}
+
+type clientState struct {
+	opts *ClientOptions
+	ctrl *ctrl.ControlLink
+	host string // Of opts.Server
+
+	assocMux sync.Mutex
+	assoc    *udpAssoc // Carrying flows if opts.UDPMux
+
+	udpBlocked atomic.Bool // UDP to the server found blocked, see [UDPAuto]
+}
+
+func NewClient(opts *ClientOptions) *Client {
+	c := &Client{
+		relays:    opts.Relays,
+		listeners: make(map[io.Closer]struct{}),
+	}
+	if c.relays == nil {
+		c.relays = &util.Group{}
+	}
+	c.state.Store(newClientState(opts, nil))
+	return c
+}
+
+// newClientState returns the state of opts, the control link of old is
+// reused if it's still valid for opts.
+func newClientState(opts *ClientOptions, old *clientState) *clientState {
+	host, _, _ := net.SplitHostPort(opts.Server)
+	st := &clientState{opts: opts, host: host}
+	if old != nil && old.opts.Server == opts.Server && old.opts.Key == opts.Key &&
+		old.opts.CtrlLinkTimeout == opts.CtrlLinkTimeout && old.opts.Heartbeat == opts.Heartbeat {
+		st.ctrl = old.ctrl
+		return st
+	}
+	st.ctrl = ctrl.NewCtrlLinkKey(opts.Server, opts.Key, opts.CtrlLinkTimeout)
+	st.ctrl.Sf = opts.Stat
+	st.ctrl.Log = opts.Log.Named("ctrl")
+	st.ctrl.Dial = opts.Dial
+	st.ctrl.Heartbeat = opts.Heartbeat
+	var connected atomic.Bool
+	st.ctrl.Handshake = func(err error) {
+		handshakes.With(sideClient, "ctrl", handshakeResult(err), opts.Name, opts.User).Inc()
+		if err == nil && connected.Swap(true) {
+			ctrlReconnects.With(opts.Name, opts.User).Inc()
+		}
+	}
+	return st
+}
+
+// Reconfigure puts opts in effect for new inbounds, opts.Relays is ignored.
+// The control link is kept if Server, Key, CtrlLinkTimeout and Heartbeat are
+// unchanged.
+func (c *Client) Reconfigure(opts *ClientOptions) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	old := c.state.Load()
+	st := newClientState(opts, old)
+	c.state.Store(st)
+	if st.ctrl != old.ctrl {
+		util.CloseCloser(old.ctrl)
+	}
+}
+
+// CtrlLink returns the state of the control link.
+func (c *Client) CtrlLink() CtrlLinkInfo {
+	st := c.state.Load()
+	cs := st.ctrl.Status()
+	info := CtrlLinkInfo{
+		ID: cs.ID, Forward: st.opts.Name, User: st.opts.User, Remote: st.opts.Server,
+		Since: cs.Since, Connected: cs.Connected,
+		Error: cs.Error, Connects: cs.Connects, Failures: cs.Failures,
+		RTT: cs.RTT, Jitter: cs.Jitter,
+	}
+	for _, h := range st.ctrl.History() {
+		info.History = append(info.History, LinkChange{h.Since, h.Connected, h.Error})
+	}
+	return info
+}
+
+// Relays returns relays being served.
+func (c *Client) Relays() []RelayInfo {
+	return c.sessions.relayInfos()
+}
+
+// KillRelay closes the relay of id, false if not found.
+func (c *Client) KillRelay(id int) bool {
+	return c.sessions.killRelay(id)
+}
+
+// KillUser closes relays of user, and returns how many were closed.
+func (c *Client) KillUser(user string) int {
+	return c.sessions.killUser(user)
+}
+
+// track adds l to the listeners closed by Close, false if c is closed.
+func (c *Client) track(l io.Closer) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed.Get() {
+		return false
+	}
+	c.listeners[l] = struct{}{}
+	return true
+}
+
+func (c *Client) untrack(l io.Closer) {
+	c.mux.Lock()
+	delete(c.listeners, l)
+	c.mux.Unlock()
+	util.CloseCloser(l)
+}
+
+// Serve accepts TCP or unix domain socket inbounds on l until ctx is done or
+// c is closed, and closes l before returning.
+func (c *Client) Serve(ctx context.Context, l net.Listener) error {
+	if !c.track(l) {
+		util.CloseCloser(l)
+		return ErrClosed
+	}
+	defer c.untrack(l)
+	stop := context.AfterFunc(ctx, func() { util.CloseCloser(l) })
+	defer stop()
+
+	for {
+		inbound, err := l.Accept()
+		if err != nil {
+			if c.closed.Get() || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		st := c.state.Load()
+		if st.opts.Accept != nil && !st.opts.Accept(inbound.RemoteAddr()) {
+			util.CloseCloser(inbound)
+			continue
+		}
+		go c.serveInboundTCP(ctx, inbound, st)
+	}
+}
+
+// udpAcceptor stops l accepting new UDP inbounds once closed, while those
+// accepted keep being relayed.
+type udpAcceptor struct {
+	l *util.MultiListenerUDP
+}
+
+func (a udpAcceptor) Close() error {
+	a.l.StopAccepting()
+	return nil
+}
+
+// ServeUDP is like Serve, but accepts UDP inbounds.
+// The filter of l is replaced with Accept of the options.
+// Once c is closed, l only stops accepting, so that UDP relays being served
+// keep their inbounds until the caller closes l.
+func (c *Client) ServeUDP(ctx context.Context, l *util.MultiListenerUDP) error {
+	a := udpAcceptor{l}
+	if !c.track(a) {
+		a.Close()
+		return ErrClosed
+	}
+	defer c.untrack(a)
+	stop := context.AfterFunc(ctx, func() { util.CloseCloser(l) })
+	defer stop()
+
+	l.SetFilter(func(raddr net.Addr) bool {
+		accept := c.state.Load().opts.Accept
+		return accept == nil || accept(raddr)
+	})
+	for {
+		inbound, err := l.Accept()
+		if err != nil {
+			if c.closed.Get() || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go c.serveInboundUDP(ctx, inbound, c.state.Load())
+	}
+}
+
+// Close stops all Serve calls and closes the control link.
+// Relays being served are not closed.
+func (c *Client) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.closed.Set() {
+		return nil
+	}
+	for l := range c.listeners {
+		util.CloseCloser(l)
+	}
+	return c.state.Load().ctrl.Close()
+}
+
+func (st *clientState) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if st.opts.Dial != nil {
+		return st.opts.Dial(ctx, network, addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func (st *clientState) limiters(r *Request) (up, down ratelimit.Limiters) {
+	if st.opts.Limiters != nil {
+		return st.opts.Limiters(r)
+	}
+	return nil, nil
+}
+
+// New Inbound: n
+// Got port: p(P)
+// Ray: r(R)
+// Relay: l(L)
+func (c *Client) serveInboundTCP(ctx context.Context, inbound net.Conn, st *clientState) {
+	member := c.relays.Join(inbound)
+	defer member.Leave()
+	sf := st.opts.Stat
+
+	id := cnt.Tick()
+	sf.WriteEvent(stat.Event{Kind: "t", ID: id, Code: "n", Forward: st.opts.Name, User: st.opts.User, Remote: inbound.RemoteAddr().String()})
+	log := connLog(st.opts.Log.Named("relay"), strconv.Itoa(id), st.opts.User, inbound)
+
+	// Setup is cancelled if the inbound is closed meanwhile.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := watchInbound(inbound, cancel)
+
+	log.Event("inbound_accepted").Debugf("New TCP inbound %s. ", inbound.RemoteAddr().String())
+	port, err := st.getPort(ctx, ctrl.ReqTCP)
+	if err != nil {
+		sf.WriteEvent(stat.Event{Kind: "t", ID: id, Code: "P", Error: err.Error()})
+		if IsRefused(err) {
+			log.Event("request_refused").Warnf("Server refused TCP inbound %s: %v. ", inbound.RemoteAddr(), err)
+		} else if IsUnreachable(err) {
+			log.Event("server_unreachable").Warnf("Closing TCP inbound %s: %v. ", inbound.RemoteAddr(), err)
+		} else if ctx.Err() != nil {
+			log.Debugf("Inbound %s closed while getting port. ", inbound.RemoteAddr())
+		} else {
+			log.Debugf("Failed to get available port, closing inbound %s: %v. ", inbound.RemoteAddr(), err)
+		}
+		util.CloseCloser(inbound)
+		return
+	}
+	sf.Write("t", id, "p")
+	log.Debug(fmt.Sprintf("Got port %d for inbound %s. ", port, util.ConnStr(inbound)))
+
+	rconn, err := st.dialDataLink(ctx, port)
+	early := w.stop()
+	if err == nil && ctx.Err() != nil {
+		util.CloseCloser(rconn)
+		err = ctx.Err()
+	}
+	if err != nil {
+		sf.WriteEvent(stat.Event{Kind: "t", ID: id, Code: "R", Error: err.Error()})
+		if ctx.Err() != nil {
+			log.Debugf("Inbound %s closed while establishing TCP data link. ", inbound.RemoteAddr())
+		} else {
+			log.Event("data_link_failed").Errf("Establish TCP data link to server %s failed, closing inbound %s: %v", st.opts.Server, util.ConnStr(inbound), err)
+		}
+		util.CloseCloser(inbound)
+		return
+	}
+	sf.Write("t", id, "r")
+	start := time.Now()
+	member.Attach(rconn)
+	log.Event("relay_started").Debugf("Established TCP data link %s for inbound %s, relay starting. ", util.ConnStr(rconn), util.ConnStr(inbound))
+
+	active := relaysActive.With(sideClient, "tcp", st.opts.Name, st.opts.User)
+	active.Inc()
+	defer active.Dec()
+
+	upBytes := relayBytes.With(sideClient, "up", st.opts.Name, st.opts.User)
+	counted := &countConn{
+		Conn:    inbound,
+		read:    upBytes,
+		written: relayBytes.With(sideClient, "down", st.opts.Name, st.opts.User),
+	}
+	defer c.sessions.addRelay(RelayInfo{
+		ID: id, Network: "tcp", Forward: st.opts.Name, User: st.opts.User,
+		Remote: inbound.RemoteAddr().String(), Since: start,
+	}, &counted.nRead, &counted.nWritten, member)()
+	up, down := st.limiters(st.request(ctx, "tcp", inbound))
+	if len(early) > 0 {
+		up.WaitN(len(early))
+		upBytes.Add(float64(len(early)))
+		counted.nRead.Add(int64(len(early)))
+		if _, err := rconn.Write(early); err != nil {
+			sf.WriteEvent(stat.Event{Kind: "t", ID: id, Code: "L", Duration: time.Since(start).Milliseconds(), Error: err.Error()})
+			log.Event("relay_failed").Warnf("Error relaying TCP for inbound %s: \n%v", util.ConnStr(inbound), err)
+			util.CloseCloser(inbound)
+			util.CloseCloser(rconn)
+			return
+		}
+	}
+	err = util.Relay(ratelimit.NewConn(counted, up, down), rconn)
+	ev := stat.Event{
+		Kind: "t", ID: id, Code: "l",
+		Up: counted.nRead.Load(), Down: counted.nWritten.Load(),
+		Duration: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		countIntegrity(err, sideClient, st.opts.Name, st.opts.User)
+		ev.Code, ev.Error = "L", err.Error()
+		log.Event("relay_failed").Warnf("Error relaying TCP for inbound %s: \n%v", util.ConnStr(inbound), err)
+	} else {
+		log.Event("relay_finished").Debugf("Relay TCP finished for inbound %s. ", util.ConnStr(inbound))
+	}
+	sf.WriteEvent(ev)
+}
+
+// Data read from an inbound beyond it is left unread until relaying starts.
+const maxWatchBuffer = 64 << 10
+
+// inboundWatch reads an inbound while its data link is being set up, so that
+// closing the inbound cancels the setup. Data read is kept for relaying.
+type inboundWatch struct {
+	conn    net.Conn
+	cancel  context.CancelFunc
+	buf     []byte
+	stopped util.FlagOnce
+	done    chan struct{}
+}
+
+func watchInbound(conn net.Conn, cancel context.CancelFunc) *inboundWatch {
+	w := &inboundWatch{
+		conn:   conn,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *inboundWatch) run() {
+	defer close(w.done)
+	b := make([]byte, 4096)
+	for len(w.buf) < maxWatchBuffer {
+		n, err := w.conn.Read(b)
+		w.buf = append(w.buf, b[:n]...)
+		if err != nil {
+			if w.stopped.Get() {
+				return
+			}
+			// An inbound half closed after sending data still expects a
+			// reply, reading it again in the relay yields EOF again.
+			if !errors.Is(err, io.EOF) || len(w.buf) == 0 {
+				w.cancel()
+			}
+			return
+		}
+	}
+}
+
+// stop stops reading and returns data read so far.
+func (w *inboundWatch) stop() []byte {
+	w.stopped.Set()
+	w.conn.SetReadDeadline(time.Now())
+	<-w.done
+	w.conn.SetReadDeadline(time.Time{})
+	return w.buf
+}
+
+func (st *clientState) request(ctx context.Context, network string, inbound interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}) *Request {
+	return &Request{
+		Context: ctx,
+		User:    st.opts.User,
+		Network: network,
+		Local:   inbound.LocalAddr(),
+		Remote:  inbound.RemoteAddr(),
+	}
+}
+
+// getPort queries a port for req on the control link, observing the latency.
+func (st *clientState) getPort(ctx context.Context, req byte) (uint16, error) {
+	start := time.Now()
+	port, err := st.ctrl.GetPortContext(ctx, req)
+	result := "ok"
+	switch {
+	case IsRefused(err):
+		result = "refused"
+	case IsUnreachable(err):
+		result = "unreachable"
+	case ctx.Err() != nil:
+		result = "cancelled"
+	case err != nil:
+		result = "error"
+	}
+	portQuerySeconds.Observe(time.Since(start).Seconds(), st.opts.Name, st.opts.User, result)
+	return port, err
+}
+
+func (st *clientState) dialDataLink(ctx context.Context, port uint16) (*ray.RayConn, error) {
+	conn, err := st.dial(ctx, "tcp", net.JoinHostPort(st.host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	rconn, err := ray.FromConnContext(ctx, conn, st.opts.Key)
+	if ctx.Err() == nil {
+		handshakes.With(sideClient, "data", handshakeResult(err), st.opts.Name, st.opts.User).Inc()
+	}
+	if err != nil {
+		util.CloseCloser(conn)
+		return nil, err
+	}
+	return rconn, nil
+}
+
+// udpLink carries datagrams of a UDP inbound, a [ray.RayUDP] or a flow of a
+// multiplexed one.
+type udpLink interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	Close() error
+	ErrTCP() error
+}
+
+// newUDPDataLink queries a port for req and dials the UDP data link for
+// inbound, writing events of it with id to the statistic file. Failures are
+// logged, and false is returned.
+func (st *clientState) newUDPDataLink(ctx context.Context, req byte, inbound net.Addr, id int, log log.Logger) (*ray.RayUDP, bool) {
+	sf := st.opts.Stat
+	port, err := st.getPort(ctx, req)
+	if err != nil {
+		sf.WriteEvent(stat.Event{Kind: "u", ID: id, Code: "P", Error: err.Error()})
+		if IsRefused(err) {
+			log.Event("request_refused").Warnf("Server refused UDP inbound %s: %v. ", inbound, err)
+		} else if IsUnreachable(err) {
+			log.Event("server_unreachable").Warnf("Closing UDP inbound %s: %v. ", inbound, err)
+		} else {
+			log.Errf("Failed to get available port, closing inbound %s: %v. ", inbound, err)
+		}
+		return nil, false
+	}
+	sf.Write("u", id, "p")
+
+	addr := net.JoinHostPort(st.host, strconv.Itoa(int(port)))
+	ru, err := st.dialUDPDataLink(ctx, addr)
+	if err != nil {
+		sf.WriteEvent(stat.Event{Kind: "u", ID: id, Code: "R", Error: err.Error()})
+		log.Event("data_link_failed").Errf("Failed to dial UDP data link to %s. Reason: \n%v", addr, err)
+		return nil, false
+	}
+	ru.OnOversize = countOversize(sideClient, st.opts.Name, st.opts.User)
+	ru.SetMTU(st.opts.UDPMTU, !st.opts.UDPRejectOversize)
+	mtu := ru.PayloadMTU()
+	if req == ctrl.ReqUDPMux {
+		mtu -= frameHeaderSize
+	}
+	udpPayloadMTU.With(st.opts.Name, st.opts.User).Set(float64(mtu))
+	log.Debugf("UDP data link %s has path MTU %d, payload MTU %d. ", util.ConnStr(ru), ru.PathMTU(), mtu)
+	go st.superviseTransport(ru)
+	return ru, true
+}
+
+func (st *clientState) dialUDPDataLink(ctx context.Context, addr string) (*ray.RayUDP, error) {
+	if st.opts.DataLinkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, st.opts.DataLinkTimeout)
+		defer cancel()
+	}
+	tcp, err := st.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ru, err := ray.FromConnUDPContext(ctx, tcp, "udp", st.opts.Key)
+	if ctx.Err() == nil {
+		handshakes.With(sideClient, "data", handshakeResult(err), st.opts.Name, st.opts.User).Inc()
+	}
+	if err != nil {
+		util.CloseCloser(tcp)
+		return nil, err
+	}
+	return ru, nil
+}
+
+// New Inbound: n
+// Got port: p(P)
+// Ray: r(R)
+// Relay: l(L)
+func (c *Client) serveInboundUDP(ctx context.Context, inbound *util.UDPConn, st *clientState) {
+	defer util.CloseCloser(inbound)
+	member := c.relays.Join(inbound)
+	defer member.Leave()
+	sf := st.opts.Stat
+
+	id := cnt.Tick()
+	sf.WriteEvent(stat.Event{Kind: "u", ID: id, Code: "n", Forward: st.opts.Name, User: st.opts.User, Remote: inbound.RemoteAddr().String()})
+	log := connLog(st.opts.Log.Named("udp"), strconv.Itoa(id), st.opts.User, inbound)
+
+	log.Event("inbound_accepted").Debugf("New UDP inbound %s. ", inbound.RemoteAddr().String())
+	var ru udpLink
+	if st.opts.UDPMux {
+		f, ok := st.openFlow(ctx, inbound.RemoteAddr(), id, log)
+		if !ok {
+			return
+		}
+		ru = f
+	} else {
+		r, ok := st.newUDPDataLink(ctx, ctrl.ReqUDP, inbound.RemoteAddr(), id, log)
+		if !ok {
+			return
+		}
+		ru = r
+	}
+	sf.Write("u", id, "r")
+	start := time.Now()
+	var nUp, nDown atomic.Int64
+	defer util.CloseCloser(ru)
+	member.Attach(ru)
+	defer c.sessions.addRelay(RelayInfo{
+		ID: id, Network: "udp", Forward: st.opts.Name, User: st.opts.User,
+		Remote: inbound.RemoteAddr().String(), Since: start,
+	}, &nUp, &nDown, member)()
+
+	active := relaysActive.With(sideClient, "udp", st.opts.Name, st.opts.User)
+	active.Inc()
+	defer active.Dec()
+
+	upBytes := relayBytes.With(sideClient, "up", st.opts.Name, st.opts.User)
+	downBytes := relayBytes.With(sideClient, "down", st.opts.Name, st.opts.User)
+	up, down := st.limiters(st.request(ctx, "udp", inbound))
+	fatal := util.Fatal{}
+	activity := make(chan struct{}, 4)
+	oversize := oversizeFeedback{log: log}
+	go func() {
+		for {
+			p, err := inbound.Read()
+			if err != nil {
+				fatal.Set(err)
+				return
+			}
+			activity <- struct{}{}
+			up.WaitN(len(p))
+			_, err = ru.Write(p)
+			if e := tooLarge(err); e != nil {
+				log.Debugf("Dropped datagram from inbound %s: %v. ", inbound.RemoteAddr(), err)
+				oversize.report(inbound.RemoteAddr(), inbound.LocalAddr(), e)
+				continue
+			}
+			if err != nil {
+				fatal.Set(err)
+				return
+			}
+			upBytes.Add(float64(len(p)))
+			nUp.Add(int64(len(p)))
+		}
+	}()
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, err := ru.Read(buffer)
+			var werr error
+			if n > 0 {
+				activity <- struct{}{}
+				down.WaitN(n)
+				_, werr = inbound.Write(buffer[:n])
+				if werr == nil {
+					downBytes.Add(float64(n))
+					nDown.Add(int64(n))
+				}
+			}
+			switch {
+			case err != nil:
+				countIntegrity(err, sideClient, st.opts.Name, st.opts.User)
+				fatal.Set(err)
+				return
+			case werr != nil:
+				fatal.Set(werr)
+				return
+			}
+		}
+	}()
+	go func() {
+		d := st.opts.UDPTimeout
+		var ticker *time.Ticker
+		if d > 0 {
+			ticker = time.NewTicker(d)
+			defer ticker.Stop()
+		} else {
+			// Make a dummy ticker
+			ticker = new(time.Ticker)
+			ticker.C = make(<-chan time.Time)
+		}
+		for {
+			select {
+			case <-activity:
+				ticker.Reset(d)
+			case <-ticker.C:
+				fatal.Set(nil)
+				return
+			}
+		}
+	}()
+
+	<-fatal.Chan()
+	ev := stat.Event{Kind: "u", ID: id, Code: "L", Up: nUp.Load(), Down: nDown.Load(), Duration: time.Since(start).Milliseconds()}
+	if err := ru.ErrTCP(); err != nil {
+		ev.Error = err.Error()
+		sf.WriteEvent(ev)
+		log.Event("relay_failed").Errf("Error relaying UDP for %s. Reason:\n%v", inbound.RemoteAddr(), err)
+		return
+	}
+	if err := fatal.Get(); err != nil && !errors.Is(err, errFlowIdle) {
+		ev.Error = err.Error()
+		sf.WriteEvent(ev)
+		log.Event("relay_failed").Errf("Error relaying UDP for %s. Reason:\n%v", inbound.RemoteAddr(), fatal.Get())
+		return
+	}
+	ev.Code = "l"
+	sf.WriteEvent(ev)
+	log.Event("relay_finished").Debugf("Relay UDP for %s finished (no activity for %s). ", inbound.RemoteAddr(), st.opts.UDPTimeout)
+}
@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/ray"
+)
+
+// oversizeWarnInterval is the min interval of warnings about datagrams
+// dropped for the payload MTU, of a relay.
+const oversizeWarnInterval = 10 * time.Second
+
+var icmpConn struct {
+	once sync.Once
+	c    net.PacketConn // Nil if raw sockets are not permitted
+}
+
+// fragNeeded tells the application at app, which sent a datagram of size to
+// local, that it's over mtu, by ICMP "fragmentation needed" as routers do,
+// so that its socket gets EMSGSIZE or lowers its path MTU. IPv4 only, and
+// raw sockets are needed, false is reported if not sent.
+func fragNeeded(app, local *net.UDPAddr, size, mtu int) bool {
+	icmpConn.once.Do(func() {
+		c, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+		if err != nil {
+			log.Named("udp").Debugf("No ICMP feedback for oversized datagrams: %v. ", err)
+			return
+		}
+		icmpConn.c = c
+	})
+	src, dst := app.IP.To4(), local.IP.To4()
+	if dst != nil && dst.IsUnspecified() && src != nil && src.IsLoopback() {
+		dst = src
+	}
+	if icmpConn.c == nil || src == nil || dst == nil || dst.IsUnspecified() {
+		return false
+	}
+
+	b := fragNeededPacket(src, dst, app.Port, local.Port, size, mtu)
+	_, err := icmpConn.c.WriteTo(b, &net.IPAddr{IP: src})
+	return err == nil
+}
+
+// fragNeededPacket returns the ICMP "fragmentation needed" message of a
+// datagram of size from src to dst, IPv4 addresses, over mtu.
+func fragNeededPacket(src, dst net.IP, srcPort, dstPort, size, mtu int) []byte {
+	// Type, code, checksum, unused, next-hop MTU, then the IP header and
+	// UDP header of the datagram.
+	b := make([]byte, 8+20+8)
+	b[0], b[1] = 3, 4
+	binary.BigEndian.PutUint16(b[6:], uint16(min(mtu+20+8, 0xFFFF)))
+	ip := b[8:28]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(min(20+8+size, 0xFFFF)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // Don't fragment
+	ip[8], ip[9] = 64, 17
+	copy(ip[12:], src)
+	copy(ip[16:], dst)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+	udp := b[28:]
+	binary.BigEndian.PutUint16(udp, uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:], uint16(min(8+size, 0xFFFF)))
+	binary.BigEndian.PutUint16(b[2:], checksum(b))
+	return b
+}
+
+// checksum is the Internet checksum of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// oversizeFeedback reports datagrams of a relay dropped for the payload MTU,
+// to the application by ICMP if possible, and by warnings at most once per
+// oversizeWarnInterval.
+type oversizeFeedback struct {
+	log log.Logger
+
+	mux     sync.Mutex
+	last    time.Time
+	dropped int // Since the last warning
+}
+
+// report reports the datagram from app to local dropped with e.
+func (f *oversizeFeedback) report(app, local net.Addr, e *ray.DatagramTooLargeError) {
+	a, _ := app.(*net.UDPAddr)
+	l, _ := local.(*net.UDPAddr)
+	sent := a != nil && l != nil && fragNeeded(a, l, e.Size, e.MTU)
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.dropped++
+	if time.Since(f.last) < oversizeWarnInterval {
+		return
+	}
+	how := "no ICMP sent"
+	if sent {
+		how = "ICMP sent"
+	}
+	f.log.Event("datagram_oversized").Warnf(
+		"Dropped %d datagrams from %s over payload MTU %d of path MTU %d, the last of %d bytes (%s). ",
+		f.dropped, app, e.MTU, e.PathMTU, e.Size, how,
+	)
+	f.last, f.dropped = time.Now(), 0
+}
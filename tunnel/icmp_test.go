@@ -0,0 +1,42 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	// An IPv4 header with its checksum 0xB861 zeroed.
+	ip, _ := hex.DecodeString("450000730000400040110000c0a80001c0a800c7")
+	if sum := checksum(ip); sum != 0xB861 {
+		t.Fatalf("want checksum 0xB861, got 0x%04X", sum)
+	}
+	ip[10], ip[11] = 0xB8, 0x61
+	if sum := checksum(ip); sum != 0 {
+		t.Errorf("want checksum 0 with it filled, got 0x%04X", sum)
+	}
+	// Odd lengths are padded with a zero byte.
+	if sum := checksum([]byte{0x01}); sum != 0xFEFF {
+		t.Errorf("want checksum 0xFEFF of odd length, got 0x%04X", sum)
+	}
+}
+
+func TestFragNeededPacket(t *testing.T) {
+	lo := net.IPv4(127, 0, 0, 1).To4()
+	got := fragNeededPacket(lo, lo, 40000, 8000, 1500, 1200)
+	want, _ := hex.DecodeString("" +
+		// Type 3 code 4, checksum, unused, next-hop MTU 1228
+		"030436cb000004cc" +
+		// IPv4 header of 1528 bytes, DF, TTL 64, UDP, from and to 127.0.0.1
+		"450005f800004000401136f37f0000017f000001" +
+		// UDP header from 40000 to 8000 of 1508 bytes
+		"9c401f4005e40000")
+	if !bytes.Equal(got, want) {
+		t.Errorf("want\n% X\ngot\n% X", want, got)
+	}
+	if sum := checksum(got); sum != 0 {
+		t.Errorf("want ICMP checksum valid, got 0x%04X", sum)
+	}
+}
@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/fishBone000/xcat/metrics"
+	"github.com/fishBone000/xcat/ray"
+)
+
+// Metrics are labelled by side ("server" or "client"), forward and user
+// where applicable.
+var (
+	relaysActive = metrics.NewGauge("xcat_relays_active",
+		"Relays being served.", "side", "proto", "forward", "user")
+	relayBytes = metrics.NewCounter("xcat_relay_bytes_total",
+		"Bytes relayed, up is the direction from client to host.", "side", "direction", "forward", "user")
+	handshakes = metrics.NewCounter("xcat_handshakes_total",
+		"Ray negotiations by link and result.", "side", "link", "result", "forward", "user")
+	integrityErrors = metrics.NewCounter("xcat_integrity_errors_total",
+		"Data received with integrity compromised.", "side", "forward", "user")
+	ctrlReconnects = metrics.NewCounter("xcat_ctrl_link_reconnects_total",
+		"Control links connected again after being lost.", "forward", "user")
+	portQuerySeconds = metrics.NewHistogram("xcat_port_query_seconds",
+		"Latency of port queries on control links, including waiting for other queries.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "forward", "user", "result")
+	udpFlows = metrics.NewGauge("xcat_udp_flows_active",
+		"UDP flows being relayed on multiplexed data links.", "side", "forward", "user")
+	udpOverTCP = metrics.NewGauge("xcat_udp_over_tcp_links",
+		"UDP data links carrying datagrams over TCP, client side only.", "forward", "user")
+	udpFallbacks = metrics.NewCounter("xcat_udp_fallbacks_total",
+		"UDP data links falling back to TCP as UDP to the server was found blocked.", "forward", "user")
+	udpPayloadMTU = metrics.NewGauge("xcat_udp_payload_mtu_bytes",
+		"Max datagram size over UDP without fragmenting, of the last UDP data link, client side only.", "forward", "user")
+	udpOversized = metrics.NewCounter("xcat_udp_oversized_total",
+		"Datagrams over the payload MTU of UDP data links, fragmented or rejected.", "side", "action", "forward", "user")
+	acceptTimeouts = metrics.NewCounter("xcat_data_link_accept_timeouts_total",
+		"Data links not connected by clients in time.", "proto", "forward", "user")
+)
+
+const (
+	sideServer = "server"
+	sideClient = "client"
+)
+
+type forwardKey struct{}
+
+// WithForward returns a copy of ctx carrying name of the forward being served,
+// pass it to [Server.Serve] to label metrics with it.
+func WithForward(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, forwardKey{}, name)
+}
+
+func forwardOf(ctx context.Context) string {
+	name, _ := ctx.Value(forwardKey{}).(string)
+	return name
+}
+
+// handshakeResult is the result label of a negotiation failed with err.
+func handshakeResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ray.ErrAuthFailed):
+		return "auth_failed"
+	case errors.Is(err, ray.ErrIntegrityCompromised):
+		return "integrity_compromised"
+	}
+	return "error"
+}
+
+// countIntegrity counts err if data integrity is compromised.
+func countIntegrity(err error, side, forward, user string) {
+	if errors.Is(err, ray.ErrIntegrityCompromised) {
+		integrityErrors.With(side, forward, user).Inc()
+	}
+}
+
+// countOversize returns a [ray.RayUDP.OnOversize] counting datagrams.
+func countOversize(side, forward, user string) func(size int, fragmented bool) {
+	fragmented := udpOversized.With(side, "fragmented", forward, user)
+	rejected := udpOversized.With(side, "rejected", forward, user)
+	return func(_ int, ok bool) {
+		if ok {
+			fragmented.Inc()
+		} else {
+			rejected.Inc()
+		}
+	}
+}
+
+// countConn counts bytes read from and written to a connection.
+type countConn struct {
+	net.Conn
+	read, written   *metrics.Value
+	nRead, nWritten atomic.Int64 // Of this connection only
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(float64(n))
+	c.nRead.Add(int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(float64(n))
+	c.nWritten.Add(int64(n))
+	return n, err
+}
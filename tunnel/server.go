@@ -0,0 +1,721 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fishBone000/xcat/ctrl"
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/ratelimit"
+	"github.com/fishBone000/xcat/ray"
+	"github.com/fishBone000/xcat/stat"
+	"github.com/fishBone000/xcat/util"
+)
+
+const udpIoRetries = 4
+
+// User is a user accepted by a [Server].
+type User struct {
+	Name string
+	Key  ray.Key // See [ray.NewKey]
+}
+
+// ServerOptions configure a [Server].
+type ServerOptions struct {
+	Users []User
+	// Target is the outbound address of data links if Authorize is nil,
+	// "unix:" followed by a socket path is accepted.
+	Target string
+	// Authorize checks the request r and returns the target to dial.
+	// The request is denied if an error is returned. Requests of a control
+	// link are authorized in order, apart from replying its pings, so it may
+	// block for a while like resolving names, but it should be bounded.
+	Authorize func(r *Request) (target string, err error)
+	// Dial dials the outbound of r to target, [DialTarget] if nil.
+	// It's called once the data link is allocated, while waiting for the
+	// client to connect.
+	Dial func(ctx context.Context, r *Request, target string) (net.Conn, error)
+	// Accept checks the remote address of new control links if not nil,
+	// rejected ones are closed.
+	Accept   func(remote net.Addr) bool
+	Limiters LimitersFunc // No bandwidth limits if nil
+
+	DataLinkTimeout time.Duration // For the client to connect, 0 for none
+	// Limits of resources, 0 for unlimited.
+	MaxCtrlLinksPerUser int
+	MaxCtrlLinksPerIP   int // Including those negotiating, closed if over
+	MaxPending          int // Data links pending for connection per control link
+	MaxRelays           int
+
+	// Relays being served are joined to Relays, so that they can be drained
+	// or closed. Only read by NewServer, a private group is used if nil.
+	Relays *util.Group
+	Stat   *stat.StatFile // Statistics are written to it if not nil
+	Log    log.Logger
+}
+
+// Server serves control links and data links of clients.
+type Server struct {
+	opts      atomic.Pointer[ServerOptions]
+	relays    *util.Group
+	ctrlLinks util.Group
+	sessions  sessions
+
+	// Quotas of resource limits
+	ctrlLinksByIP   util.Quota
+	ctrlLinksByUser util.Quota
+	relayQuota      util.Quota
+
+	mux       sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    util.FlagOnce
+}
+
+func NewServer(opts *ServerOptions) *Server {
+	s := &Server{
+		relays:    opts.Relays,
+		listeners: make(map[net.Listener]struct{}),
+	}
+	if s.relays == nil {
+		s.relays = &util.Group{}
+	}
+	s.opts.Store(opts)
+	return s
+}
+
+// Reconfigure puts opts in effect for new requests, opts.Relays is ignored.
+// Control links of users removed or with the key changed are closed on their
+// next request.
+func (s *Server) Reconfigure(opts *ServerOptions) {
+	s.opts.Store(opts)
+}
+
+// Serve accepts control links on l until ctx is done or s is closed, and
+// closes l before returning.
+// Control links accepted are closed once ctx is done, relays are not.
+// Data links are listened on the host of the address of l.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	s.mux.Lock()
+	if s.closed.Get() {
+		s.mux.Unlock()
+		util.CloseCloser(l)
+		return ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mux.Unlock()
+	defer func() {
+		s.mux.Lock()
+		delete(s.listeners, l)
+		s.mux.Unlock()
+		util.CloseCloser(l)
+	}()
+	stop := context.AfterFunc(ctx, func() { util.CloseCloser(l) })
+	defer stop()
+
+	lhost, _, _ := net.SplitHostPort(l.Addr().String())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closed.Get() || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		opts := s.opts.Load()
+		if opts.Accept != nil && !opts.Accept(conn.RemoteAddr()) {
+			util.CloseCloser(conn)
+			continue
+		}
+		go s.serveControlLink(ctx, conn, lhost)
+	}
+}
+
+// Close stops all Serve calls and closes control links.
+// Relays being served are not closed.
+func (s *Server) Close() error {
+	s.mux.Lock()
+	if !s.closed.Set() {
+		s.mux.Unlock()
+		return nil
+	}
+	for l := range s.listeners {
+		util.CloseCloser(l)
+	}
+	s.mux.Unlock()
+	return s.ctrlLinks.Close()
+}
+
+// CtrlLinks returns control links being served.
+func (s *Server) CtrlLinks() []CtrlLinkInfo {
+	return s.sessions.ctrlLinkInfos()
+}
+
+// Relays returns relays being served.
+func (s *Server) Relays() []RelayInfo {
+	return s.sessions.relayInfos()
+}
+
+// KillRelay closes the relay of id, false if not found.
+func (s *Server) KillRelay(id int) bool {
+	return s.sessions.killRelay(id)
+}
+
+// KillUser closes control links and relays of user, and returns how many
+// were closed. The user can connect again unless removed from the options.
+func (s *Server) KillUser(user string) int {
+	return s.sessions.killUser(user)
+}
+
+// findUser returns the user of name with key, nil if not found or the key
+// has changed.
+func (opts *ServerOptions) findUser(name string, key ray.Key) *User {
+	for i := range opts.Users {
+		if opts.Users[i].Name == name && opts.Users[i].Key == key {
+			return &opts.Users[i]
+		}
+	}
+	return nil
+}
+
+func (s *Server) serveControlLink(ctx context.Context, conn net.Conn, lhost string) {
+	opts := s.opts.Load()
+	sf := opts.Stat
+	id := cnt.Tick()
+	log := connLog(opts.Log.Named("ctrl"), strconv.Itoa(id), "", conn)
+	log.Event("ctrl_link_accepted").Infof("New control link %s. ", util.ConnStr(conn))
+
+	// The quota of the IP is taken before negotiating, which is costly, so
+	// that it also limits pending negotiations of the IP.
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !s.ctrlLinksByIP.Acquire(ip, opts.MaxCtrlLinksPerIP) {
+		log.Event("ctrl_link_refused").Warnf("Too many control links from %s, closing %s. ", ip, util.ConnStr(conn))
+		util.CloseCloser(conn)
+		return
+	}
+	defer s.ctrlLinksByIP.Release(ip)
+
+	keys := make([]ray.Key, len(opts.Users))
+	for i, u := range opts.Users {
+		keys[i] = u.Key
+	}
+	rconn, i, err := ray.FromConnAny(conn, keys)
+	if err != nil {
+		handshakes.With(sideServer, "ctrl", handshakeResult(err), forwardOf(ctx), "").Inc()
+		log.Named("ray").Event("handshake_failed").Warnf("Ray negotiation on control link %s failed: %v", util.ConnStr(conn), err)
+		sf.WriteEvent(stat.Event{Kind: "s", ID: id, Code: "A", Forward: forwardOf(ctx), Remote: conn.RemoteAddr().String(), Error: err.Error()})
+		util.CloseCloser(conn)
+		return
+	}
+	usr := opts.Users[i]
+	handshakes.With(sideServer, "ctrl", "ok", forwardOf(ctx), usr.Name).Inc()
+	log = connLog(opts.Log.Named("ctrl"), strconv.Itoa(id), usr.Name, conn)
+	log.Debugf("Control link %s authenticated as user %s. ", util.ConnStr(rconn), usr.Name)
+	sf.WriteEvent(stat.Event{Kind: "s", ID: id, Code: "c", Forward: forwardOf(ctx), User: usr.Name, Remote: conn.RemoteAddr().String()})
+	start := time.Now()
+	var endErr error // Cause of ending, nil if closed by client or for stopping
+	defer func() {
+		sf.WriteEvent(stat.Event{Kind: "s", ID: id, Code: "e", Duration: time.Since(start).Milliseconds(), Error: errStr(endErr)})
+	}()
+
+	if !s.ctrlLinksByUser.Acquire(usr.Name, opts.MaxCtrlLinksPerUser) {
+		log.Event("ctrl_link_refused").Warnf("Too many control links of user %s, refusing %s. ", usr.Name, util.ConnStr(rconn))
+		refuseControlLink(opts, rconn, ctrl.ReplyTooManyCtrlLinks)
+		endErr = ctrl.ErrTooManyCtrlLinks
+		return
+	}
+	defer s.ctrlLinksByUser.Release(usr.Name)
+
+	member := s.ctrlLinks.Join(rconn)
+	defer member.Leave()
+	stop := context.AfterFunc(ctx, func() { util.CloseCloser(rconn) })
+	defer stop()
+
+	var pending util.Quota
+	defer s.sessions.addCtrlLink(CtrlLinkInfo{
+		ID: id, Forward: forwardOf(ctx), User: usr.Name, Remote: conn.RemoteAddr().String(),
+		Since: start, Connected: true,
+	}, &pending, rconn)()
+
+	// Requests are served in order apart from the read loop, so that pings
+	// are replied while resolving targets of requests.
+	var reqErr util.Fatal // Set before closing rconn on failure
+	serve := func(q ctrlRequest) bool {
+		opts, log := q.opts, q.log
+		log.Debugf("New port allocating request from %s type 0x%02X", conn.RemoteAddr(), q.req)
+		r := &Request{
+			Context: ctx,
+			User:    usr.Name,
+			Network: "tcp",
+			Local:   conn.LocalAddr(),
+			Remote:  conn.RemoteAddr(),
+		}
+		if q.req != ctrl.ReqTCP {
+			r.Network = "udp"
+		}
+		mux := q.req == ctrl.ReqUDPMux
+		dlID := cnt.Tick()
+		ev := stat.Event{Kind: statKind(r.Network), ID: dlID, Forward: forwardOf(ctx), User: usr.Name, Remote: conn.RemoteAddr().String()}
+		ev.Code = "n"
+		sf.WriteEvent(ev)
+		refused := func(err error) {
+			sf.WriteEvent(stat.Event{Kind: ev.Kind, ID: dlID, Code: "P", Error: err.Error()})
+		}
+
+		target, err := opts.Target, error(nil)
+		if opts.Authorize != nil {
+			target, err = opts.Authorize(r)
+		} else if target == "" {
+			err = errors.New("no target")
+		}
+		if err != nil {
+			log.Event("request_denied").Warnf("Denied %s request of user %s on control link %s: %v. ", r.Network, usr.Name, util.ConnStr(rconn), err)
+			refused(fmt.Errorf("denied: %w", err))
+			return replyRefusal(log, rconn, ctrl.ReplyDenied)
+		}
+
+		if !pending.Acquire("", opts.MaxPending) {
+			log.Event("request_refused").Warnf("Too many pending data links on control link %s, refusing %s request. ", util.ConnStr(rconn), r.Network)
+			refused(ctrl.ErrTooManyPending)
+			return replyRefusal(log, rconn, ctrl.ReplyTooManyPending)
+		}
+		if !s.relayQuota.Acquire("", opts.MaxRelays) {
+			pending.Release("")
+			log.Event("request_refused").Warnf("Too many relays, refusing %s request on control link %s. ", r.Network, util.ConnStr(rconn))
+			refused(ctrl.ErrTooManyRelays)
+			return replyRefusal(log, rconn, ctrl.ReplyTooManyRelays)
+		}
+
+		l, err := util.ListenMultipleTCP("tcp", net.JoinHostPort(lhost, "0"))
+		if err != nil {
+			pending.Release("")
+			s.relayQuota.Release("")
+			log.Errf("Allocate port for new data link failed: %v. ", err)
+			refused(err)
+			reqErr.Set(err)
+			util.CloseCloser(rconn)
+			return false
+		}
+
+		port, err := util.ParsePortFromAddr(l.Addr())
+		if err != nil {
+			panic(fmt.Errorf("IMPOSSIBLE! Failed to parse port from listener address %s: %w", l.Addr(), err))
+		}
+
+		portBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(portBuf, uint16(port))
+		if _, err := rconn.Write(portBuf); err != nil {
+			pending.Release("")
+			s.relayQuota.Release("")
+			util.CloseCloser(l)
+			log.Err("Failed to reply allocated port on control link " + util.ConnStr(rconn) + ". ")
+			refused(err)
+			reqErr.Set(err)
+			util.CloseCloser(rconn)
+			return false
+		}
+
+		log.Event("port_allocated").Debugf("Port %d allocated on control link %s, start serving. ", port, util.ConnStr(rconn))
+		sf.WriteEvent(stat.Event{Kind: ev.Kind, ID: dlID, Code: "p"})
+		dl := &dataLink{
+			id:       dlID,
+			mux:      mux,
+			opts:     opts,
+			r:        r,
+			key:      usr.Key,
+			target:   target,
+			l:        l,
+			accepted: func() { pending.Release("") },
+			member:   s.relays.Join(l),
+			sessions: &s.sessions,
+		}
+		go func() {
+			defer dl.member.Leave()
+			defer s.relayQuota.Release("")
+			dl.serve()
+		}()
+		return true
+	}
+	reqs := make(chan ctrlRequest, ctrlRequestBacklog)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		for q := range reqs {
+			if !serve(q) {
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(reqs)
+		<-served
+	}()
+
+	buf := make([]byte, 16)
+	for {
+		n, err := rconn.Read(buf)
+		if err != nil {
+			log := log.Event("ctrl_link_closed")
+			if errors.Is(err, io.EOF) {
+				log.Debugf("Finished serving control link %s: EOF", util.ConnStr(rconn))
+			} else if s.closed.Get() || ctx.Err() != nil {
+				log.Debugf("Closed control link %s for stopping. ", util.ConnStr(rconn))
+			} else if errors.Is(err, net.ErrClosed) {
+				// Closed on failure of serving requests, which is logged.
+				endErr = reqErr.Get()
+			} else {
+				log.Errf(
+					"Error reading request on control link %s, closing: %v. ",
+					util.ConnStr(rconn), err,
+				)
+				endErr = err
+			}
+			util.CloseCloser(rconn)
+			return
+		}
+
+		if latest := s.opts.Load(); latest != opts {
+			if latest.findUser(usr.Name, usr.Key) == nil {
+				log.Event("ctrl_link_closed").Infof("User of control link %s is removed, closing. ", util.ConnStr(rconn))
+				endErr = errors.New("user removed")
+				util.CloseCloser(rconn)
+				return
+			}
+			opts = latest
+			log = connLog(opts.Log.Named("ctrl"), strconv.Itoa(id), usr.Name, conn)
+		}
+
+		for i := 0; i < n; i++ {
+			if buf[i] == ctrl.ReqPing {
+				if _, err := rconn.Write([]byte{0x00, 0x00, ctrl.ReplyPong}); err != nil {
+					log.Errf("Failed to reply heartbeat on control link %s: %v. ", util.ConnStr(rconn), err)
+					endErr = err
+					util.CloseCloser(rconn)
+					return
+				}
+				continue
+			}
+			select {
+			case reqs <- ctrlRequest{buf[i], opts, log}:
+			case <-served:
+				// Failed, so is the next read.
+			}
+		}
+	}
+}
+
+// ctrlRequestBacklog is the max number of requests of a control link waiting
+// to be served.
+const ctrlRequestBacklog = 16
+
+// ctrlRequest is a request read on a control link, served with the options
+// in effect by then.
+type ctrlRequest struct {
+	req  byte
+	opts *ServerOptions
+	log  log.Logger
+}
+
+// replyRefusal replies code on the control link rconn, and closes it if
+// failed.
+func replyRefusal(log log.Logger, rconn net.Conn, code byte) bool {
+	if _, err := rconn.Write([]byte{0x00, 0x00, code}); err != nil {
+		log.Errf("Failed to reply refusal on control link %s: %v. ", util.ConnStr(rconn), err)
+		util.CloseCloser(rconn)
+		return false
+	}
+	return true
+}
+
+// refuseControlLink waits for the first request on rconn, replies code to it
+// and closes rconn.
+func refuseControlLink(opts *ServerOptions, rconn net.Conn, code byte) {
+	defer util.CloseCloser(rconn)
+	if opts.DataLinkTimeout > 0 {
+		rconn.SetDeadline(time.Now().Add(opts.DataLinkTimeout))
+	}
+	buf := make([]byte, 1)
+	if _, err := rconn.Read(buf); err != nil {
+		return
+	}
+	replyRefusal(opts.Log.Named("ctrl"), rconn, code)
+}
+
+// DialTarget dials target for network of a request, "unix:" followed by a
+// socket path is dialed as a unix domain socket for TCP.
+func DialTarget(ctx context.Context, network, target string) (net.Conn, error) {
+	var d net.Dialer
+	if path, ok := util.SplitUnixAddr(target); ok {
+		if network != "tcp" {
+			return nil, fmt.Errorf("cannot relay %s to unix domain socket %s", network, path)
+		}
+		return d.DialContext(ctx, "unix", path)
+	}
+	return d.DialContext(ctx, network, target)
+}
+
+// dataLink is a data link allocated on a control link.
+type dataLink struct {
+	id       int  // In logs and statistic files
+	mux      bool // Of ctrl.ReqUDPMux, dialing outbounds per flow
+	opts     *ServerOptions
+	r        *Request
+	key      ray.Key
+	target   string // Returned by Authorize
+	l        *util.MultiListenerTCP
+	accepted func()       // Called once the listener stops accepting
+	member   *util.Member // Connections of the data link are attached to it
+	sessions *sessions    // The relay is tracked in it
+	log      log.Logger   // Attaching fields of the data link once accepted
+}
+
+func (dl *dataLink) dial() (net.Conn, error) {
+	if dl.opts.Dial != nil {
+		return dl.opts.Dial(dl.r.Context, dl.r, dl.target)
+	}
+	return DialTarget(dl.r.Context, dl.r.Network, dl.target)
+}
+
+// event writes e of the data link to the statistic file.
+func (dl *dataLink) event(e stat.Event) {
+	e.Kind, e.ID = statKind(dl.r.Network), dl.id
+	dl.opts.Stat.WriteEvent(e)
+}
+
+// track tracks the relay of the data link connected from remote, with bytes
+// counted in up and down. The returned function stops tracking it.
+func (dl *dataLink) track(remote net.Addr, up, down *atomic.Int64) func() {
+	return dl.sessions.addRelay(RelayInfo{
+		ID: dl.id, Network: dl.r.Network, Forward: forwardOf(dl.r.Context), User: dl.r.User,
+		Remote: remote.String(), Since: time.Now(),
+	}, up, down, dl.member)
+}
+
+// serve dials the outbound while waiting for the client to connect, then
+// relays between them.
+func (dl *dataLink) serve() {
+	dl.log = dl.opts.Log.Named("relay").With(log.Fields{User: dl.r.User})
+	log := dl.log
+	l := dl.l
+
+	dialed := make(chan struct{})
+	var outbound net.Conn
+	var dialErr error
+	if dl.mux {
+		close(dialed)
+	} else {
+		go func() {
+			outbound, dialErr = dl.dial()
+			close(dialed)
+		}()
+	}
+
+	if dl.opts.DataLinkTimeout > 0 {
+		err := l.SetDeadline(time.Now().Add(dl.opts.DataLinkTimeout))
+		if err != nil {
+			log.Warnf("Failed to set deadline for listener %s: %v. ", l.Addr(), err)
+		}
+	}
+	c, err := l.Accept()
+	dl.accepted()
+	util.CloseCloser(l)
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			acceptTimeouts.With(dl.r.Network, forwardOf(dl.r.Context), dl.r.User).Inc()
+			log.Event("data_link_timeout").Warnf("Timed out listening for %s data link at %s. ", dl.r.Network, l.Addr())
+		} else {
+			log.Errf("Failed to accept %s data link on %s: %v", dl.r.Network, l.Addr(), err)
+		}
+		dl.event(stat.Event{Code: "R", Error: "accept: " + err.Error()})
+		<-dialed
+		if outbound != nil {
+			util.CloseCloser(outbound)
+		}
+		return
+	}
+	dl.member.Attach(c)
+	dl.log = connLog(dl.opts.Log.Named("relay"), strconv.Itoa(dl.id), dl.r.User, c)
+	log = dl.log
+
+	<-dialed
+	if dialErr != nil {
+		log.Event("dial_failed").Errf("Error dial outbound for %s data link %s.\n%v", dl.r.Network, util.ConnStr(c), dialErr)
+		dl.event(stat.Event{Code: "R", Remote: c.RemoteAddr().String(), Error: "dial outbound: " + dialErr.Error()})
+		util.CloseCloser(c)
+		return
+	}
+	if outbound != nil {
+		dl.member.Attach(outbound)
+	}
+
+	active := relaysActive.With(sideServer, dl.r.Network, forwardOf(dl.r.Context), dl.r.User)
+	active.Inc()
+	defer active.Dec()
+
+	var up, down ratelimit.Limiters
+	if dl.opts.Limiters != nil {
+		up, down = dl.opts.Limiters(dl.r)
+	}
+	switch {
+	case dl.r.Network == "tcp":
+		dl.relayTCP(c, outbound, up, down)
+	case dl.mux:
+		dl.relayUDPMux(c, up, down)
+	default:
+		dl.relayUDP(c, outbound, up, down)
+	}
+}
+
+func (dl *dataLink) relayTCP(c, outbound net.Conn, up, down ratelimit.Limiters) {
+	log := dl.log
+	defer util.CloseCloser(outbound)
+
+	fwd := forwardOf(dl.r.Context)
+	rconn, err := ray.FromConnKey(c, dl.key)
+	handshakes.With(sideServer, "data", handshakeResult(err), fwd, dl.r.User).Inc()
+	if err != nil {
+		log.Named("ray").Event("handshake_failed").Errf("Ray negotiation on TCP data link %s failed: %v", util.ConnStr(c), err)
+		dl.event(stat.Event{Code: "R", Remote: c.RemoteAddr().String(), Error: "negotiate: " + err.Error()})
+		util.CloseCloser(c)
+		return
+	}
+	dl.event(stat.Event{Code: "r", Remote: c.RemoteAddr().String()})
+	start := time.Now()
+	log.Debugf("TCP data link established: %s. ", util.ConnStr(rconn))
+	defer util.CloseCloser(rconn)
+
+	log.Event("relay_started").Debugf("Relaying for TCP data link %s started. ", util.ConnStr(rconn))
+	counted := &countConn{
+		Conn:    rconn,
+		read:    relayBytes.With(sideServer, "up", fwd, dl.r.User),
+		written: relayBytes.With(sideServer, "down", fwd, dl.r.User),
+	}
+	defer dl.track(c.RemoteAddr(), &counted.nRead, &counted.nWritten)()
+	err = util.Relay(ratelimit.NewConn(counted, up, down), outbound)
+	ev := stat.Event{Code: "l", Up: counted.nRead.Load(), Down: counted.nWritten.Load(), Duration: time.Since(start).Milliseconds()}
+	if err != nil {
+		countIntegrity(err, sideServer, fwd, dl.r.User)
+		log.Event("relay_failed").Warnf("Error relaying TCP for inbound %s: \n%v", util.ConnStr(rconn), err)
+		ev.Code, ev.Error = "L", err.Error()
+	} else {
+		log.Event("relay_finished").Debugf("Relay TCP finished for inbound %s. ", util.ConnStr(rconn))
+	}
+	dl.event(ev)
+}
+
+func (dl *dataLink) relayUDP(tcpIn, udpOut net.Conn, up, down ratelimit.Limiters) {
+	log := dl.log.Named("udp")
+	defer util.CloseCloser(tcpIn)
+	defer util.CloseCloser(udpOut)
+
+	laddr, _ := net.ResolveUDPAddr("udp", tcpIn.LocalAddr().String())
+	udpIn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		log.Errf("Failed to dial UDP inbound for UDP data link %s: %v. ", util.ConnStr(tcpIn), err)
+		dl.event(stat.Event{Code: "R", Remote: tcpIn.RemoteAddr().String(), Error: "listen UDP: " + err.Error()})
+		return
+	}
+	defer util.CloseCloser(udpIn)
+
+	fwd := forwardOf(dl.r.Context)
+	r, err := ray.NegotiateKey(tcpIn, dl.key)
+	handshakes.With(sideServer, "data", handshakeResult(err), fwd, dl.r.User).Inc()
+	if err != nil {
+		log.Named("ray").Event("handshake_failed").Errf("Ray negotiation failed for UDP data link %s: %v. ", util.ConnStr(tcpIn), err)
+		dl.event(stat.Event{Code: "R", Remote: tcpIn.RemoteAddr().String(), Error: "negotiate: " + err.Error()})
+		return
+	}
+	dl.event(stat.Event{Code: "r", Remote: tcpIn.RemoteAddr().String()})
+	start := time.Now()
+	var nUp, nDown atomic.Int64
+
+	ru := ray.NewRayUDP(udpIn, false, tcpIn, r)
+	ru.OnOversize = countOversize(sideServer, fwd, dl.r.User)
+	log.Event("relay_started").Debugf("UDP data link %s established. ", util.ConnStr(ru))
+	dl.member.Attach(udpIn)
+	defer dl.track(tcpIn.RemoteAddr(), &nUp, &nDown)()
+
+	upBytes := relayBytes.With(sideServer, "up", fwd, dl.r.User)
+	downBytes := relayBytes.With(sideServer, "down", fwd, dl.r.User)
+	fatal := util.Fatal{}
+	oversize := oversizeFeedback{log: log}
+	go func() {
+		buffer := make([]byte, 65535)
+		wRetry := util.Retry{Max: udpIoRetries}
+		rRetry := util.Retry{Max: udpIoRetries}
+		for {
+			n, err := ru.Read(buffer)
+			if n > 0 {
+				up.WaitN(n)
+				_, werr := udpOut.Write(buffer[:n])
+				if werr == nil {
+					upBytes.Add(float64(n))
+					nUp.Add(int64(n))
+				}
+				if wRetry.Test(werr) {
+					fatal.Set(werr)
+					return
+				}
+			}
+			countIntegrity(err, sideServer, fwd, dl.r.User)
+			if rRetry.Test(err) {
+				fatal.Set(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		buffer := make([]byte, 65535)
+		wRetry := util.Retry{Max: udpIoRetries}
+		rRetry := util.Retry{Max: udpIoRetries}
+		for {
+			n, err := udpOut.Read(buffer)
+			if n > 0 {
+				down.WaitN(n)
+				_, werr := ru.Write(buffer[:n])
+				if e := tooLarge(werr); e != nil {
+					log.Debugf("Dropped datagram from target %s: %v. ", udpOut.RemoteAddr(), werr)
+					oversize.report(udpOut.RemoteAddr(), udpOut.LocalAddr(), e)
+					continue
+				}
+				if werr == nil {
+					downBytes.Add(float64(n))
+					nDown.Add(int64(n))
+				}
+				if wRetry.Test(werr) {
+					fatal.Set(werr)
+					return
+				}
+			}
+			if rRetry.Test(err) {
+				fatal.Set(err)
+				return
+			}
+		}
+	}()
+
+	<-fatal.Chan()
+	ev := stat.Event{Code: "L", Up: nUp.Load(), Down: nDown.Load()}
+	if err := ru.ErrTCP(); err != nil {
+		if errors.Is(err, io.EOF) {
+			log.Event("relay_finished").Debugf("Relay UDP for inbound %s finished: EOF", util.ConnStr(ru))
+			ev.Code = "l"
+		} else {
+			log.Event("relay_failed").Errf("Error relaying UDP for inbound %s: %v", util.ConnStr(ru), err)
+			ev.Error = err.Error()
+		}
+	} else {
+		log.Event("relay_failed").Errf("Error relaying UDP for inbound %s: %v", util.ConnStr(ru), fatal.Get())
+		ev.Error = errStr(fatal.Get())
+	}
+	ev.Duration = time.Since(start).Milliseconds()
+	dl.event(ev)
+}
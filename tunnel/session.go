@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fishBone000/xcat/util"
+)
+
+// CtrlLinkInfo describes a control link being served.
+type CtrlLinkInfo struct {
+	ID        int       `json:"id"`
+	Forward   string    `json:"forward"`
+	User      string    `json:"user"`
+	Remote    string    `json:"remote"` // Of the client on server side, the server on client side
+	Since     time.Time `json:"since"`
+	Connected bool      `json:"connected"` // Always true on server side
+	Pending   int       `json:"pending"`   // Data links allocated but not connected, server side only
+
+	// Client side only.
+	Error    string        `json:"error,omitempty"` // Why down
+	Connects int           `json:"connects"`        // Times connected so far
+	Failures int           `json:"failures"`        // Rounds of connecting attempts failed since down
+	RTT      time.Duration `json:"rtt_ns"`          // Smoothed round trip time of heartbeats, 0 if none
+	Jitter   time.Duration `json:"jitter_ns"`
+	History  []LinkChange  `json:"history,omitempty"`
+}
+
+// LinkChange is a change of state of a control link.
+type LinkChange struct {
+	Time      time.Time `json:"time"`
+	Connected bool      `json:"connected"`
+	Error     string    `json:"error,omitempty"` // Why broken
+}
+
+// RelayInfo describes a relay being served.
+type RelayInfo struct {
+	ID      int       `json:"id"`
+	Network string    `json:"network"` // "tcp" or "udp"
+	Forward string    `json:"forward"`
+	User    string    `json:"user"`
+	Remote  string    `json:"remote"` // Of the inbound on client side, the data link on server side
+	Since   time.Time `json:"since"`
+	Up      int64     `json:"up"`   // Bytes from client to host
+	Down    int64     `json:"down"` // Bytes from host to client
+}
+
+// sessions tracks control links and relays being served, so that they can
+// be listed and killed.
+type sessions struct {
+	mux       sync.Mutex
+	ctrlLinks map[int]*ctrlLinkSession
+	relays    map[int]*relaySession
+}
+
+type ctrlLinkSession struct {
+	info    CtrlLinkInfo
+	pending *util.Quota
+	conn    io.Closer
+}
+
+type relaySession struct {
+	info     RelayInfo
+	up, down *atomic.Int64
+	member   *util.Member
+}
+
+// addCtrlLink tracks a control link closed by conn, with data links pending
+// counted in pending. The returned function stops tracking it.
+func (ss *sessions) addCtrlLink(info CtrlLinkInfo, pending *util.Quota, conn io.Closer) func() {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	if ss.ctrlLinks == nil {
+		ss.ctrlLinks = make(map[int]*ctrlLinkSession)
+	}
+	ss.ctrlLinks[info.ID] = &ctrlLinkSession{info, pending, conn}
+	return func() {
+		ss.mux.Lock()
+		delete(ss.ctrlLinks, info.ID)
+		ss.mux.Unlock()
+	}
+}
+
+// addRelay tracks a relay of member, with bytes counted in up and down.
+// The returned function stops tracking it.
+func (ss *sessions) addRelay(info RelayInfo, up, down *atomic.Int64, member *util.Member) func() {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	if ss.relays == nil {
+		ss.relays = make(map[int]*relaySession)
+	}
+	ss.relays[info.ID] = &relaySession{info, up, down, member}
+	return func() {
+		ss.mux.Lock()
+		delete(ss.relays, info.ID)
+		ss.mux.Unlock()
+	}
+}
+
+func (ss *sessions) ctrlLinkInfos() []CtrlLinkInfo {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	infos := make([]CtrlLinkInfo, 0, len(ss.ctrlLinks))
+	for _, c := range ss.ctrlLinks {
+		info := c.info
+		info.Pending = c.pending.Used("")
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+func (ss *sessions) relayInfos() []RelayInfo {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	infos := make([]RelayInfo, 0, len(ss.relays))
+	for _, r := range ss.relays {
+		info := r.info
+		info.Up, info.Down = r.up.Load(), r.down.Load()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// killRelay closes the relay of id, false if not found.
+func (ss *sessions) killRelay(id int) bool {
+	ss.mux.Lock()
+	r := ss.relays[id]
+	ss.mux.Unlock()
+	if r == nil {
+		return false
+	}
+	r.member.Close()
+	return true
+}
+
+// killUser closes control links and relays of user, and returns how many
+// were closed.
+func (ss *sessions) killUser(user string) int {
+	var closers []io.Closer
+	ss.mux.Lock()
+	for _, c := range ss.ctrlLinks {
+		if c.info.User == user {
+			closers = append(closers, c.conn)
+		}
+	}
+	for _, r := range ss.relays {
+		if r.info.User == user {
+			closers = append(closers, r.member)
+		}
+	}
+	ss.mux.Unlock()
+	for _, c := range closers {
+		util.CloseCloser(c)
+	}
+	return len(closers)
+}
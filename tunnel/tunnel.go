@@ -0,0 +1,82 @@
+// Package tunnel implements the server and the client of xcat, so that they
+// can be embedded in other programs.
+//
+// A client accepts inbounds and relays each one of them through a data link
+// to the server, which relays it to the outbound. Data links are allocated by
+// requests on the control link between them.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/fishBone000/xcat/ctrl"
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/ratelimit"
+	"github.com/fishBone000/xcat/stat"
+)
+
+// ErrClosed is returned by Serve after Close.
+var ErrClosed = errors.New("tunnel: closed")
+
+// Request is a request of a data link.
+type Request struct {
+	Context context.Context // Passed to Serve
+	User    string          // Authenticated user on server side, own user on client side
+	Network string          // "tcp" or "udp"
+	// On server side, addresses of the control link.
+	// On client side, addresses of the inbound.
+	Local, Remote net.Addr
+}
+
+// LimitersFunc returns bandwidth limiters of a new relay of r, up is the
+// direction from client to host.
+type LimitersFunc func(r *Request) (up, down ratelimit.Limiters)
+
+// IsRefused reports whether err is a refusal replied by the server, rather
+// than a failure of the control link.
+func IsRefused(err error) bool {
+	var re ctrl.ReplyError
+	return errors.As(err, &re)
+}
+
+// IsUnreachable reports whether err is returned for the server being
+// unreachable, see [ctrl.UnreachableError].
+func IsUnreachable(err error) bool {
+	var ue *ctrl.UnreachableError
+	return errors.As(err, &ue)
+}
+
+// Identifiers of connections in logs and statistic files, inbounds on
+// client side, control links and data links on server side.
+var cnt stat.Counter
+
+// statKind is the kind of connections of network in statistic files.
+func statKind(network string) string {
+	if network == "udp" {
+		return "u"
+	}
+	return "t"
+}
+
+// errStr returns the message of err, empty if nil.
+func errStr(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// connLog returns l attaching id, user and addresses of conn to entries.
+func connLog(l log.Logger, id, user string, conn interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}) log.Logger {
+	return l.With(log.Fields{
+		ConnID: id,
+		User:   user,
+		Local:  conn.LocalAddr().String(),
+		Remote: conn.RemoteAddr().String(),
+	})
+}
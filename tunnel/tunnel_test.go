@@ -0,0 +1,218 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fishBone000/xcat/ctrl"
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/ray"
+)
+
+var testKey = ray.NewKey([]byte("alice"), []byte("secret"))
+
+// listen listens on a TCP port of loopback.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// echo serves TCP echo on l until it's closed.
+func echo(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+	}
+}
+
+// events returns a Logger recording event names of entries, and a function
+// reporting whether an event has been recorded.
+func events() (log.Logger, func(name string) bool) {
+	var mux sync.Mutex
+	seen := make(map[string]bool)
+	l := func(e *log.Entry) {
+		mux.Lock()
+		seen[e.Fields.Event] = true
+		mux.Unlock()
+	}
+	return l, func(name string) bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return seen[name]
+	}
+}
+
+// tunnel starts a server with opts and a client of it, and returns the
+// address of the client. Both stop once the test ends.
+func tunnel(t *testing.T, opts *ServerOptions, cliLog log.Logger) string {
+	t.Helper()
+	opts.Users = []User{{Name: "alice", Key: testKey}}
+	srv := NewServer(opts)
+	sl := listen(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	srvDone := make(chan error, 1)
+	go func() { srvDone <- srv.Serve(ctx, sl) }()
+
+	cli := NewClient(&ClientOptions{Server: sl.Addr().String(), User: "alice", Key: testKey, CtrlLinkTimeout: 5 * time.Second, Log: cliLog})
+	cl := listen(t)
+	cliDone := make(chan error, 1)
+	go func() { cliDone <- cli.Serve(ctx, cl) }()
+
+	t.Cleanup(func() {
+		cli.Close()
+		cancel()
+		srv.Close()
+		for _, done := range []chan error{cliDone, srvDone} {
+			if err := <-done; err != nil {
+				t.Errorf("serve: %v", err)
+			}
+		}
+	})
+	return cl.Addr().String()
+}
+
+func TestTCPRelay(t *testing.T) {
+	target := listen(t)
+	defer target.Close()
+	go echo(target)
+	addr := tunnel(t, &ServerOptions{Target: target.Addr().String()}, nil)
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		want := "hello through xcat"
+		if _, err := c.Write([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+		c.Close()
+	}
+}
+
+func TestDenied(t *testing.T) {
+	authorize := func(r *Request) (string, error) {
+		return "", errors.New("not for you")
+	}
+	defer log.SetLevels(log.Levels())
+	log.SetLevels(map[string]int{"relay": log.LvlWarn})
+	cliLog, seen := events()
+	addr := tunnel(t, &ServerOptions{Authorize: authorize}, cliLog)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want inbound closed, got %v", err)
+	}
+	if !seen("request_refused") {
+		t.Error("refusal not logged by client")
+	}
+}
+
+func TestDeniedReply(t *testing.T) {
+	srv := NewServer(&ServerOptions{
+		Users:     []User{{Name: "alice", Key: testKey}},
+		Authorize: func(r *Request) (string, error) { return "", errors.New("not for you") },
+	})
+	defer srv.Close()
+	l := listen(t)
+	go srv.Serve(context.Background(), l)
+
+	cl := ctrl.NewCtrlLinkKey(l.Addr().String(), testKey, 5*time.Second)
+	defer cl.Close()
+	for i := 0; i < 2; i++ {
+		_, err := cl.GetPortTCP()
+		if !errors.Is(err, ctrl.ErrDenied) || !IsRefused(err) {
+			t.Fatalf("want denied, got %v", err)
+		}
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	target := listen(t)
+	defer target.Close()
+	go echo(target)
+	before := runtime.NumGoroutine()
+
+	srv := NewServer(&ServerOptions{Users: []User{{Name: "alice", Key: testKey}}, Target: target.Addr().String()})
+	sl := listen(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	srvDone := make(chan error, 1)
+	go func() { srvDone <- srv.Serve(ctx, sl) }()
+	cli := NewClient(&ClientOptions{Server: sl.Addr().String(), Key: testKey, CtrlLinkTimeout: 5 * time.Second})
+	cl := listen(t)
+	cliDone := make(chan error, 1)
+	go func() { cliDone <- cli.Serve(context.Background(), cl) }()
+
+	// A control link and a finished relay.
+	c, err := net.Dial("tcp", cl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("x"))
+	if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	cancel()
+	select {
+	case err := <-srvDone:
+		if err != nil {
+			t.Errorf("server: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not stopped by ctx")
+	}
+	cli.Close()
+	select {
+	case err := <-cliDone:
+		if err != nil {
+			t.Errorf("client: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client not stopped by Close")
+	}
+	srv.Close()
+	if err := srv.Serve(context.Background(), listen(t)); err != ErrClosed {
+		t.Errorf("want ErrClosed after Close, got %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left over %d:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
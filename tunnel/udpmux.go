@@ -0,0 +1,585 @@
+package tunnel
+
+// # Multiplexed UDP data links
+//
+// A UDP data link allocated by [ctrl.ReqUDPMux] carries many flows, each a
+// UDP inbound on client side and an outbound on server side. Every Ray
+// packet on it is a frame:
+//
+//	+---------+------+-------  ...  -------+
+//	| FLOW ID | TYPE |         BODY         |
+//	+---------+------+-------  ...  -------+
+//	     4        1            VAR
+//
+// FLOW ID is chosen by the client, and TYPE is one of:
+//
+//	DATA  (0x00): BODY is a datagram of the flow.
+//	OPEN  (0x01): Sent by the client instead of DATA until the server replied
+//	              on the flow, the flow is created on the first one.
+//	              BODY is IDLE (4), DLEN (1), DEST (DLEN) and the datagram.
+//	CLOSE (0x02): The flow is closed, BODY is the reason if any.
+//
+// IDLE is the idle timeout of the flow in milliseconds, 0 for none. As a
+// CLOSE may be lost, the server closes flows idle for it too, or for its
+// default if 0, up to a max. DEST is the
+// destination of the flow, empty for the target of the data link, which is
+// the only one allowed for now.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fishBone000/xcat/ctrl"
+	"github.com/fishBone000/xcat/log"
+	"github.com/fishBone000/xcat/metrics"
+	"github.com/fishBone000/xcat/ratelimit"
+	"github.com/fishBone000/xcat/ray"
+	"github.com/fishBone000/xcat/stat"
+	"github.com/fishBone000/xcat/util"
+)
+
+const (
+	frameData  byte = 0x00
+	frameOpen  byte = 0x01
+	frameClose byte = 0x02
+)
+
+const frameHeaderSize = 5
+
+// maxUDPFlows is the max flows on a multiplexed UDP data link.
+const maxUDPFlows = 4096
+
+// flowQueueSize is how many datagrams to a flow are queued, on client side
+// and on server side until its outbound is dialed, later ones are dropped if
+// it's full.
+const flowQueueSize = 64
+
+// IDLE of flows is taken as defaultFlowIdle if 0, and clamped to
+// maxFlowIdle, so that clients can't keep flows forever.
+const (
+	defaultFlowIdle = 180 * time.Second
+	maxFlowIdle     = 10 * time.Minute
+)
+
+// errFlowIdle is the reason of closing flows idle for their timeouts.
+var errFlowIdle = errors.New("idle")
+
+type frame struct {
+	flow uint32
+	typ  byte
+	idle time.Duration // OPEN only
+	dest string        // OPEN only
+	body []byte
+}
+
+func (f *frame) marshal() []byte {
+	b := make([]byte, frameHeaderSize, frameHeaderSize+5+len(f.dest)+len(f.body))
+	binary.BigEndian.PutUint32(b, f.flow)
+	b[4] = f.typ
+	if f.typ == frameOpen {
+		b = binary.BigEndian.AppendUint32(b, uint32(f.idle.Milliseconds()))
+		b = append(b, byte(len(f.dest)))
+		b = append(b, f.dest...)
+	}
+	return append(b, f.body...)
+}
+
+func parseFrame(p []byte) (*frame, error) {
+	if len(p) < frameHeaderSize {
+		return nil, fmt.Errorf("short frame (%d bytes)", len(p))
+	}
+	f := &frame{flow: binary.BigEndian.Uint32(p), typ: p[4], body: p[frameHeaderSize:]}
+	switch f.typ {
+	case frameData, frameClose:
+	case frameOpen:
+		b := f.body
+		if len(b) < 5 || len(b) < 5+int(b[4]) {
+			return nil, errors.New("short OPEN frame")
+		}
+		f.idle = time.Duration(binary.BigEndian.Uint32(b)) * time.Millisecond
+		f.dest = string(b[5 : 5+int(b[4])])
+		f.body = b[5+int(b[4]):]
+	default:
+		return nil, fmt.Errorf("unknown frame type 0x%02X", f.typ)
+	}
+	return f, nil
+}
+
+// udpAssoc is a multiplexed UDP data link on client side.
+type udpAssoc struct {
+	ru     *ray.RayUDP
+	idle   time.Duration // Of flows, also closing the association once no flows left
+	log    log.Logger
+	active *metrics.Value
+
+	mux   sync.Mutex
+	flows map[uint32]*udpFlow
+	next  uint32
+	timer *time.Timer // Closing the association without flows
+	dead  util.Fatal
+}
+
+// udpFlow is a flow of a UDP inbound on a udpAssoc, relaying datagrams like
+// a [ray.RayUDP].
+type udpFlow struct {
+	a      *udpAssoc
+	id     uint32
+	in     chan []byte
+	opened atomic.Bool // Replied by the server
+	closed util.Fatal
+}
+
+// openFlow opens a flow of inbound on the association of st. A new
+// association is made on demand, whose port query and establishment are
+// written to the statistic file as those of inbound with id.
+func (st *clientState) openFlow(ctx context.Context, inbound net.Addr, id int, log log.Logger) (*udpFlow, bool) {
+	st.assocMux.Lock()
+	defer st.assocMux.Unlock()
+	if a := st.assoc; a != nil {
+		if f := a.open(); f != nil {
+			st.opts.Stat.Write("u", id, "p")
+			return f, true
+		}
+	}
+	ru, ok := st.newUDPDataLink(ctx, ctrl.ReqUDPMux, inbound, id, log)
+	if !ok {
+		return nil, false
+	}
+	a := &udpAssoc{
+		ru:     ru,
+		idle:   st.opts.UDPTimeout,
+		log:    st.opts.Log.Named("udp"),
+		active: udpFlows.With(sideClient, st.opts.Name, st.opts.User),
+		flows:  make(map[uint32]*udpFlow),
+	}
+	log.Debugf("Multiplexed UDP data link %s established. ", util.ConnStr(ru))
+	st.assoc = a
+	go a.run()
+	return a.open(), true
+}
+
+// open adds a flow, nil if a is dead.
+func (a *udpAssoc) open() *udpFlow {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if isSet(&a.dead) || len(a.flows) >= maxUDPFlows {
+		return nil
+	}
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.next++
+	f := &udpFlow{a: a, id: a.next, in: make(chan []byte, flowQueueSize)}
+	a.flows[f.id] = f
+	a.active.Inc()
+	return f
+}
+
+// remove removes f, a is closed after idle without flows.
+func (a *udpAssoc) remove(f *udpFlow) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if a.flows[f.id] != f {
+		return
+	}
+	delete(a.flows, f.id)
+	a.active.Dec()
+	if len(a.flows) == 0 && a.timer == nil {
+		a.timer = time.AfterFunc(a.idle, func() {
+			a.mux.Lock()
+			empty := len(a.flows) == 0
+			a.mux.Unlock()
+			if empty {
+				a.close(nil)
+			}
+		})
+	}
+}
+
+// close closes a and its flows with err.
+func (a *udpAssoc) close(err error) {
+	if !a.dead.Set(err) {
+		return
+	}
+	util.CloseCloser(a.ru)
+	a.mux.Lock()
+	flows := a.flows
+	a.flows = nil
+	a.active.Add(-float64(len(flows)))
+	a.mux.Unlock()
+	if err == nil {
+		err = net.ErrClosed
+	}
+	for _, f := range flows {
+		f.closed.Set(err)
+	}
+}
+
+// run dispatches datagrams to flows until a is closed.
+func (a *udpAssoc) run() {
+	buffer := make([]byte, 65535)
+	rRetry := util.Retry{Max: udpIoRetries}
+	for {
+		n, err := a.ru.Read(buffer)
+		if n > 0 {
+			if fr, err := parseFrame(buffer[:n]); err != nil {
+				a.log.Warnf("Invalid frame on multiplexed UDP data link %s: %v. ", util.ConnStr(a.ru), err)
+			} else {
+				a.dispatch(fr)
+			}
+		}
+		if rRetry.Test(err) {
+			if !isSet(&a.dead) {
+				a.log.Debugf("Multiplexed UDP data link %s closed: %v. ", util.ConnStr(a.ru), err)
+			}
+			a.close(err)
+			return
+		}
+	}
+}
+
+func (a *udpAssoc) dispatch(fr *frame) {
+	a.mux.Lock()
+	f := a.flows[fr.flow]
+	a.mux.Unlock()
+	if f == nil {
+		return
+	}
+	switch fr.typ {
+	case frameData:
+		f.opened.Store(true)
+		select {
+		case f.in <- append([]byte(nil), fr.body...):
+		default:
+		}
+	case frameClose:
+		if string(fr.body) == errFlowIdle.Error() {
+			f.closed.Set(fmt.Errorf("flow closed by server: %w", errFlowIdle))
+		} else {
+			f.closed.Set(fmt.Errorf("flow closed by server: %s", fr.body))
+		}
+		a.remove(f)
+	}
+}
+
+func (f *udpFlow) Read(b []byte) (int, error) {
+	select {
+	case p := <-f.in:
+		return copy(b, p), nil
+	case <-f.closed.Chan():
+		if err := f.closed.Get(); err != nil {
+			return 0, err
+		}
+		return 0, net.ErrClosed
+	}
+}
+
+func (f *udpFlow) Write(b []byte) (int, error) {
+	if isSet(&f.closed) {
+		return 0, net.ErrClosed
+	}
+	fr := &frame{flow: f.id, typ: frameData, body: b}
+	if !f.opened.Load() {
+		fr.typ, fr.idle = frameOpen, f.a.idle
+	}
+	if _, err := f.a.ru.Write(fr.marshal()); err != nil {
+		var e *ray.DatagramTooLargeError
+		if errors.As(err, &e) {
+			err = &ray.DatagramTooLargeError{Size: len(b), MTU: e.MTU - frameHeaderSize, PathMTU: e.PathMTU}
+		}
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the flow, the server is told unless it's closed by it.
+func (f *udpFlow) Close() error {
+	if !f.closed.Set(nil) {
+		return nil
+	}
+	f.a.remove(f)
+	f.a.ru.Write((&frame{flow: f.id, typ: frameClose}).marshal())
+	return nil
+}
+
+// ErrTCP returns why the multiplexed data link was broken, if so.
+func (f *udpFlow) ErrTCP() error {
+	return f.a.ru.ErrTCP()
+}
+
+func (f *udpFlow) LocalAddr() net.Addr {
+	return f.a.ru.LocalAddr()
+}
+
+func (f *udpFlow) RemoteAddr() net.Addr {
+	return f.a.ru.RemoteAddr()
+}
+
+// udpMux serves flows of a multiplexed UDP data link on server side.
+type udpMux struct {
+	dl                 *dataLink
+	ru                 *ray.RayUDP
+	log                log.Logger
+	up, down           ratelimit.Limiters
+	upBytes, downBytes *metrics.Value
+	nUp, nDown         atomic.Int64
+	active             *metrics.Value
+
+	mux   sync.Mutex
+	flows map[uint32]*muxFlow
+}
+
+// isSet reports whether f is set, even with nil.
+func isSet(f *util.Fatal) bool {
+	select {
+	case <-f.Chan():
+		return true
+	default:
+		return false
+	}
+}
+
+// muxFlow is a flow of a multiplexed UDP data link on server side, its
+// outbound is owned by [udpMux.run].
+type muxFlow struct {
+	id     uint32
+	in     chan []byte // Datagrams to the outbound
+	idle   time.Duration
+	timer  *time.Timer
+	closed util.Fatal
+}
+
+// relayUDPMux relays flows on a multiplexed UDP data link to their
+// outbounds.
+func (dl *dataLink) relayUDPMux(tcpIn net.Conn, up, down ratelimit.Limiters) {
+	log := dl.log.Named("udp")
+	defer util.CloseCloser(tcpIn)
+
+	laddr, _ := net.ResolveUDPAddr("udp", tcpIn.LocalAddr().String())
+	udpIn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		log.Errf("Failed to dial UDP inbound for UDP data link %s: %v. ", util.ConnStr(tcpIn), err)
+		dl.event(stat.Event{Code: "R", Remote: tcpIn.RemoteAddr().String(), Error: "listen UDP: " + err.Error()})
+		return
+	}
+	defer util.CloseCloser(udpIn)
+
+	fwd := forwardOf(dl.r.Context)
+	r, err := ray.NegotiateKey(tcpIn, dl.key)
+	handshakes.With(sideServer, "data", handshakeResult(err), fwd, dl.r.User).Inc()
+	if err != nil {
+		log.Named("ray").Event("handshake_failed").Errf("Ray negotiation failed for UDP data link %s: %v. ", util.ConnStr(tcpIn), err)
+		dl.event(stat.Event{Code: "R", Remote: tcpIn.RemoteAddr().String(), Error: "negotiate: " + err.Error()})
+		return
+	}
+	dl.event(stat.Event{Code: "r", Remote: tcpIn.RemoteAddr().String()})
+	start := time.Now()
+
+	m := &udpMux{
+		dl:        dl,
+		ru:        ray.NewRayUDP(udpIn, false, tcpIn, r),
+		log:       log,
+		up:        up,
+		down:      down,
+		upBytes:   relayBytes.With(sideServer, "up", fwd, dl.r.User),
+		downBytes: relayBytes.With(sideServer, "down", fwd, dl.r.User),
+		active:    udpFlows.With(sideServer, fwd, dl.r.User),
+		flows:     make(map[uint32]*muxFlow),
+	}
+	m.ru.OnOversize = countOversize(sideServer, fwd, dl.r.User)
+	log.Event("relay_started").Debugf("Multiplexed UDP data link %s established. ", util.ConnStr(m.ru))
+	dl.member.Attach(udpIn)
+	defer dl.track(tcpIn.RemoteAddr(), &m.nUp, &m.nDown)()
+	defer m.closeAll()
+
+	buffer := make([]byte, 65535)
+	rRetry := util.Retry{Max: udpIoRetries}
+	var fatal error
+	for {
+		n, err := m.ru.Read(buffer)
+		if n > 0 {
+			if fr, err := parseFrame(buffer[:n]); err != nil {
+				log.Warnf("Invalid frame on multiplexed UDP data link %s: %v. ", util.ConnStr(m.ru), err)
+			} else {
+				m.handle(fr)
+			}
+		}
+		countIntegrity(err, sideServer, fwd, dl.r.User)
+		if rRetry.Test(err) {
+			fatal = err
+			break
+		}
+	}
+
+	ev := stat.Event{Code: "L", Up: m.nUp.Load(), Down: m.nDown.Load()}
+	if err := m.ru.ErrTCP(); err != nil {
+		if errors.Is(err, io.EOF) {
+			log.Event("relay_finished").Debugf("Multiplexed UDP data link %s finished: EOF", util.ConnStr(m.ru))
+			ev.Code = "l"
+		} else {
+			log.Event("relay_failed").Errf("Error relaying multiplexed UDP for %s: %v", util.ConnStr(m.ru), err)
+			ev.Error = err.Error()
+		}
+	} else {
+		log.Event("relay_failed").Errf("Error relaying multiplexed UDP for %s: %v", util.ConnStr(m.ru), fatal)
+		ev.Error = errStr(fatal)
+	}
+	ev.Duration = time.Since(start).Milliseconds()
+	dl.event(ev)
+}
+
+// handle handles a frame from the client. Flows are added here so that a
+// flow is not opened twice, but their outbounds are dialed by their own
+// goroutines, not to hold up other flows.
+func (m *udpMux) handle(fr *frame) {
+	m.mux.Lock()
+	f := m.flows[fr.flow]
+	m.mux.Unlock()
+
+	switch {
+	case fr.typ == frameClose:
+		if f != nil {
+			m.close(f, nil)
+		}
+		return
+	case f == nil && fr.typ == frameData:
+		// Closed for idle while the client still relays.
+		m.send(&frame{flow: fr.flow, typ: frameClose, body: []byte("flow expired")})
+		return
+	case f == nil:
+		var err error
+		if f, err = m.open(fr); err != nil {
+			m.log.Debugf("Failed to open UDP flow %d of %s: %v. ", fr.flow, util.ConnStr(m.ru), err)
+			m.send(&frame{flow: fr.flow, typ: frameClose, body: []byte(err.Error())})
+			return
+		}
+	}
+
+	if len(fr.body) == 0 {
+		return
+	}
+	select {
+	case f.in <- append([]byte(nil), fr.body...):
+	default:
+	}
+}
+
+// open adds a flow opened by fr, whose outbound is dialed by [udpMux.run].
+func (m *udpMux) open(fr *frame) (*muxFlow, error) {
+	if fr.dest != "" && fr.dest != m.dl.target {
+		return nil, fmt.Errorf("destination %s not allowed", fr.dest)
+	}
+	m.mux.Lock()
+	n := len(m.flows)
+	m.mux.Unlock()
+	if n >= maxUDPFlows {
+		return nil, errors.New("too many flows")
+	}
+	f := &muxFlow{id: fr.flow, in: make(chan []byte, flowQueueSize), idle: fr.idle}
+	if f.idle <= 0 {
+		f.idle = defaultFlowIdle
+	}
+	f.idle = min(f.idle, maxFlowIdle)
+	f.timer = time.AfterFunc(f.idle, func() { m.close(f, errFlowIdle) })
+	m.mux.Lock()
+	m.flows[f.id] = f
+	m.mux.Unlock()
+	m.active.Inc()
+	go m.run(f)
+	return f, nil
+}
+
+// run dials the outbound of f, then relays datagrams queued to it until f is
+// closed. The outbound is not attached to the member, but closed here once
+// closeAll closes f.
+func (m *udpMux) run(f *muxFlow) {
+	out, err := m.dl.dial()
+	if err != nil {
+		m.log.Debugf("Failed to open UDP flow %d of %s: %v. ", f.id, util.ConnStr(m.ru), err)
+		m.close(f, err)
+		return
+	}
+	defer util.CloseCloser(out)
+	m.log.Debugf("Opened UDP flow %d of %s to %s. ", f.id, util.ConnStr(m.ru), out.RemoteAddr())
+	go m.relayDown(f, out)
+
+	for {
+		select {
+		case p := <-f.in:
+			m.up.WaitN(len(p))
+			if _, err := out.Write(p); err != nil {
+				m.log.Debugf("Failed to relay datagram of UDP flow %d of %s: %v. ", f.id, util.ConnStr(m.ru), err)
+				continue
+			}
+			m.upBytes.Add(float64(len(p)))
+			m.nUp.Add(int64(len(p)))
+			f.timer.Reset(f.idle)
+		case <-f.closed.Chan():
+			return
+		}
+	}
+}
+
+// relayDown relays datagrams from out, the outbound of f, to the client.
+func (m *udpMux) relayDown(f *muxFlow, out net.Conn) {
+	buffer := make([]byte, 65535-frameHeaderSize)
+	rRetry := util.Retry{Max: udpIoRetries}
+	for {
+		n, err := out.Read(buffer)
+		if n > 0 {
+			m.down.WaitN(n)
+			if err := m.send(&frame{flow: f.id, typ: frameData, body: buffer[:n]}); err == nil {
+				m.downBytes.Add(float64(n))
+				m.nDown.Add(int64(n))
+			}
+			f.timer.Reset(f.idle)
+		}
+		if rRetry.Test(err) {
+			m.close(f, err)
+			return
+		}
+	}
+}
+
+func (m *udpMux) send(fr *frame) error {
+	_, err := m.ru.Write(fr.marshal())
+	return err
+}
+
+// close closes f, and tells the client why unless reason is nil.
+func (m *udpMux) close(f *muxFlow, reason error) {
+	m.mux.Lock()
+	if m.flows[f.id] != f {
+		m.mux.Unlock()
+		return
+	}
+	delete(m.flows, f.id)
+	m.mux.Unlock()
+	m.active.Dec()
+	f.timer.Stop()
+	f.closed.Set(reason)
+	if reason != nil {
+		m.send(&frame{flow: f.id, typ: frameClose, body: []byte(reason.Error())})
+		m.log.Debugf("Closed UDP flow %d of %s: %v. ", f.id, util.ConnStr(m.ru), reason)
+	}
+}
+
+func (m *udpMux) closeAll() {
+	m.mux.Lock()
+	fs := make([]*muxFlow, 0, len(m.flows))
+	for _, f := range m.flows {
+		fs = append(fs, f)
+	}
+	m.mux.Unlock()
+	for _, f := range fs {
+		m.close(f, nil)
+	}
+}
@@ -0,0 +1,211 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fishBone000/xcat/ray"
+)
+
+func TestParseFrame(t *testing.T) {
+	for _, p := range [][]byte{
+		nil,
+		{0, 0, 0, 1},
+		{0, 0, 0, 1, 0x03},
+		{0, 0, 0, 1, frameOpen, 0, 0, 0, 0},
+		{0, 0, 0, 1, frameOpen, 0, 0, 0, 0, 3, 'a', 'b'},
+	} {
+		if _, err := parseFrame(p); err == nil {
+			t.Errorf("want error parsing % X", p)
+		}
+	}
+
+	want := &frame{flow: 7, typ: frameOpen, idle: 3 * time.Second, dest: "127.0.0.1:53", body: []byte("query")}
+	f, err := parseFrame(want.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.flow != want.flow || f.typ != want.typ || f.idle != want.idle || f.dest != want.dest || !bytes.Equal(f.body, want.body) {
+		t.Errorf("want %+v, got %+v", want, f)
+	}
+}
+
+// newTestMux returns a udpMux with outbounds dialed by dial, and the client
+// side of its data link.
+func newTestMux(t *testing.T, dial func() (net.Conn, error)) (*udpMux, *ray.RayUDP) {
+	t.Helper()
+	ln := listen(t)
+	defer ln.Close()
+
+	srvCh := make(chan *ray.RayUDP, 1)
+	go func() {
+		tcp, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		laddr, _ := net.ResolveUDPAddr("udp", tcp.LocalAddr().String())
+		udp, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		r, err := ray.NegotiateKey(tcp, testKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		srvCh <- ray.NewRayUDP(udp, false, tcp, r)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli, err := ray.DialUDPContext(ctx, "udp", ln.Addr().String(), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	srv := <-srvCh
+	t.Cleanup(func() { srv.Close() })
+	// The server side replies to where the client is once read from it.
+	if _, err := cli.Write((&frame{typ: frameClose}).marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.Read(make([]byte, 65535)); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &udpMux{
+		dl: &dataLink{
+			opts: &ServerOptions{Dial: func(context.Context, *Request, string) (net.Conn, error) {
+				return dial()
+			}},
+			r:      &Request{Context: context.Background(), Network: "udp"},
+			target: "127.0.0.1:53",
+		},
+		ru:        srv,
+		upBytes:   relayBytes.With(sideServer, "up", "", ""),
+		downBytes: relayBytes.With(sideServer, "down", "", ""),
+		active:    udpFlows.With(sideServer, "", ""),
+		flows:     make(map[uint32]*muxFlow),
+	}
+	t.Cleanup(m.closeAll)
+	return m, cli
+}
+
+// readFrame reads a frame sent by the mux to cli.
+func readFrame(t *testing.T, cli *ray.RayUDP) *frame {
+	t.Helper()
+	buf := make([]byte, 65535)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := cli.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parseFrame(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// dialTo returns a dial function of UDP outbounds to pc.
+func dialTo(pc net.PacketConn) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return net.Dial("udp", pc.LocalAddr().String())
+	}
+}
+
+// listenUDP listens on a UDP port of loopback.
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func TestUDPMuxRefusal(t *testing.T) {
+	m, cli := newTestMux(t, dialTo(listenUDP(t)))
+
+	m.handle(&frame{flow: 1, typ: frameData, body: []byte("late")})
+	if f := readFrame(t, cli); f.flow != 1 || f.typ != frameClose || string(f.body) != "flow expired" {
+		t.Errorf("want CLOSE of expired flow 1, got %+v", f)
+	}
+
+	m.handle(&frame{flow: 2, typ: frameOpen, dest: "10.0.0.1:53", body: []byte("query")})
+	if f := readFrame(t, cli); f.flow != 2 || f.typ != frameClose || !strings.Contains(string(f.body), "not allowed") {
+		t.Errorf("want CLOSE of disallowed flow 2, got %+v", f)
+	}
+	if _, err := m.open(&frame{flow: 3, typ: frameOpen, dest: m.dl.target}); err != nil {
+		t.Errorf("want target as DEST allowed, got %v", err)
+	}
+}
+
+func TestUDPMuxMaxFlows(t *testing.T) {
+	m, _ := newTestMux(t, dialTo(listenUDP(t)))
+	for i := 0; i < maxUDPFlows; i++ {
+		m.flows[uint32(i)+100] = &muxFlow{}
+	}
+	if _, err := m.open(&frame{flow: 1, typ: frameOpen}); err == nil {
+		t.Fatal("want flow over maxUDPFlows refused")
+	}
+	clear(m.flows)
+}
+
+func TestUDPMuxFlowIdle(t *testing.T) {
+	m, _ := newTestMux(t, dialTo(listenUDP(t)))
+	for i, tc := range []struct{ idle, want time.Duration }{
+		{0, defaultFlowIdle},
+		{time.Second, time.Second},
+		{maxFlowIdle, maxFlowIdle},
+		{maxFlowIdle + time.Millisecond, maxFlowIdle},
+	} {
+		f, err := m.open(&frame{flow: uint32(i), typ: frameOpen, idle: tc.idle})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.idle != tc.want {
+			t.Errorf("idle %v: want %v, got %v", tc.idle, tc.want, f.idle)
+		}
+	}
+}
+
+func TestUDPMuxSlowDial(t *testing.T) {
+	pc := listenUDP(t)
+	release := make(chan struct{})
+	var dials atomic.Int32
+	dial := dialTo(pc)
+	m, _ := newTestMux(t, func() (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			<-release
+		}
+		return dial()
+	})
+
+	// Flow 1 is stuck dialing, its datagrams are queued meanwhile.
+	m.handle(&frame{flow: 1, typ: frameOpen, body: []byte("a")})
+	for dials.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	m.handle(&frame{flow: 1, typ: frameData, body: []byte("b")})
+	m.handle(&frame{flow: 2, typ: frameOpen, body: []byte("c")})
+
+	buf := make([]byte, 16)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err := pc.ReadFrom(buf); err != nil || string(buf[:n]) != "c" {
+		t.Fatalf("want flow 2 relayed while flow 1 dials, got %q, %v", buf[:n], err)
+	}
+	close(release)
+	for _, want := range []string{"a", "b"} {
+		if n, _, err := pc.ReadFrom(buf); err != nil || string(buf[:n]) != want {
+			t.Fatalf("want %q queued on flow 1, got %q, %v", want, buf[:n], err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/fishBone000/xcat/ray"
+	"github.com/fishBone000/xcat/util"
+)
+
+// UDPTransport is how UDP data links carry datagrams on client side.
+type UDPTransport int
+
+const (
+	// UDPAuto carries datagrams over UDP, but over the TCP connections of
+	// data links while UDP to the server is found blocked, which is probed
+	// again every [UDPReprobeInterval].
+	UDPAuto UDPTransport = iota
+	UDPNative
+	UDPOverTCP // Always over the TCP connections of data links
+)
+
+// UDPProbeTimeout is how long UDP probes are sent before UDP to the server
+// is considered blocked.
+const UDPProbeTimeout = 3 * time.Second
+
+// UDPReprobeInterval is how often UDP to the server is probed again.
+const UDPReprobeInterval = 30 * time.Second
+
+const udpProbeInterval = 250 * time.Millisecond
+
+// UDPProbeTimeout and UDPReprobeInterval, shortened by tests.
+var (
+	probeTimeout    = UDPProbeTimeout
+	reprobeInterval = UDPReprobeInterval
+)
+
+// tooLarge returns the error of a datagram over the payload MTU in err if
+// any, which is dropped without failing the relay.
+func tooLarge(err error) *ray.DatagramTooLargeError {
+	var e *ray.DatagramTooLargeError
+	if errors.As(err, &e) {
+		return e
+	}
+	return nil
+}
+
+func (t UDPTransport) String() string {
+	switch t {
+	case UDPAuto:
+		return "auto"
+	case UDPNative:
+		return "udp"
+	case UDPOverTCP:
+		return "tcp"
+	}
+	return "unknown"
+}
+
+// superviseTransport picks how ru carries datagrams until it's closed.
+// Servers not supporting streaming over TCP are left with UDP.
+func (st *clientState) superviseTransport(ru *ray.RayUDP) {
+	log := st.opts.Log.Named("udp")
+	overTCP := udpOverTCP.With(st.opts.Name, st.opts.User)
+	setStream := func(on bool) {
+		if on == ru.Stream() {
+			return
+		}
+		ru.SetStream(on)
+		if on {
+			overTCP.Inc()
+		} else {
+			overTCP.Dec()
+		}
+	}
+	defer setStream(false)
+
+	switch st.opts.UDPTransport {
+	case UDPNative:
+		return
+	case UDPOverTCP:
+		setStream(true)
+		select {
+		case <-ru.Done():
+			return
+		case <-time.After(probeTimeout):
+		}
+		if !ru.StreamSupported() {
+			log.Warnf("Server of UDP data link %s may not support relaying UDP over TCP. ", util.ConnStr(ru))
+		}
+		<-ru.Done()
+		return
+	}
+
+	if st.udpBlocked.Load() {
+		setStream(true)
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		ok := ru.ProbeUDP(ctx, udpProbeInterval)
+		cancel()
+		select {
+		case <-ru.Done():
+			return
+		default:
+		}
+
+		switch {
+		case ok:
+			setStream(false)
+			if st.udpBlocked.CompareAndSwap(true, false) {
+				log.Event("udp_restored").Infof("UDP to server %s is reachable again, relaying over UDP. ", st.opts.Server)
+			}
+		case !ru.StreamSupported():
+			// Old servers echo neither probes nor HELLO, UDP may be fine.
+			log.Debugf("Server of UDP data link %s doesn't support relaying UDP over TCP. ", util.ConnStr(ru))
+			return
+		case !ru.Stream():
+			setStream(true)
+			udpFallbacks.With(st.opts.Name, st.opts.User).Inc()
+			if st.udpBlocked.CompareAndSwap(false, true) {
+				log.Event("udp_blocked").Warnf("UDP to server %s seems blocked, relaying over TCP. ", st.opts.Server)
+			}
+		}
+
+		select {
+		case <-ru.Done():
+			return
+		case <-time.After(reprobeInterval):
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package tunnel
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fishBone000/xcat/ray"
+)
+
+// udpPair is a UDP data link whose datagrams over UDP pass a relay, which
+// drops them while drop is set.
+type udpPair struct {
+	cli, srv *ray.RayUDP // srv is nil for old servers
+	drop     atomic.Bool
+}
+
+// pairUDPLink returns a UDP data link and its other side, or an old server
+// neither echoing probes nor replying HELLO if old.
+func pairUDPLink(t *testing.T, old bool) *udpPair {
+	t.Helper()
+	ln := listen(t)
+	defer ln.Close()
+	p := &udpPair{}
+
+	srvCh := make(chan *ray.RayUDP, 1)
+	go func() {
+		tcp, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			srvCh <- nil
+			return
+		}
+		t.Cleanup(func() { tcp.Close() })
+		laddr, _ := net.ResolveUDPAddr("udp", tcp.LocalAddr().String())
+		udp, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			t.Error(err)
+			srvCh <- nil
+			return
+		}
+		t.Cleanup(func() { udp.Close() })
+		r, err := ray.NegotiateKey(tcp, testKey)
+		if err != nil || old {
+			srvCh <- nil
+			return
+		}
+		srvCh <- ray.NewRayUDP(udp, false, tcp, r)
+	}()
+
+	relay := listenUDP(t)
+	srvAddr, _ := net.ResolveUDPAddr("udp", ln.Addr().String())
+	go func() {
+		buf := make([]byte, 65535)
+		var cliAddr net.Addr
+		for {
+			n, from, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			switch {
+			case p.drop.Load():
+			case from.String() == srvAddr.String():
+				if cliAddr != nil {
+					relay.WriteTo(buf[:n], cliAddr)
+				}
+			default:
+				cliAddr = from
+				relay.WriteTo(buf[:n], srvAddr)
+			}
+		}
+	}()
+
+	tcp, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.DialUDP("udp", nil, relay.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tcp.Close()
+		t.Fatal(err)
+	}
+	r, err := ray.NegotiateKey(tcp, testKey)
+	if err != nil {
+		tcp.Close()
+		udp.Close()
+		t.Fatal(err)
+	}
+	p.cli = ray.NewRayUDP(udp, true, tcp, r)
+	t.Cleanup(func() { p.cli.Close() })
+	p.srv = <-srvCh
+	if p.srv != nil {
+		t.Cleanup(func() { p.srv.Close() })
+	}
+	return p
+}
+
+// exchangeUDP writes msg to from, and checks it read from to.
+func exchangeUDP(t *testing.T, from, to *ray.RayUDP, msg string) {
+	t.Helper()
+	if _, err := from.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 65535)
+		n, _ := to.Read(buf)
+		got <- string(buf[:n])
+	}()
+	select {
+	case p := <-got:
+		if p != msg {
+			t.Fatalf("want %q, got %q", msg, p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%q not relayed", msg)
+	}
+}
+
+// shortProbes shortens probing for the test.
+func shortProbes(t *testing.T) {
+	timeout, interval := probeTimeout, reprobeInterval
+	probeTimeout, reprobeInterval = 600*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() { probeTimeout, reprobeInterval = timeout, interval })
+}
+
+// supervise runs superviseTransport of st on ru, the returned channel is
+// closed once it returns.
+func supervise(st *clientState, ru *ray.RayUDP) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		st.superviseTransport(ru)
+		close(done)
+	}()
+	return done
+}
+
+func TestSuperviseTransport(t *testing.T) {
+	shortProbes(t)
+	p := pairUDPLink(t, false)
+	st := &clientState{opts: &ClientOptions{Name: "supervise", User: "alice"}}
+	overTCP := udpOverTCP.With("supervise", "alice")
+	done := supervise(st, p.cli)
+
+	exchangeUDP(t, p.cli, p.srv, "a")
+	waitUntil(t, "HELLO", p.cli.StreamSupported)
+	if p.cli.Stream() {
+		t.Fatal("want UDP while it's reachable")
+	}
+
+	p.drop.Store(true)
+	waitUntil(t, "fallback to stream", p.cli.Stream)
+	if !st.udpBlocked.Load() || overTCP.Get() != 1 {
+		t.Errorf("want UDP blocked and 1 link over TCP, got %v and %v", st.udpBlocked.Load(), overTCP.Get())
+	}
+	exchangeUDP(t, p.cli, p.srv, "b")
+	exchangeUDP(t, p.srv, p.cli, "c")
+	if !p.srv.Stream() {
+		t.Error("server not following client to stream")
+	}
+
+	p.drop.Store(false)
+	waitUntil(t, "UDP restored", func() bool { return !p.cli.Stream() })
+	if st.udpBlocked.Load() || overTCP.Get() != 0 {
+		t.Errorf("want UDP reachable and no links over TCP, got %v and %v", st.udpBlocked.Load(), overTCP.Get())
+	}
+	exchangeUDP(t, p.cli, p.srv, "d")
+	exchangeUDP(t, p.srv, p.cli, "e")
+	if p.srv.Stream() {
+		t.Error("server not following client back to UDP")
+	}
+
+	p.cli.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervision not stopped by closing")
+	}
+}
+
+func TestSuperviseTransportBlocked(t *testing.T) {
+	shortProbes(t)
+	p := pairUDPLink(t, false)
+	p.drop.Store(true)
+	// Found blocked by another data link.
+	st := &clientState{opts: &ClientOptions{}}
+	st.udpBlocked.Store(true)
+	done := supervise(st, p.cli)
+	waitUntil(t, "stream", p.cli.Stream)
+	exchangeUDP(t, p.cli, p.srv, "a")
+	p.cli.Close()
+	<-done
+}
+
+func TestSuperviseTransportOldServer(t *testing.T) {
+	shortProbes(t)
+	p := pairUDPLink(t, true)
+	st := &clientState{opts: &ClientOptions{}}
+	start := time.Now()
+	select {
+	case <-supervise(st, p.cli):
+	case <-time.After(5 * time.Second):
+		t.Fatal("want supervision stopped for old servers")
+	}
+	if d := time.Since(start); d < probeTimeout {
+		t.Errorf("stopped after %v, before probes time out", d)
+	}
+	if p.cli.Stream() || st.udpBlocked.Load() {
+		t.Error("want UDP kept for old servers")
+	}
+}
+
+// waitUntil polls cond until it's true, or fails the test after 5 seconds.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
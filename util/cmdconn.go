@@ -0,0 +1,207 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// cmdWaitDelay is how long an exited or killed command may leave its stderr
+// open, e.g. by processes it started in the background, before it's closed.
+const cmdWaitDelay = 2 * time.Second
+
+// ShellCommand builds a command that runs s with the platform's shell,
+// so that arguments, quoting and redirections behave as users expect.
+func ShellCommand(ctx context.Context, s string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", s)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", s)
+}
+
+// CmdConn wires a running command's stdin and stdout to a [net.Conn], so that
+// it can be used with [Relay] like any other outbound.
+// Closing a CmdConn kills the command.
+type CmdConn struct {
+	cmd    *exec.Cmd
+	stdin  *os.File
+	stdout *os.File
+	laddr  net.Addr
+	raddr  net.Addr
+	cancel context.CancelFunc
+	done   chan struct{}
+	werr   error
+	closed FlagOnce
+}
+
+// StartCmdConn starts s with [ShellCommand] and environment env appended to
+// the current one.
+// Every line the command writes to stderr is passed to stderr along with its
+// pid, stderr may be nil.
+func StartCmdConn(s string, env []string, stderr func(pid int, line string)) (*CmdConn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := ShellCommand(ctx, s)
+	cmd.Env = append(cmd.Environ(), env...)
+	cmd.WaitDelay = cmdWaitDelay
+	killGroup(cmd)
+
+	// Pipes are created by hand rather than with StdinPipe and StdoutPipe,
+	// as Wait would close them while the relay may still be reading.
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		cancel()
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	errLines := &lineWriter{}
+	if stderr != nil {
+		// Process is set before stderr is copied.
+		errLines.line = func(l string) { stderr(cmd.Process.Pid, l) }
+	}
+	cmd.Stderr = errLines
+	err = cmd.Start()
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		cancel()
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, err
+	}
+
+	c := &CmdConn{
+		cmd:    cmd,
+		stdin:  stdinW,
+		stdout: stdoutR,
+		laddr:  NewStrAddr("exec", fmt.Sprintf("pid %d", cmd.Process.Pid)),
+		raddr:  NewStrAddr("exec", s),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		c.werr = cmd.Wait()
+		errLines.flush()
+		close(c.done)
+	}()
+
+	return c, nil
+}
+
+func (c *CmdConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *CmdConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+// Close kills the command, along with processes it started on unix, and waits
+// for it to exit.
+func (c *CmdConn) Close() error {
+	if !c.closed.Set() {
+		return net.ErrClosed
+	}
+	c.stdin.Close()
+	c.cancel()
+	<-c.done
+	return c.stdout.Close()
+}
+
+// Done is closed once the command has exited.
+func (c *CmdConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// ExitErr returns the error of the exited command.
+// It returns nil if the command has not exited yet, or if it exited normally.
+func (c *CmdConn) ExitErr() error {
+	select {
+	case <-c.done:
+	default:
+		return nil
+	}
+	var exitErr *exec.ExitError
+	if c.closed.Get() && (errors.Is(c.werr, context.Canceled) ||
+		errors.As(c.werr, &exitErr) && !exitErr.Exited()) {
+		// Killed by us.
+		return nil
+	}
+	return c.werr
+}
+
+func (c *CmdConn) Pid() int {
+	return c.cmd.Process.Pid
+}
+
+func (c *CmdConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *CmdConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *CmdConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
+
+func (c *CmdConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *CmdConn) SetWriteDeadline(t time.Time) error {
+	return c.stdin.SetWriteDeadline(t)
+}
+
+// lineWriter passes each line written to it to line, without the newline.
+// Lines longer than [bufio.MaxScanTokenSize] are split.
+type lineWriter struct {
+	line func(string) // Set before the first write
+	buf  []byte
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for {
+		if i := bytes.IndexByte(w.buf, '\n'); i >= 0 && i <= bufio.MaxScanTokenSize {
+			w.emit(w.buf[:i])
+			w.buf = w.buf[i+1:]
+		} else if len(w.buf) >= bufio.MaxScanTokenSize {
+			w.emit(w.buf[:bufio.MaxScanTokenSize])
+			w.buf = w.buf[bufio.MaxScanTokenSize:]
+		} else {
+			break
+		}
+	}
+	return len(b), nil
+}
+
+// flush passes the last line if not terminated by a newline.
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) emit(l []byte) {
+	if w.line != nil {
+		w.line(string(bytes.TrimSuffix(l, []byte{'\r'})))
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package util
+
+import "os/exec"
+
+// Process groups are not supported on this platform, only the command itself
+// is killed on cancel.
+func killGroup(cmd *exec.Cmd) {}
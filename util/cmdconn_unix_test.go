@@ -0,0 +1,158 @@
+//go:build unix
+
+package util
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitDone waits for c to exit, or fails the test after d.
+func waitDone(t *testing.T, c *CmdConn, d time.Duration) {
+	t.Helper()
+	select {
+	case <-c.Done():
+	case <-time.After(d):
+		t.Fatalf("command not exited in %v", d)
+	}
+}
+
+// alive reports whether the process of pid is running, zombies are not.
+func alive(pid int) bool {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return false
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	// pid (comm) state ...
+	i := strings.LastIndexByte(string(stat), ')')
+	return i < 0 || i+2 >= len(stat) || stat[i+2] != 'Z'
+}
+
+func TestCmdConnCat(t *testing.T) {
+	c, err := StartCmdConn("cat", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"hello\n", "world\n"} {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Errorf("want %q, got %q", msg, got)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ExitErr(); err != nil {
+		t.Errorf("want no exit error when killed by Close, got %v", err)
+	}
+	if err := c.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("want closed twice, got %v", err)
+	}
+}
+
+func TestCmdConnKillGroup(t *testing.T) {
+	c, err := StartCmdConn("sleep 60 & echo $!; wait", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	child, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	if !alive(child) {
+		t.Fatalf("child %d not started", child)
+	}
+
+	c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for alive(child) {
+		if time.Now().After(deadline) {
+			syscall.Kill(child, syscall.SIGKILL)
+			t.Fatalf("child %d outlived the closed command", child)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCmdConnWaitDelay(t *testing.T) {
+	// The shell exits, but the child keeps stderr open.
+	c, err := StartCmdConn("sleep 60 & exit 0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(-c.Pid(), syscall.SIGKILL)
+	start := time.Now()
+	waitDone(t, c, cmdWaitDelay+3*time.Second)
+	if d := time.Since(start); d < cmdWaitDelay/2 {
+		t.Errorf("want stderr waited for about %v, done after %v", cmdWaitDelay, d)
+	}
+}
+
+func TestCmdConnStderr(t *testing.T) {
+	var mux sync.Mutex
+	var pids []int
+	var lines []string
+	c, err := StartCmdConn(`printf 'a\nb\r\n%s' "$X" >&2`, []string{"X=c"}, func(pid int, line string) {
+		mux.Lock()
+		defer mux.Unlock()
+		pids = append(pids, pid)
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitDone(t, c, 5*time.Second)
+	if err := c.ExitErr(); err != nil {
+		t.Errorf("want exited normally, got %v", err)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if want := []string{"a", "b", "c"}; strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("want lines %q, got %q", want, lines)
+	}
+	for _, pid := range pids {
+		if pid != c.Pid() {
+			t.Errorf("want pid %d, got %d", c.Pid(), pid)
+		}
+	}
+}
+
+func TestLineWriterLong(t *testing.T) {
+	var lines []string
+	w := &lineWriter{line: func(l string) { lines = append(lines, l) }}
+	long := strings.Repeat("x", bufio.MaxScanTokenSize+1)
+	w.Write([]byte(long[:10]))
+	w.Write([]byte(long[10:] + "\ny"))
+	w.flush()
+	if len(lines) != 3 || len(lines[0]) != bufio.MaxScanTokenSize || lines[1] != "x" || lines[2] != "y" {
+		t.Errorf("want a long line split, got %d lines", len(lines))
+	}
+}
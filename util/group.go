@@ -0,0 +1,134 @@
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Group tracks active members, like relays, so that they can be waited for or
+// closed all at once.
+type Group struct {
+	mux     sync.Mutex
+	members map[*Member]struct{}
+	idle    chan struct{}
+	closed  bool
+}
+
+// Member is a member of a [Group], holding closers of its resources.
+type Member struct {
+	g       *Group
+	closers []io.Closer
+	closed  bool // By Close
+}
+
+// Join adds a new member holding closers c.
+// If the group has been closed, c are closed at once.
+func (g *Group) Join(c ...io.Closer) *Member {
+	m := &Member{g: g}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.members == nil {
+		g.members = make(map[*Member]struct{})
+	}
+	g.members[m] = struct{}{}
+	m.attachNoLock(c...)
+	return m
+}
+
+// Attach adds closers c to m, c are closed at once if m or the group has
+// been closed.
+func (m *Member) Attach(c ...io.Closer) {
+	m.g.mux.Lock()
+	defer m.g.mux.Unlock()
+	m.attachNoLock(c...)
+}
+
+func (m *Member) attachNoLock(c ...io.Closer) {
+	if m.g.closed || m.closed {
+		for _, c := range c {
+			go CloseCloser(c)
+		}
+		return
+	}
+	m.closers = append(m.closers, c...)
+}
+
+// Leave removes m from its group, it doesn't close anything.
+func (m *Member) Leave() {
+	g := m.g
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	delete(g.members, m)
+	if len(g.members) == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+// Close closes closers of m, and those attached later.
+// m still has to leave by itself.
+func (m *Member) Close() error {
+	m.g.mux.Lock()
+	m.closed = true
+	closers := m.closers
+	m.closers = nil
+	m.g.mux.Unlock()
+
+	for _, c := range closers {
+		CloseCloser(c)
+	}
+	return nil
+}
+
+func (g *Group) Len() int {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return len(g.members)
+}
+
+// Wait waits until all members have left, and reports whether it was so
+// before timeout. A timeout of 0 means no timeout.
+func (g *Group) Wait(timeout time.Duration) bool {
+	g.mux.Lock()
+	if len(g.members) == 0 {
+		g.mux.Unlock()
+		return true
+	}
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+	}
+	idle := g.idle
+	g.mux.Unlock()
+
+	if timeout == 0 {
+		<-idle
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Close closes all closers of current members, and those attached later.
+// Members still have to leave by themselves.
+func (g *Group) Close() error {
+	g.mux.Lock()
+	g.closed = true
+	var closers []io.Closer
+	for m := range g.members {
+		closers = append(closers, m.closers...)
+		m.closers = nil
+	}
+	g.mux.Unlock()
+
+	for _, c := range closers {
+		CloseCloser(c)
+	}
+	return nil
+}
@@ -2,8 +2,11 @@ package util
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 )
@@ -72,11 +75,38 @@ func ListenMultipleTCP(network, addr string) (*MultiListenerTCP, error) {
 		return nil, err
 	}
 
+	return newMultiListenerTCP(ls, NewStrAddr(network, net.JoinHostPort(host, port))), nil
+}
+
+// FileMultiListenerTCP makes a MultiListenerTCP of already listening sockets,
+// e.g. inherited from a parent process, addr is used as its address.
+// It's the reverse of [MultiListenerTCP.Files]. files are not closed.
+func FileMultiListenerTCP(files []*os.File, addr string) (*MultiListenerTCP, error) {
+	ls := make([]*net.TCPListener, 0, len(files))
+	for _, f := range files {
+		l, err := net.FileListener(f)
+		if err == nil {
+			if tl, ok := l.(*net.TCPListener); ok {
+				ls = append(ls, tl)
+				continue
+			}
+			l.Close()
+			err = fmt.Errorf("%s is not a TCP listener", f.Name())
+		}
+		for _, l := range ls {
+			CloseCloser(l)
+		}
+		return nil, err
+	}
+	return newMultiListenerTCP(ls, NewStrAddr("tcp", addr)), nil
+}
+
+func newMultiListenerTCP(ls []*net.TCPListener, addr net.Addr) *MultiListenerTCP {
 	ml := &MultiListenerTCP{
 		connChan: make(chan net.Conn),
 		ls:       ls,
 		errs:     make([]error, len(ls)),
-		addr:     NewStrAddr(network, net.JoinHostPort(host, port)),
+		addr:     addr,
 	}
 	for i, l := range ls {
 		go func(i int, l net.Listener) {
@@ -95,7 +125,7 @@ func ListenMultipleTCP(network, addr string) (*MultiListenerTCP, error) {
 		}(i, l)
 	}
 
-	return ml, nil
+	return ml
 }
 
 func (ml *MultiListenerTCP) Accept() (net.Conn, error) {
@@ -126,6 +156,26 @@ func (ml *MultiListenerTCP) Addr() net.Addr {
 	return ml.addr
 }
 
+// Files returns duplicates of the underlying sockets, to be handed off to
+// another process. Closing them doesn't affect ml.
+func (ml *MultiListenerTCP) Files() ([]*os.File, error) {
+	ml.mux.Lock()
+	defer ml.mux.Unlock()
+
+	files := make([]*os.File, 0, len(ml.ls))
+	for _, l := range ml.ls {
+		f, err := l.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
 func (ml *MultiListenerTCP) SetDeadline(t time.Time) (err error) {
 	for _, l := range ml.ls {
 		err = l.SetDeadline(t)
@@ -136,6 +186,10 @@ func (ml *MultiListenerTCP) SetDeadline(t time.Time) (err error) {
 	return
 }
 
+// udpAcceptBacklog is how many new UDP inbounds may wait for Accept, the
+// oldest is dropped when exceeded.
+const udpAcceptBacklog = 128
+
 type MultiListenerUDP struct {
 	mux sync.Mutex
 
@@ -143,8 +197,10 @@ type MultiListenerUDP struct {
 	connsTableByLAddr map[string]map[string]*UDPConn // Local Address -> Remote Address -> UDPCOnn
 	acceptQueue       chan *UDPConn
 	addr              *StrAddr
+	filter            func(raddr net.Addr) bool
 
-	fatal Fatal
+	fatal   Fatal
+	stopped FlagOnce // New remote addresses are dropped once set
 }
 
 func ListenMultipleUDP(network, addr string) (*MultiListenerUDP, error) {
@@ -182,7 +238,7 @@ func ListenMultipleUDP(network, addr string) (*MultiListenerUDP, error) {
 	d := &MultiListenerUDP{
 		netConnsByAddr:    make(map[string]*net.UDPConn),
 		connsTableByLAddr: make(map[string]map[string]*UDPConn),
-		acceptQueue:       make(chan *UDPConn),
+		acceptQueue:       make(chan *UDPConn, udpAcceptBacklog),
 		addr:              NewStrAddr(network, net.JoinHostPort(host, port)),
 	}
 
@@ -223,21 +279,67 @@ func (l *MultiListenerUDP) Accept() (*UDPConn, error) {
 	select {
 	case conn := <-l.acceptQueue:
 		return conn, nil
-	case <-l.fatal.ch:
+	case <-l.fatal.Chan():
 		return nil, l.fatal.Get()
+	case <-l.stopped.Chan():
+		return nil, net.ErrClosed
+	}
+}
+
+// StopAccepting drops packets from new remote addresses, including those
+// waiting for Accept, which returns net.ErrClosed afterwards. UDPConns
+// accepted keep working until Close.
+func (l *MultiListenerUDP) StopAccepting() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if !l.stopped.Set() {
+		return
+	}
+	for {
+		select {
+		case c := <-l.acceptQueue:
+			delete(l.connsTableByLAddr[c.laddr.String()], c.RemoteAddr().String())
+		default:
+			return
+		}
 	}
 }
 
+// Close closes all underlying sockets, Accept and Read calls of UDPConns
+// return net.ErrClosed afterwards.
+func (l *MultiListenerUDP) Close() error {
+	if !l.fatal.Set(net.ErrClosed) {
+		return net.ErrClosed
+	}
+	errs := make([]error, 0, len(l.netConnsByAddr))
+	for _, conn := range l.netConnsByAddr {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
 func (l *MultiListenerUDP) Addr() net.Addr {
 	return l.addr
 }
 
+// SetFilter sets a function to decide whether packets from a new remote
+// address should be accepted. Packets from rejected addresses are dropped.
+func (l *MultiListenerUDP) SetFilter(filter func(raddr net.Addr) bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.filter = filter
+}
+
 func (l *MultiListenerUDP) pushAcceptQueueNoLock(c *UDPConn) {
 	select {
 	case l.acceptQueue <- c:
 	default:
-		discard := <-l.acceptQueue
-		delete(l.connsTableByLAddr[discard.laddr.String()], discard.RemoteAddr().String())
+		// Queue is full, drop the oldest. Accept may have drained it meanwhile.
+		select {
+		case discard := <-l.acceptQueue:
+			delete(l.connsTableByLAddr[discard.laddr.String()], discard.RemoteAddr().String())
+		default:
+		}
 		l.acceptQueue <- c
 	}
 }
@@ -252,6 +354,10 @@ func (l *MultiListenerUDP) run() {
 
 				l.mux.Lock()
 				conn := l.connsTableByLAddr[laddr][addr.String()]
+				if conn == nil && err == nil && (l.stopped.Get() || l.filter != nil && !l.filter(addr)) {
+					l.mux.Unlock()
+					continue
+				}
 				if conn == nil {
 					conn = &UDPConn{
 						l:      l,
@@ -307,6 +413,8 @@ func (c *UDPConn) Read() ([]byte, error) {
 		return b, nil
 	case <-c.l.fatal.Chan():
 		return nil, c.l.fatal.Get()
+	case <-c.closed.Chan():
+		return nil, net.ErrClosed
 	}
 }
 
@@ -346,3 +454,68 @@ func (c *UDPConn) pushBuffer(p []byte) {
 		c.buffer <- p
 	}
 }
+
+// UnixPrefix marks an address as a unix domain socket path, e.g.
+// "unix:/run/xcat.sock".
+const UnixPrefix = "unix:"
+
+// SplitUnixAddr returns the socket path of addr and true if addr carries
+// [UnixPrefix].
+func SplitUnixAddr(addr string) (path string, ok bool) {
+	return strings.CutPrefix(addr, UnixPrefix)
+}
+
+// ListenStream listens on a unix domain socket if addr carries [UnixPrefix],
+// in which case the socket file is given permission perm.
+// Otherwise it's equivalent to ListenMultipleTCP("tcp", addr).
+func ListenStream(addr string, perm os.FileMode) (net.Listener, error) {
+	if path, ok := SplitUnixAddr(addr); ok {
+		return ListenUnix(path, perm)
+	}
+	return ListenMultipleTCP("tcp", addr)
+}
+
+// ListenUnix listens on the unix domain socket at path, removing the socket
+// file left by a previous process if no one is listening on it anymore.
+// The socket file is removed when the listener is closed.
+func ListenUnix(path string, perm os.FileMode) (*net.UnixListener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	// The socket file is created accessible to us only, so that no one
+	// connects before it's chmod to perm.
+	var l *net.UnixListener
+	var err error
+	withUmask(0177, func() {
+		l, err = net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("chmod socket %s: %w", path, err)
+	}
+	return l, nil
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package util
+
+// There's no umask on this platform, f is run as is.
+func withUmask(mask int, f func()) {
+	f()
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// dialUDP dials a socket of l from a new UDP socket.
+func dialUDP(t *testing.T, l *MultiListenerUDP) *net.UDPConn {
+	t.Helper()
+	var raddr *net.UDPAddr
+	for _, conn := range l.netConnsByAddr {
+		raddr = conn.LocalAddr().(*net.UDPAddr)
+	}
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func readUDPConn(t *testing.T, c *UDPConn) string {
+	t.Helper()
+	done := make(chan []byte, 1)
+	go func() {
+		p, _ := c.Read()
+		done <- p
+	}()
+	select {
+	case p := <-done:
+		return string(p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out reading")
+		return ""
+	}
+}
+
+func TestStopAccepting(t *testing.T) {
+	l, err := ListenMultipleUDP("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	a := dialUDP(t, l)
+	a.Write([]byte("a"))
+	ca, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := readUDPConn(t, ca); p != "a" {
+		t.Fatalf("want a, got %q", p)
+	}
+
+	l.StopAccepting()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("want Accept closed, got %v", err)
+	}
+	b := dialUDP(t, l)
+	b.Write([]byte("b"))
+	a.Write([]byte("c"))
+	if p := readUDPConn(t, ca); p != "c" {
+		t.Fatalf("want c on accepted conn, got %q", p)
+	}
+	if _, err := ca.Write([]byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	if n, err := a.Read(buf); err != nil || string(buf[:n]) != "d" {
+		t.Fatalf("want d from accepted conn, got %q, %v", buf[:n], err)
+	}
+	l.mux.Lock()
+	n := len(l.connsTableByLAddr[ca.LocalAddr().String()])
+	l.mux.Unlock()
+	if n != 1 {
+		t.Errorf("want new remote address dropped, got %d conns", n)
+	}
+
+	ca.Close()
+	if _, err := ca.Read(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("want Read closed, got %v", err)
+	}
+}
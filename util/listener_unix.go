@@ -0,0 +1,20 @@
+//go:build unix
+
+package util
+
+import (
+	"sync"
+	"syscall"
+)
+
+var umaskMux sync.Mutex
+
+// withUmask runs f with the umask of the process set to mask.
+// The umask is process wide, files created by others meanwhile are affected.
+func withUmask(mask int, f func()) {
+	umaskMux.Lock()
+	defer umaskMux.Unlock()
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	f()
+}
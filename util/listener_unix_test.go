@@ -0,0 +1,95 @@
+//go:build unix
+
+package util
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x.sock")
+	old, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Left behind as by a crashed process.
+	old.SetUnlinkOnClose(false)
+	old.Close()
+
+	l, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("want stale socket replaced, got %v", err)
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("want socket removed on close, got %v", err)
+	}
+}
+
+func TestListenUnixLive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x.sock")
+	l, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	if l2, err := ListenUnix(path, 0600); err == nil {
+		l2.Close()
+		t.Fatal("want socket in use refused")
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("want live socket kept, got %v", err)
+	}
+	c.Close()
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "x.sock")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := ListenUnix(path, 0600); err == nil {
+		l.Close()
+		t.Fatal("want non-socket file refused")
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "data" {
+		t.Errorf("want file kept, got %q, %v", b, err)
+	}
+}
+
+func TestListenUnixPerm(t *testing.T) {
+	for _, perm := range []os.FileMode{0600, 0660} {
+		path := filepath.Join(t.TempDir(), "x.sock")
+		l, err := ListenUnix(path, perm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(path)
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != perm {
+			t.Errorf("want socket of mode %v, got %v", perm, fi.Mode())
+		}
+	}
+}
@@ -42,28 +42,31 @@ func (c *AddrConn) RemoteAddr() net.Addr {
 	return c.raddr
 }
 
+// listenerLog logs closing of connections and listeners.
+var listenerLog = log.Named("listener")
+
 func CloseCloser(c io.Closer) {
   err := c.Close()
 	switch c := c.(type) {
 	case net.Conn:
-		log.Debugf("close %s connection %s", c.LocalAddr().Network(), ConnStr(c))
+		listenerLog.Debugf("close %s connection %s", c.LocalAddr().Network(), ConnStr(c))
 		if err != nil && !errors.Is(err, net.ErrClosed) {
-			log.Debugf("close %s connection %s: %w", c.LocalAddr().Network(), ConnStr(c), err)
+			listenerLog.Debugf("close %s connection %s: %v", c.LocalAddr().Network(), ConnStr(c), err)
 		}
 	case *UDPConn:
-		log.Debugf("close %s connection %s", c.LocalAddr().Network(), ConnStr(c))
+		listenerLog.Debugf("close %s connection %s", c.LocalAddr().Network(), ConnStr(c))
 		if err != nil && !errors.Is(err, net.ErrClosed) {
-			log.Debugf("close %s connection %s: %w", c.LocalAddr().Network(), ConnStr(c), err)
+			listenerLog.Debugf("close %s connection %s: %v", c.LocalAddr().Network(), ConnStr(c), err)
 		}
 	case net.Listener:
-		log.Debugf("close %s listener %s", c.Addr().Network(), c.Addr())
+		listenerLog.Debugf("close %s listener %s", c.Addr().Network(), c.Addr())
 		if err != nil && !errors.Is(err, net.ErrClosed) {
-			log.Debugf("close %s listener %s: %w", c.Addr().Network(), c.Addr(), err)
+			listenerLog.Debugf("close %s listener %s: %v", c.Addr().Network(), c.Addr(), err)
 		}
 	default:
-		log.Debugf("close %T", c)
+		listenerLog.Debugf("close %T", c)
 		if err != nil && !errors.Is(err, net.ErrClosed) {
-			log.Debugf("close %T: %w", c, err)
+			listenerLog.Debugf("close %T: %v", c, err)
 		}
 	}
 }
@@ -230,3 +233,39 @@ func (c *Counter) Clear() int {
 	c.cnt = 0
 	return ret
 }
+
+// Quota counts usage by key, and refuses usage beyond a limit.
+type Quota struct {
+	mux  sync.Mutex
+	used map[string]int
+}
+
+// Acquire increases the usage of key by one and returns true, unless it has
+// reached limit. A limit not positive means unlimited.
+func (q *Quota) Acquire(key string, limit int) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.used == nil {
+		q.used = make(map[string]int)
+	}
+	if limit > 0 && q.used[key] >= limit {
+		return false
+	}
+	q.used[key]++
+	return true
+}
+
+func (q *Quota) Release(key string) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.used[key]--
+	if q.used[key] <= 0 {
+		delete(q.used, key)
+	}
+}
+
+func (q *Quota) Used(key string) int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.used[key]
+}